@@ -0,0 +1,352 @@
+package toyredis
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy tells how often the append only file is synced to disk
+type FsyncPolicy int
+
+const (
+	// at most one second of writes is lost on a crash
+	FsyncEverySec FsyncPolicy = iota
+	// sync after every write command
+	FsyncAlways
+	// leave it to the operating system
+	FsyncNo
+)
+
+var fsyncPolicyNames = []string{
+	FsyncEverySec: "everysec",
+	FsyncAlways:   "always",
+	FsyncNo:       "no",
+}
+
+func (p FsyncPolicy) String() string {
+	return fsyncPolicyNames[p]
+}
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	for p, name := range fsyncPolicyNames {
+		if name == s {
+			return FsyncPolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid appendfsync: %s", s)
+}
+
+var rewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// aof logs write commands in the request format of the protocol, so that
+// replaying the file rebuilds the data set.
+type aof struct {
+	mu       sync.Mutex
+	path     string
+	f        *os.File
+	bw       *bufio.Writer
+	wr       *Writer
+	fsync    FsyncPolicy
+	lastSync time.Time
+	// database selected in the file, -1 if unknown
+	db int
+	// commands logged while a rewrite is in progress, they are appended
+	// to the rewritten file once it is complete
+	rewriteBuf *bytes.Buffer
+}
+
+func openAOF(path string, fsync FsyncPolicy) (*aof, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &aof{
+		path:     path,
+		f:        f,
+		bw:       bufio.NewWriter(f),
+		fsync:    fsync,
+		lastSync: time.Now(),
+		db:       -1,
+	}
+	a.wr = NewWriter(a.bw)
+	return a, nil
+}
+
+func (a *aof) write(args []string) {
+	a.wr.Request(args)
+	if a.rewriteBuf != nil {
+		NewWriter(a.rewriteBuf).Request(args)
+	}
+}
+
+// append logs commands that were run against database db
+func (a *aof) append(db int, cmds [][]string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if db != a.db {
+		a.write([]string{"select", strconv.Itoa(db)})
+		a.db = db
+	}
+	for _, args := range cmds {
+		a.write(args)
+	}
+	if err := a.bw.Flush(); err != nil {
+		return err
+	}
+	if a.fsync == FsyncAlways {
+		return a.f.Sync()
+	}
+	return nil
+}
+
+// syncIfDue syncs the file once per second under the everysec policy
+func (a *aof) syncIfDue() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.fsync != FsyncEverySec || time.Since(a.lastSync) < time.Second {
+		return
+	}
+	if err := a.f.Sync(); err != nil {
+		log.Println(err)
+	}
+	a.lastSync = time.Now()
+}
+
+func (a *aof) setFsync(fsync FsyncPolicy) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.fsync = fsync
+}
+
+func (a *aof) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.bw.Flush(); err != nil {
+		return err
+	}
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	return a.f.Close()
+}
+
+// startRewrite starts buffering the logged commands. The caller copies
+// the data set before any other write can run.
+func (a *aof) startRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriteBuf != nil {
+		return rewriteInProgress
+	}
+	a.rewriteBuf = new(bytes.Buffer)
+	// the buffered commands must not depend on the old file
+	a.db = -1
+	return nil
+}
+
+func (a *aof) rewriting() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.rewriteBuf != nil
+}
+
+// finishRewrite appends the buffered commands to the rewritten file f and
+// replaces the log with it. On error the rewrite is abandoned and the
+// current file is kept.
+func (a *aof) finishRewrite(f *os.File, err error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	buf := a.rewriteBuf
+	a.rewriteBuf = nil
+	if err == nil {
+		_, err = f.Write(buf.Bytes())
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = a.bw.Flush()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), a.path)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		return err
+	}
+
+	a.f.Close()
+	a.f = f
+	a.bw.Reset(f)
+	return nil
+}
+
+// batch size of the commands that recreate collections in a rewrite
+const rewriteBatch = 64
+
+// rewriteEntry returns the commands that recreate an entry
+func rewriteEntry(kv *entry) (cmds [][]string) {
+	// appends args to the last command, or starts a new one with prefix
+	// once it holds rewriteBatch items
+	items := 0
+	add := func(prefix []string, args ...string) {
+		if items%rewriteBatch == 0 {
+			cmds = append(cmds, append([]string(nil), prefix...))
+		}
+		cmds[len(cmds)-1] = append(cmds[len(cmds)-1], args...)
+		items++
+	}
+
+	switch v := kv.value.(type) {
+	case []byte:
+		add([]string{"set", kv.key}, string(v))
+	case map[string][]byte:
+		for vk, vv := range v {
+			add([]string{"hmset", kv.key}, vk, string(vv))
+		}
+	case *list.List:
+		for e := v.Front(); e != nil; e = e.Next() {
+			add([]string{"rpush", kv.key}, string(e.Value.([]byte)))
+		}
+	case map[string]struct{}:
+		for m := range v {
+			add([]string{"sadd", kv.key}, m)
+		}
+	case *zset:
+		for x := v.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			add([]string{"zadd", kv.key}, formatFloat(x.score), x.member)
+		}
+	}
+	if kv.expire != nilTime {
+		at := strconv.FormatInt(fromTime(kv.expire, time.Millisecond), 10)
+		cmds = append(cmds, []string{"pexpireat", kv.key, at})
+	}
+	return
+}
+
+// writeRewrite writes the commands that recreate the entries of each
+// database to a temporary file next to path
+func writeRewrite(path string, dbs [][]*entry) (f *os.File, err error) {
+	f, err = os.CreateTemp(filepath.Dir(path), "temp-rewriteaof-*.aof")
+	if err != nil {
+		return
+	}
+	bw := bufio.NewWriter(f)
+	wr := NewWriter(bw)
+	for i, entries := range dbs {
+		if len(entries) == 0 {
+			continue
+		}
+		wr.Request([]string{"select", strconv.Itoa(i)})
+		for _, kv := range entries {
+			for _, args := range rewriteEntry(kv) {
+				wr.Request(args)
+			}
+		}
+	}
+	return f, bw.Flush()
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return
+}
+
+// loadAOF replays the append only file at path with the command handlers.
+// A command cut short at the end of the file, as left by a crash in the
+// middle of a write, is dropped and the file truncated after the last
+// complete command.
+func (s *server) loadAOF(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	cr := &countingReader{r: f}
+	rd := NewReader(cr)
+	// replies are discarded
+	bw := bufio.NewWriter(io.Discard)
+	cn := &Conn{bw: bw, wr: NewWriter(bw)}
+	var valid int64
+	// the commands of a transaction are applied once its EXEC is read, a
+	// transaction the file ends in is discarded
+	var queued [][]string
+	multiAt := int64(-1)
+	for {
+		ss, err := rd.ReadRequest()
+		if err == io.EOF && valid == cr.n && multiAt < 0 {
+			return nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if multiAt >= 0 {
+				valid = multiAt
+			}
+			log.Printf("truncated append only file, discarding the last %d bytes", cr.n-valid)
+			return os.Truncate(path, valid)
+		}
+		if err != nil || len(ss) == 0 {
+			return fmt.Errorf("bad append only file format at byte %d", valid)
+		}
+		start := valid
+		valid = cr.n - int64(rd.rd.Buffered())
+
+		switch cmd := strings.ToLower(ss[0]); {
+		case cmd == "multi":
+			multiAt = start
+		case cmd == "exec":
+			for _, args := range queued {
+				if err = s.replay(cn, args); err != nil {
+					return fmt.Errorf("error replaying append only file at byte %d: %v", valid, err)
+				}
+			}
+			queued, multiAt = nil, -1
+		case multiAt >= 0:
+			queued = append(queued, ss)
+		default:
+			if err = s.replay(cn, ss); err != nil {
+				return fmt.Errorf("error replaying append only file at byte %d: %v", valid, err)
+			}
+		}
+	}
+}
+
+// replay runs a command of the log
+func (s *server) replay(cn *Conn, ss []string) error {
+	cmd := s.lookupCommand(strings.ToLower(ss[0]))
+	if cmd == nil {
+		return unsupportedRequest
+	}
+	return s.dispatch(cn, cmd, ss)
+}
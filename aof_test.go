@@ -0,0 +1,140 @@
+package toyredis
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendCommands runs the commands on a new connection and returns their
+// replies, bulk strings as their content and other replies as their line.
+func sendCommands(t *testing.T, port string, cmds ...[]string) []string {
+	cn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+	bw := bufio.NewWriter(cn)
+	wr := NewWriter(bw)
+	rd := NewReader(cn)
+	replies := make([]string, len(cmds))
+	for i, args := range cmds {
+		wr.Request(args)
+		bw.Flush()
+		line, err := rd.readline()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line[0] == StringReply && string(line) != "$-1" {
+			if line, err = rd.readline(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		replies[i] = string(line)
+	}
+	return replies
+}
+
+func TestAOF(t *testing.T) {
+	cfg := Config{
+		Port:        "6792",
+		SizeLimit:   20,
+		Dir:         t.TempDir(),
+		AppendOnly:  true,
+		AppendFsync: FsyncAlways,
+	}
+	path := filepath.Join(cfg.Dir, defaultAOFilename)
+	server := NewServerWithConfig(cfg)
+	replies := sendCommands(t, cfg.Port,
+		[]string{"set", "foo", "bar", "ex", "100"},
+		[]string{"incr", "counter"},
+		[]string{"get", "foo"},
+		[]string{"select", "1"},
+		[]string{"sadd", "set", "a"},
+		[]string{"spop", "set"},
+		[]string{"rpush", "list", "a", "b"},
+	)
+	if strings.Join(replies, " ") != "+OK :1 bar +OK :1 a :2" {
+		t.Fatalf("unexpected replies %v", replies)
+	}
+	server.Stop()
+
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "pexpireat") || !strings.Contains(string(data), "srem") {
+		t.Fatalf("relative expires and spop should be rewritten, got %q", data)
+	}
+	if strings.Contains(string(data), "get") {
+		t.Fatal("read commands should not be logged.")
+	}
+
+	// a write cut short by a crash
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("*3\r\n$3\r\nset\r\n$1")
+	f.Close()
+
+	cfg.Port = "6793"
+	server = NewServerWithConfig(cfg)
+	if v, _ := server.dbs[0].Get("counter"); string(v) != "1" {
+		t.Fatalf("expected 1, got %s", v)
+	}
+	if at, _ := server.dbs[0].ExpireTime("foo"); time.Until(at) < 99*time.Second {
+		t.Fatalf("ttl should be kept, got %v", time.Until(at))
+	}
+	if n, _ := server.dbs[1].LLen("list"); n != 2 {
+		t.Fatalf("expected 2, got %d", n)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != int64(len(data)) {
+		t.Fatalf("file should be truncated to %d bytes, got %d", len(data), fi.Size())
+	}
+	server.Stop()
+
+	// a transaction cut short by a crash
+	f, _ = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("*1\r\n$5\r\nmulti\r\n*2\r\n$4\r\nincr\r\n$7\r\ncounter\r\n*3\r\n$3\r\nset\r\n$1")
+	f.Close()
+
+	cfg.Port = "6807"
+	server = NewServerWithConfig(cfg)
+	if v, _ := server.dbs[0].Get("counter"); string(v) != "1" {
+		t.Fatalf("expected 1, got %s", v)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != int64(len(data)) {
+		t.Fatalf("file should be truncated to %d bytes, got %d", len(data), fi.Size())
+	}
+
+	// rewrite
+	cmds := [][]string{}
+	for i := 0; i < 100; i++ {
+		cmds = append(cmds, []string{"incr", "counter"})
+	}
+	sendCommands(t, cfg.Port, cmds...)
+	replies = sendCommands(t, cfg.Port, []string{"bgrewriteaof"}, []string{"incr", "counter"})
+	if replies[0] != "+Background append only file rewriting started" {
+		t.Fatalf("unexpected reply %s", replies[0])
+	}
+	for i := 0; server.aof.rewriting(); i++ {
+		if i == 100 {
+			t.Fatal("rewrite did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sendCommands(t, cfg.Port, []string{"incr", "counter"})
+	server.Stop()
+	if data, _ = os.ReadFile(path); strings.Count(string(data), "incr") > 2 {
+		t.Fatalf("increments should be compacted, got %q", data)
+	}
+
+	cfg.Port = "6794"
+	server = NewServerWithConfig(cfg)
+	defer server.Stop()
+	if v, _ := server.dbs[0].Get("counter"); string(v) != "103" {
+		t.Fatalf("expected 103, got %s", v)
+	}
+	if n, _ := server.dbs[1].LLen("list"); n != 2 {
+		t.Fatalf("expected 2, got %d", n)
+	}
+}
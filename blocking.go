@@ -0,0 +1,325 @@
+package toyredis
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blocking commands wait for data when all the keys they are given are
+// empty. The waiters of a key are queued in the order they blocked, and
+// after each write the waiters of the keys it changed are served by the
+// connection that wrote, before execMu is released, so that no other
+// command can take the data in between.
+
+var (
+	negativeTimeout = errors.New("ERR timeout is negative")
+	invalidTimeout  = errors.New("ERR timeout is not a float or out of range")
+)
+
+type blockKey struct {
+	db  int
+	key string
+}
+
+// waiter is a connection blocked on some keys
+type waiter struct {
+	cn *Conn
+	// 0 to wait forever
+	timeout time.Duration
+	// run with execMu held exclusively, they try the command again on key
+	// and report whether it replied
+	serve func(key string) bool
+	// replies when the timeout elapses
+	timedOut func()
+
+	// guarded by blockMu
+	keys   []blockKey
+	elems  []*list.Element // in the queue of each key
+	queued bool
+	// closed once served
+	done chan struct{}
+}
+
+func parseTimeout(arg string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f*float64(time.Second) > math.MaxInt64 {
+		return 0, invalidTimeout
+	}
+	if f < 0 {
+		return 0, negativeTimeout
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// blockOn runs try on each key in order until one replies. If none does,
+// the connection is blocked on the keys and waits once the command
+// returns.
+func (s *server) blockOn(cn *Conn, keys []string, timeout time.Duration, try func(key string) (bool, error), timedOut func()) error {
+	for _, key := range keys {
+		if ok, err := try(key); err != nil || ok {
+			return err
+		}
+	}
+	// nothing changed yet
+	cn.propagated = [][]string{}
+	if cn.netConn == nil || cn.multi {
+		// replayed commands and transactions do not block
+		timedOut()
+		return nil
+	}
+
+	w := &waiter{
+		cn:      cn,
+		timeout: timeout,
+		serve: func(key string) bool {
+			ok, err := try(key)
+			return ok && err == nil
+		},
+		timedOut: timedOut,
+		queued:   true,
+		done:     make(chan struct{}),
+	}
+	s.blockMu.Lock()
+	defer s.blockMu.Unlock()
+	for _, key := range keys {
+		k := blockKey{cn.db, key}
+		q := s.blocked[k]
+		if q == nil {
+			q = list.New()
+			s.blocked[k] = q
+		}
+		w.keys = append(w.keys, k)
+		w.elems = append(w.elems, q.PushBack(w))
+	}
+	cn.waiter = w
+	return nil
+}
+
+// unblock removes w from the queues, blockMu must be held. It reports
+// whether w was still queued.
+func (s *server) unblock(w *waiter) bool {
+	if !w.queued {
+		return false
+	}
+	for i, k := range w.keys {
+		q := s.blocked[k]
+		q.Remove(w.elems[i])
+		if q.Len() == 0 {
+			delete(s.blocked, k)
+		}
+	}
+	w.queued = false
+	return true
+}
+
+// markReady records that key was changed, its waiters may be served
+func (s *server) markReady(key blockKey) {
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	s.ready[key] = true
+}
+
+// takeReady returns the keys changed since the last call
+func (s *server) takeReady() map[blockKey]bool {
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	ready := s.ready
+	s.ready = make(map[blockKey]bool)
+	return ready
+}
+
+// serveBlocked serves the waiters of the keys changed that hold data,
+// execMu must be held exclusively. Serving a waiter may feed the keys of
+// others, as BLMOVE does, so it goes on until no key is changed.
+func (s *server) serveBlocked() {
+	s.blockMu.Lock()
+	defer s.blockMu.Unlock()
+
+	for ready := s.takeReady(); len(ready) > 0; ready = s.takeReady() {
+		for k := range ready {
+			q := s.blocked[k]
+			for q != nil && q.Len() > 0 {
+				w := q.Front().Value.(*waiter)
+				if !w.serve(k.key) {
+					break
+				}
+				s.unblock(w)
+				s.wrote(w.cn, "", nil)
+				close(w.done)
+			}
+		}
+	}
+}
+
+// wait blocks until the waiter of cn is served, its timeout elapses or the
+// client disconnects
+func (s *server) wait(cn *Conn) {
+	w := cn.waiter
+	cn.waiter = nil
+	var timeout <-chan time.Time
+	if w.timeout > 0 {
+		timer := time.NewTimer(w.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	// the only way to notice a disconnection is to read
+	peeked := make(chan error, 1)
+	go func() {
+		_, err := cn.rd.rd.Peek(1)
+		peeked <- err
+	}()
+	peeking := peeked
+
+	for waiting := true; waiting; {
+		select {
+		case <-w.done:
+			waiting = false
+		case <-timeout:
+			if s.cancel(w) {
+				w.timedOut()
+			} else {
+				<-w.done
+			}
+			waiting = false
+		case err := <-peeking:
+			peeking = nil
+			if err != nil {
+				if !s.cancel(w) {
+					<-w.done
+				}
+				waiting = false
+			}
+			// otherwise the next command is waiting in the buffer
+		}
+	}
+	if peeking != nil {
+		// interrupt the read
+		cn.netConn.SetReadDeadline(time.Now())
+		<-peeked
+		cn.netConn.SetReadDeadline(time.Time{})
+	}
+}
+
+// cancel unblocks w unless it has been served
+func (s *server) cancel(w *waiter) bool {
+	s.blockMu.Lock()
+	defer s.blockMu.Unlock()
+
+	return s.unblock(w)
+}
+
+// handleBlockingPop parses BLPOP and BRPOP key [key ...] timeout
+func (s *server) handleBlockingPop(cn *Conn, ss []string, left bool) (err error) {
+	timeout, err := parseTimeout(ss[len(ss)-1])
+	if err != nil {
+		return
+	}
+	cmd := "rpop"
+	if left {
+		cmd = "lpop"
+	}
+	try := func(key string) (bool, error) {
+		var values [][]byte
+		var err error
+		if left {
+			values, err = s.db(cn).LPop(key, 1)
+		} else {
+			values, err = s.db(cn).RPop(key, 1)
+		}
+		if err != nil || len(values) == 0 {
+			return false, err
+		}
+		cn.wr.StringArray([][]byte{[]byte(key), values[0]})
+		cn.propagated = [][]string{{cmd, key}}
+		return true, nil
+	}
+	return s.blockOn(cn, ss[:len(ss)-1], timeout, try, func() { cn.wr.NullStringArray() })
+}
+
+// parseWhere parses the LEFT or RIGHT of LMOVE
+func parseWhere(arg string) (left bool, err error) {
+	switch strings.ToLower(arg) {
+	case "left":
+		return true, nil
+	case "right":
+		return false, nil
+	}
+	return false, syntaxError
+}
+
+func (s *server) handleLMove(cn *Conn, ss []string) (err error) {
+	srcLeft, err := parseWhere(ss[2])
+	if err != nil {
+		return
+	}
+	dstLeft, err := parseWhere(ss[3])
+	if err != nil {
+		return
+	}
+	value, err := s.db(cn).LMove(ss[0], ss[1], srcLeft, dstLeft)
+	if err != nil {
+		return
+	}
+	cn.wr.String(value)
+	return
+}
+
+// handleBlockingMove parses BLMOVE source destination LEFT|RIGHT
+// LEFT|RIGHT timeout
+func (s *server) handleBlockingMove(cn *Conn, ss []string) (err error) {
+	srcLeft, err := parseWhere(ss[2])
+	if err != nil {
+		return
+	}
+	dstLeft, err := parseWhere(ss[3])
+	if err != nil {
+		return
+	}
+	timeout, err := parseTimeout(ss[4])
+	if err != nil {
+		return
+	}
+	try := func(key string) (bool, error) {
+		value, err := s.db(cn).LMove(key, ss[1], srcLeft, dstLeft)
+		if err != nil || value == nil {
+			return false, err
+		}
+		cn.wr.String(value)
+		cn.propagated = [][]string{{"lmove", key, ss[1], ss[2], ss[3]}}
+		return true, nil
+	}
+	return s.blockOn(cn, ss[:1], timeout, try, func() { cn.wr.String(nil) })
+}
+
+// handleBlockingZPop parses BZPOPMIN and BZPOPMAX key [key ...] timeout
+func (s *server) handleBlockingZPop(cn *Conn, ss []string, max bool) (err error) {
+	timeout, err := parseTimeout(ss[len(ss)-1])
+	if err != nil {
+		return
+	}
+	cmd := "zpopmin"
+	if max {
+		cmd = "zpopmax"
+	}
+	try := func(key string) (bool, error) {
+		var members []ZMember
+		var err error
+		if max {
+			members, err = s.db(cn).ZPopMax(key, 1)
+		} else {
+			members, err = s.db(cn).ZPopMin(key, 1)
+		}
+		if err != nil || len(members) == 0 {
+			return false, err
+		}
+		m := members[0]
+		cn.wr.StringArray([][]byte{[]byte(key), []byte(m.Member), []byte(formatFloat(m.Score))})
+		cn.propagated = [][]string{{cmd, key}}
+		return true, nil
+	}
+	return s.blockOn(cn, ss[:len(ss)-1], timeout, try, func() { cn.wr.NullStringArray() })
+}
@@ -0,0 +1,125 @@
+package toyredis
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendBlocking sends a blocking command on a new connection and returns the
+// connection and where its array reply is sent
+func sendBlocking(t *testing.T, s *server, port string, args ...string) (net.Conn, <-chan string) {
+	blocked := countBlocked(s)
+	cn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw := bufio.NewWriter(cn)
+	NewWriter(bw).Request(args)
+	bw.Flush()
+	reply := make(chan string, 1)
+	go func() {
+		ss, _ := NewReader(cn).ReadRequest()
+		reply <- strings.Join(ss, " ")
+	}()
+
+	// wait until it is blocked, or has replied
+	for countBlocked(s) == blocked && len(reply) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cn, reply
+}
+
+// countBlocked returns the number of keys waiters are blocked on
+func countBlocked(s *server) (n int) {
+	s.blockMu.Lock()
+	defer s.blockMu.Unlock()
+
+	for _, q := range s.blocked {
+		n += q.Len()
+	}
+	return
+}
+
+func TestBlocking(t *testing.T) {
+	server := NewServerWithConfig(Config{Port: "6799", SizeLimit: 20})
+	defer server.Stop()
+
+	sendCommands(t, "6799", []string{"rpush", "list", "a"})
+	cn, reply := sendBlocking(t, server, "6799", "blpop", "none", "list", "0")
+	if r := <-reply; r != "list a" {
+		t.Fatalf("expected list a, got %s", r)
+	}
+	cn.Close()
+	replies := sendCommands(t, "6799",
+		[]string{"blpop", "none", "0.05"},
+		[]string{"blpop", "none", "-1"},
+		[]string{"set", "str", "1"},
+		[]string{"blpop", "str", "0"},
+		[]string{"lmove", "none", "list", "left", "right"},
+	)
+	if strings.Join(replies, " ") != "*-1 -ERR timeout is negative +OK "+
+		"-WRONGTYPE Operation against a key holding the wrong kind of value $-1" {
+		t.Fatalf("unexpected replies %v", replies)
+	}
+
+	// waiters are served in the order they blocked
+	cn1, reply1 := sendBlocking(t, server, "6799", "brpop", "queue", "other", "0")
+	defer cn1.Close()
+	cn2, reply2 := sendBlocking(t, server, "6799", "blpop", "queue", "0")
+	defer cn2.Close()
+	sendCommands(t, "6799", []string{"rpush", "queue", "a", "b"})
+	if r1, r2 := <-reply1, <-reply2; r1 != "queue b" || r2 != "queue a" {
+		t.Fatalf("unexpected replies %s, %s", r1, r2)
+	}
+
+	// a waiter that disconnected is not served
+	cn3, _ := sendBlocking(t, server, "6799", "blpop", "queue", "0")
+	cn3.Close()
+	for countBlocked(server) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reply := sendCommands(t, "6799", []string{"rpush", "queue", "c"})[0]; reply != ":1" {
+		t.Fatalf("expected :1, got %s", reply)
+	}
+
+	// serving a BLMOVE feeds the next waiter
+	cn4, reply4 := sendBlocking(t, server, "6799", "bzpopmin", "zset", "0")
+	defer cn4.Close()
+	cn5, reply5 := sendBlocking(t, server, "6799", "blpop", "dst", "0")
+	defer cn5.Close()
+	replies = sendCommands(t, "6799",
+		[]string{"blmove", "queue", "dst", "left", "left", "0"},
+		[]string{"zadd", "zset", "2", "b", "1", "a"},
+	)
+	if r4, r5 := <-reply4, <-reply5; replies[0] != "c" || r4 != "zset a 1" || r5 != "dst c" {
+		t.Fatalf("unexpected replies %v, %s, %s", replies, r4, r5)
+	}
+
+	// served waiters are propagated as the non-blocking commands
+	records, _ := server.cdc.read(0, func() bool { return false })
+	var cmds []string
+	for _, r := range records {
+		cmds = append(cmds, r.args[0])
+	}
+	if s := strings.Join(cmds, " "); s != "rpush lpop set lmove rpush rpop lpop rpush lmove lpop zadd zpopmin" {
+		t.Fatalf("unexpected commands %s", s)
+	}
+
+	// the keys of the databases swapped may hold data
+	cn6, reply6 := sendBlocking(t, server, "6799", "blpop", "swapped", "0")
+	defer cn6.Close()
+	sendCommands(t, "6799",
+		[]string{"select", "1"},
+		[]string{"rpush", "swapped", "a"},
+		[]string{"swapdb", "0", "1"},
+	)
+	if r := <-reply6; r != "swapped a" {
+		t.Fatalf("expected swapped a, got %s", r)
+	}
+	if len(server.takeReady()) != 0 {
+		t.Fatal("the keys changed should have been served.")
+	}
+}
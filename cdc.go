@@ -0,0 +1,190 @@
+package toyredis
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// The change data capture feed lists every write applied to the data set,
+// in order, as records of an offset, a database index and the command as it
+// is propagated. Keys the databases expire or evict on their own are
+// recorded as DEL, after the command that removed them unless it wrote
+// them again. The last records are kept in a ring, so that a consumer can
+// resume from the offset after the last record it got.
+
+const defaultCDCBacklog = 10000
+
+var cdcFellBehind = errors.New("ERR CDC consumer fell behind the backlog")
+
+type cdcRecord struct {
+	offset int64
+	db     int
+	args   []string
+}
+
+type cdc struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// record of offset o is at o % len(ring)
+	ring   []cdcRecord
+	next   int64 // offset of the next record
+	closed bool
+}
+
+func newCDC(size int) *cdc {
+	c := &cdc{ring: make([]cdcRecord, size)}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *cdc) append(db int, cmds [][]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, args := range cmds {
+		c.ring[c.next%int64(len(c.ring))] = cdcRecord{offset: c.next, db: db, args: args}
+		c.next++
+	}
+	c.cond.Broadcast()
+}
+
+// oldest returns the offset of the oldest record held, mu must be held
+func (c *cdc) oldest() int64 {
+	if n := int64(len(c.ring)); c.next > n {
+		return c.next - n
+	}
+	return 0
+}
+
+// start returns the offset to stream from, the next record if offset is
+// negative
+func (c *cdc) start(offset int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case offset < 0:
+		return c.next, nil
+	case offset < c.oldest():
+		return 0, fmt.Errorf("ERR offset %d is no longer in the backlog", offset)
+	case offset > c.next:
+		return 0, fmt.Errorf("ERR offset %d is ahead of the feed", offset)
+	}
+	return offset, nil
+}
+
+// read waits for the records from offset on. io.EOF is returned once the
+// feed is closed or stopped returns true, stopped is checked when wake is
+// called.
+func (c *cdc) read(offset int64, stopped func() bool) ([]cdcRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for offset == c.next && !c.closed && !stopped() {
+		c.cond.Wait()
+	}
+	if c.closed || stopped() {
+		return nil, io.EOF
+	}
+	if offset < c.oldest() {
+		return nil, cdcFellBehind
+	}
+	records := make([]cdcRecord, 0, c.next-offset)
+	for ; offset < c.next; offset++ {
+		records = append(records, c.ring[offset%int64(len(c.ring))])
+	}
+	return records, nil
+}
+
+func (c *cdc) wake() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cond.Broadcast()
+}
+
+func (c *cdc) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.cond.Broadcast()
+}
+
+// cacheEvents records the keys database i removed on its own, to be
+// propagated, and the keys it changed, for the blocked connections, and
+// sends the keyspace notifications of its events
+func (s *server) cacheEvents(i int) func(Event) {
+	return func(e Event) {
+		s.markReady(blockKey{i, e.Key})
+		if e.Name == "expired" || e.Name == "evicted" {
+			s.removedMu.Lock()
+			s.removed = append(s.removed, removedKey{i, e.Key})
+			s.removedMu.Unlock()
+		}
+		s.notifyKeyspaceEvent(i, e)
+	}
+}
+
+// handleCDC parses CDC [offset]. The connection is handed over to serveCDC
+// once the reply is flushed, without an offset it starts with the next
+// record.
+func (s *server) handleCDC(cn *Conn, ss []string) (err error) {
+	if len(ss) > 1 {
+		return arityError
+	}
+	offset := int64(-1)
+	if len(ss) == 1 {
+		if offset, err = strconv.ParseInt(ss[0], 10, 64); err != nil || offset < 0 {
+			return notIntError
+		}
+	}
+	if offset, err = s.cdc.start(offset); err != nil {
+		return
+	}
+	cn.wr.Status("OK")
+	cn.takeover = func() { s.serveCDC(cn, offset) }
+	return
+}
+
+// serveCDC streams the records from offset on as arrays of the offset, the
+// database index and the command, until either side closes
+func (s *server) serveCDC(cn *Conn, offset int64) {
+	stop := make(chan struct{})
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+			return false
+		}
+	}
+	// nothing is expected from the consumer but its disconnection
+	go func() {
+		io.Copy(io.Discard, cn.rd.rd)
+		close(stop)
+		s.cdc.wake()
+	}()
+
+	for {
+		records, err := s.cdc.read(offset, stopped)
+		if err == cdcFellBehind {
+			cn.wr.Error(err.Error())
+			cn.bw.Flush()
+		}
+		if err != nil {
+			return
+		}
+		for _, r := range records {
+			args := append([]string{strconv.FormatInt(r.offset, 10), strconv.Itoa(r.db)}, r.args...)
+			cn.wr.Request(args)
+		}
+		if err = cn.bw.Flush(); err != nil {
+			return
+		}
+		offset += int64(len(records))
+	}
+}
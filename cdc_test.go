@@ -0,0 +1,84 @@
+package toyredis
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// openCDC sends CDC with args and returns the reader of the records
+func openCDC(t *testing.T, port string, args ...string) (net.Conn, *Reader) {
+	cn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw := bufio.NewWriter(cn)
+	NewWriter(bw).Request(append([]string{"cdc"}, args...))
+	bw.Flush()
+	rd := NewReader(cn)
+	if line, err := rd.readline(); err != nil || string(line) != "+OK" {
+		t.Fatalf("unexpected reply %s %v", line, err)
+	}
+	return cn, rd
+}
+
+func TestCDC(t *testing.T) {
+	server := NewServerWithConfig(Config{Port: "6798", SizeLimit: 20, CDCBacklog: 4})
+	defer server.Stop()
+
+	cn, rd := openCDC(t, "6798")
+	sendCommands(t, "6798",
+		[]string{"set", "foo", "bar", "px", "100"},
+		[]string{"get", "foo"},
+		[]string{"select", "1"},
+		[]string{"sadd", "set", "a"},
+		[]string{"spop", "set"},
+	)
+	want := []string{
+		"0 0 set foo bar px 100",
+		"1 0 pexpireat foo",
+		"2 1 sadd set a",
+		"3 1 srem set a",
+		// expired by the database
+		"4 0 del foo",
+	}
+	for _, w := range want {
+		ss, err := rd.ReadRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(ss, " "); !strings.HasPrefix(got, w) {
+			t.Fatalf("expected %s, got %s", w, got)
+		}
+	}
+
+	// a key evicted once written is deleted after it
+	sendCommands(t, "6798",
+		[]string{"config", "set", "maxmemory-policy", "allkeys-lru"},
+		[]string{"config", "set", "maxmemory", "1mb"},
+		[]string{"set", "big", strings.Repeat("a", 2<<20)},
+	)
+	for _, w := range []string{"5 0 set big aaa", "6 0 del big"} {
+		ss, err := rd.ReadRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(ss, " "); !strings.HasPrefix(got, w) {
+			t.Fatalf("expected %s, got %.20s", w, got)
+		}
+	}
+	cn.Close()
+
+	// resume
+	cn, rd = openCDC(t, "6798", "3")
+	if ss, _ := rd.ReadRequest(); strings.Join(ss, " ") != "3 1 srem set a" {
+		t.Fatalf("unexpected record %v", ss)
+	}
+	cn.Close()
+
+	replies := sendCommands(t, "6798", []string{"cdc", "0"}, []string{"cdc", "8"})
+	if replies[0] != "-ERR offset 0 is no longer in the backlog" || replies[1] != "-ERR offset 8 is ahead of the feed" {
+		t.Fatalf("unexpected replies %v", replies)
+	}
+}
@@ -0,0 +1,432 @@
+package toyredis
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The command table drives dispatch: the arity of a command is checked
+// before its handler runs, its flags tell how it is run, such as denyoom
+// commands being refused once no memory can be freed, and its key
+// positions are reported by COMMAND, in the format of redis. Handlers check
+// what depends on more than the number of arguments.
+
+// CommandFlags tell how a command is run
+type CommandFlags int
+
+const (
+	FlagWrite CommandFlags = 1 << iota
+	FlagReadOnly
+	FlagDenyOOM
+	FlagAdmin
+	FlagPubSub
+	FlagNoScript
+	FlagBlocking
+	FlagFast
+	FlagNoMulti
+	FlagMovableKeys
+)
+
+// names of the flags, in the order of their bits
+var flagNames = []string{
+	"write", "readonly", "denyoom", "admin", "pubsub", "noscript", "blocking", "fast", "no_multi", "movablekeys",
+}
+
+type command struct {
+	name string
+	// number of arguments including the name, at least -arity if negative
+	arity int
+	flags CommandFlags
+	// positions of the first and the last key and the step between keys,
+	// the last counted from the end if negative and 0 if there is no key
+	firstKey, lastKey, keyStep int
+	handler                    func(s *server, cn *Conn, args []string) error
+}
+
+var (
+	invalidCommand   = errors.New("ERR Invalid command specified")
+	invalidArguments = errors.New("ERR Invalid number of arguments specified for command")
+	noKeyArguments   = errors.New("ERR The command has no key arguments")
+)
+
+var commandTable = make(map[string]*command)
+
+func init() {
+	for _, c := range []*command{
+		{"save", 1, FlagAdmin | FlagNoScript, 0, 0, 0, (*server).handleSave},
+		{"bgsave", 1, FlagAdmin, 0, 0, 0, (*server).handleBgSave},
+		{"lastsave", 1, FlagFast, 0, 0, 0, (*server).handleLastSave},
+		{"bgrewriteaof", 1, FlagAdmin, 0, 0, 0, (*server).handleBgRewriteAOF},
+		{"flushdb", 1, FlagWrite, 0, 0, 0, (*server).handleFlush},
+		{"flushall", 1, FlagWrite, 0, 0, 0, (*server).handleFlushAll},
+		{"select", 2, FlagFast, 0, 0, 0, (*server).handleSelect},
+		{"swapdb", 3, FlagWrite | FlagFast, 0, 0, 0, (*server).handleSwapDB},
+		{"move", 3, FlagWrite | FlagFast, 1, 1, 1, (*server).handleMove},
+		{"expire", -3, FlagWrite | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleExpire(cn, args, "expire", time.Second, false)
+		}},
+		{"pexpire", -3, FlagWrite | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleExpire(cn, args, "pexpire", time.Millisecond, false)
+		}},
+		{"expireat", -3, FlagWrite | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleExpire(cn, args, "expireat", time.Second, true)
+		}},
+		{"pexpireat", -3, FlagWrite | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleExpire(cn, args, "pexpireat", time.Millisecond, true)
+		}},
+		{"ttl", 2, FlagReadOnly | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleTTL(cn, args, time.Second)
+		}},
+		{"pttl", 2, FlagReadOnly | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleTTL(cn, args, time.Millisecond)
+		}},
+		{"expiretime", 2, FlagReadOnly | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleExpireTime(cn, args, time.Second)
+		}},
+		{"pexpiretime", 2, FlagReadOnly | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleExpireTime(cn, args, time.Millisecond)
+		}},
+		{"persist", 2, FlagWrite | FlagFast, 1, 1, 1, (*server).handlePersist},
+
+		{"set", -3, FlagWrite | FlagDenyOOM, 1, 1, 1, (*server).handleSet},
+		{"setnx", 3, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, (*server).handleSetNX},
+		{"setex", 4, FlagWrite | FlagDenyOOM, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleSetEx(cn, args, "setex", time.Second)
+		}},
+		{"psetex", 4, FlagWrite | FlagDenyOOM, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleSetEx(cn, args, "psetex", time.Millisecond)
+		}},
+		{"getset", 3, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, (*server).handleGetSet},
+		{"getdel", 2, FlagWrite | FlagFast, 1, 1, 1, (*server).handleGetDel},
+		{"getex", -2, FlagWrite | FlagFast, 1, 1, 1, (*server).handleGetEx},
+		{"mset", -3, FlagWrite | FlagDenyOOM, 1, -1, 2, (*server).handleMSet},
+		{"get", 2, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleGet},
+		{"mget", -2, FlagReadOnly | FlagFast, 1, -1, 1, (*server).handleMGet},
+		{"exists", 2, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleExists},
+		{"incr", 2, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleIncr(cn, args, 1)
+		}},
+		{"decr", 2, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleIncr(cn, args, -1)
+		}},
+		{"incrby", 3, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleIncrBy(cn, args, 1)
+		}},
+		{"decrby", 3, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleIncrBy(cn, args, -1)
+		}},
+		{"incrbyfloat", 3, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, (*server).handleIncrByFloat},
+
+		{"hset", 4, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, (*server).handleHSet},
+		{"hmset", -4, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, (*server).handleHMSet},
+		{"hget", 3, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleHGet},
+		{"hmget", -3, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleHMGet},
+		{"hgetall", 2, FlagReadOnly, 1, 1, 1, (*server).handleHGetAll},
+		{"hexists", 3, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleHExists},
+		{"del", -2, FlagWrite, 1, -1, 1, (*server).handleDel},
+		{"hincrby", 4, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, (*server).handleHIncrBy},
+		{"hincrbyfloat", 4, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, (*server).handleHIncrByFloat},
+		{"hdel", -3, FlagWrite | FlagFast, 1, 1, 1, (*server).handleHDel},
+
+		{"lpush", -3, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handlePush(cn, args, true)
+		}},
+		{"rpush", -3, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handlePush(cn, args, false)
+		}},
+		{"lpop", -2, FlagWrite | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handlePop(cn, args, true)
+		}},
+		{"rpop", -2, FlagWrite | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handlePop(cn, args, false)
+		}},
+		{"llen", 2, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleLLen},
+		{"lrange", 4, FlagReadOnly, 1, 1, 1, (*server).handleLRange},
+		{"lindex", 3, FlagReadOnly, 1, 1, 1, (*server).handleLIndex},
+		{"lset", 4, FlagWrite | FlagDenyOOM, 1, 1, 1, (*server).handleLSet},
+		{"lrem", 4, FlagWrite, 1, 1, 1, (*server).handleLRem},
+		{"ltrim", 4, FlagWrite, 1, 1, 1, (*server).handleLTrim},
+		{"linsert", 5, FlagWrite | FlagDenyOOM, 1, 1, 1, (*server).handleLInsert},
+		{"lmove", 5, FlagWrite | FlagDenyOOM, 1, 2, 1, (*server).handleLMove},
+		{"blpop", -3, FlagWrite | FlagBlocking, 1, -2, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleBlockingPop(cn, args, true)
+		}},
+		{"brpop", -3, FlagWrite | FlagBlocking, 1, -2, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleBlockingPop(cn, args, false)
+		}},
+		{"blmove", 6, FlagWrite | FlagDenyOOM | FlagBlocking, 1, 2, 1, (*server).handleBlockingMove},
+
+		{"sadd", -3, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, (*server).handleSAdd},
+		{"srem", -3, FlagWrite | FlagFast, 1, 1, 1, (*server).handleSRem},
+		{"smembers", 2, FlagReadOnly, 1, 1, 1, (*server).handleSMembers},
+		{"sismember", 3, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleSIsMember},
+		{"smismember", -3, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleSMIsMember},
+		{"scard", 2, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleSCard},
+		{"spop", -2, FlagWrite | FlagFast, 1, 1, 1, (*server).handleSPop},
+		{"srandmember", -2, FlagReadOnly, 1, 1, 1, (*server).handleSRandMember},
+		{"smove", 4, FlagWrite | FlagFast, 1, 2, 1, (*server).handleSMove},
+		{"sunion", -2, FlagReadOnly, 1, -1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleSetOperation(cn, args, s.db(cn).SUnion)
+		}},
+		{"sinter", -2, FlagReadOnly, 1, -1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleSetOperation(cn, args, s.db(cn).SInter)
+		}},
+		{"sdiff", -2, FlagReadOnly, 1, -1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleSetOperation(cn, args, s.db(cn).SDiff)
+		}},
+		{"sunionstore", -3, FlagWrite | FlagDenyOOM, 1, -1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleSetOperationStore(cn, args, s.db(cn).SUnionStore)
+		}},
+		{"sinterstore", -3, FlagWrite | FlagDenyOOM, 1, -1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleSetOperationStore(cn, args, s.db(cn).SInterStore)
+		}},
+		{"sdiffstore", -3, FlagWrite | FlagDenyOOM, 1, -1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleSetOperationStore(cn, args, s.db(cn).SDiffStore)
+		}},
+
+		{"zadd", -4, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, (*server).handleZAdd},
+		{"zincrby", 4, FlagWrite | FlagDenyOOM | FlagFast, 1, 1, 1, (*server).handleZIncrBy},
+		{"zrem", -3, FlagWrite | FlagFast, 1, 1, 1, (*server).handleZRem},
+		{"zscore", 3, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleZScore},
+		{"zcard", 2, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleZCard},
+		{"zrank", 3, FlagReadOnly | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleZRank(cn, args, false)
+		}},
+		{"zrevrank", 3, FlagReadOnly | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleZRank(cn, args, true)
+		}},
+		{"zcount", 4, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleZCount},
+		{"zrange", -4, FlagReadOnly, 1, 1, 1, (*server).handleZRange},
+		{"zpopmin", -2, FlagWrite | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleZPop(cn, args, s.db(cn).ZPopMin)
+		}},
+		{"zpopmax", -2, FlagWrite | FlagFast, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleZPop(cn, args, s.db(cn).ZPopMax)
+		}},
+		{"bzpopmin", -3, FlagWrite | FlagBlocking | FlagFast, 1, -2, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleBlockingZPop(cn, args, false)
+		}},
+		{"bzpopmax", -3, FlagWrite | FlagBlocking | FlagFast, 1, -2, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleBlockingZPop(cn, args, true)
+		}},
+		{"zunionstore", -4, FlagWrite | FlagDenyOOM | FlagMovableKeys, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleZSetOperationStore(cn, args, s.db(cn).ZUnionStore)
+		}},
+		{"zinterstore", -4, FlagWrite | FlagDenyOOM | FlagMovableKeys, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleZSetOperationStore(cn, args, s.db(cn).ZInterStore)
+		}},
+
+		{"keys", 2, FlagReadOnly, 0, 0, 0, (*server).handleKeys},
+		{"scan", -2, FlagReadOnly, 0, 0, 0, (*server).handleScan},
+		{"hscan", -3, FlagReadOnly, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleCollectionScan(cn, args, "hscan")
+		}},
+		{"sscan", -3, FlagReadOnly, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleCollectionScan(cn, args, "sscan")
+		}},
+		{"zscan", -3, FlagReadOnly, 1, 1, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleCollectionScan(cn, args, "zscan")
+		}},
+		{"type", 2, FlagReadOnly | FlagFast, 1, 1, 1, (*server).handleType},
+		{"rename", 3, FlagWrite, 1, 2, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleRename(cn, args, false)
+		}},
+		{"renamenx", 3, FlagWrite | FlagFast, 1, 2, 1, func(s *server, cn *Conn, args []string) error {
+			return s.handleRename(cn, args, true)
+		}},
+		{"copy", -3, FlagWrite | FlagDenyOOM, 1, 2, 1, (*server).handleCopy},
+		{"randomkey", 1, FlagReadOnly, 0, 0, 0, (*server).handleRandomKey},
+		{"dbsize", 1, FlagReadOnly | FlagFast, 0, 0, 0, (*server).handleDBSize},
+		{"touch", -2, FlagReadOnly | FlagFast, 1, -1, 1, (*server).handleTouch},
+		{"unlink", -2, FlagWrite | FlagFast, 1, -1, 1, (*server).handleUnlink},
+		{"dump", 2, FlagReadOnly, 1, 1, 1, (*server).handleDump},
+		{"restore", -4, FlagWrite | FlagDenyOOM, 1, 1, 1, (*server).handleRestore},
+		{"object", 3, FlagReadOnly, 2, 2, 1, (*server).handleObject},
+
+		{"replicaof", 3, FlagAdmin | FlagNoScript, 0, 0, 0, (*server).handleReplicaOf},
+		{"slaveof", 3, FlagAdmin | FlagNoScript, 0, 0, 0, (*server).handleReplicaOf},
+		{"replconf", -1, FlagAdmin | FlagNoScript, 0, 0, 0, (*server).handleReplConf},
+		{"sync", 1, FlagAdmin | FlagNoScript | FlagNoMulti, 0, 0, 0, func(s *server, cn *Conn, args []string) error {
+			return s.handleSync(cn, args, false)
+		}},
+		{"psync", 3, FlagAdmin | FlagNoScript | FlagNoMulti, 0, 0, 0, func(s *server, cn *Conn, args []string) error {
+			return s.handleSync(cn, args, true)
+		}},
+		{"cdc", -1, FlagAdmin | FlagNoScript | FlagNoMulti, 0, 0, 0, (*server).handleCDC},
+
+		{"ping", -1, FlagFast, 0, 0, 0, (*server).handlePing},
+		{"subscribe", -2, FlagPubSub | FlagNoScript | FlagNoMulti, 0, 0, 0, func(s *server, cn *Conn, args []string) error {
+			return s.handleSubscribe(cn, args, false)
+		}},
+		{"psubscribe", -2, FlagPubSub | FlagNoScript | FlagNoMulti, 0, 0, 0, func(s *server, cn *Conn, args []string) error {
+			return s.handleSubscribe(cn, args, true)
+		}},
+		{"unsubscribe", -1, FlagPubSub | FlagNoScript | FlagNoMulti, 0, 0, 0, func(s *server, cn *Conn, args []string) error {
+			return s.handleUnsubscribe(cn, args, false)
+		}},
+		{"punsubscribe", -1, FlagPubSub | FlagNoScript | FlagNoMulti, 0, 0, 0, func(s *server, cn *Conn, args []string) error {
+			return s.handleUnsubscribe(cn, args, true)
+		}},
+		{"publish", 3, FlagPubSub | FlagFast, 0, 0, 0, (*server).handlePublish},
+		{"pubsub", -2, FlagPubSub, 0, 0, 0, (*server).handlePubSub},
+
+		{"multi", 1, FlagNoScript | FlagFast, 0, 0, 0, (*server).handleMulti},
+		{"exec", 1, FlagNoScript, 0, 0, 0, (*server).handleExec},
+		{"discard", 1, FlagNoScript | FlagFast, 0, 0, 0, (*server).handleDiscard},
+		{"watch", -2, FlagNoScript | FlagFast, 1, -1, 1, (*server).handleWatch},
+		{"unwatch", 1, FlagNoScript | FlagFast, 0, 0, 0, (*server).handleUnwatch},
+		{"eval", -3, FlagNoScript | FlagMovableKeys, 0, 0, 0, func(s *server, cn *Conn, args []string) error {
+			return s.handleEval(cn, args, false)
+		}},
+		{"evalsha", -3, FlagNoScript | FlagMovableKeys, 0, 0, 0, func(s *server, cn *Conn, args []string) error {
+			return s.handleEval(cn, args, true)
+		}},
+		{"script", -2, FlagNoScript, 0, 0, 0, (*server).handleScript},
+
+		{"info", 1, 0, 0, 0, 0, (*server).handleInfo},
+		{"config", -2, FlagAdmin | FlagNoScript, 0, 0, 0, (*server).handleConfigSet},
+		{"command", -1, 0, 0, 0, 0, (*server).handleCommand},
+	} {
+		commandTable[c.name] = c
+	}
+}
+
+// keys of the commands whose keys depend on the arguments
+var movableKeys = map[string]func(ss []string) ([]string, error){
+	"eval":        evalKeys,
+	"evalsha":     evalKeys,
+	"zunionstore": zsetStoreKeys,
+	"zinterstore": zsetStoreKeys,
+}
+
+func evalKeys(ss []string) ([]string, error) {
+	return numKeys(ss, 2, 3)
+}
+
+func zsetStoreKeys(ss []string) ([]string, error) {
+	keys, err := numKeys(ss, 2, 3)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{ss[1]}, keys...), nil
+}
+
+// numKeys returns the keys of commands that give their number at position
+// i, followed by the keys from position first
+func numKeys(ss []string, i, first int) ([]string, error) {
+	n, err := strconv.Atoi(ss[i])
+	if err != nil || n < 0 || first+n > len(ss) {
+		return nil, invalidArguments
+	}
+	return ss[first : first+n], nil
+}
+
+// lookupCommand returns the command named name, in lower case, nil if
+// there is none
+func (s *server) lookupCommand(name string) *command {
+	s.commandsMu.RLock()
+	defer s.commandsMu.RUnlock()
+	return s.commands[name]
+}
+
+func (c *command) checkArity(n int) bool {
+	return c.arity == n || c.arity < 0 && n >= -c.arity
+}
+
+// keys returns the keys of a call of c, ss including the name
+func (c *command) keys(ss []string) ([]string, error) {
+	if getKeys, ok := movableKeys[c.name]; ok {
+		return getKeys(ss)
+	}
+	if c.firstKey == 0 {
+		return nil, nil
+	}
+	last := c.lastKey
+	if last < 0 {
+		last += len(ss)
+	}
+	var keys []string
+	for i := c.firstKey; i <= last && i < len(ss); i += c.keyStep {
+		keys = append(keys, ss[i])
+	}
+	return keys, nil
+}
+
+func (c *command) writeInfo(wr *Writer) {
+	var flags []string
+	for i, name := range flagNames {
+		if c.flags&(1<<i) != 0 {
+			flags = append(flags, name)
+		}
+	}
+	wr.Array(6)
+	wr.String([]byte(c.name))
+	wr.Int(c.arity)
+	wr.Array(len(flags))
+	for _, flag := range flags {
+		wr.Status(flag)
+	}
+	wr.Int(c.firstKey)
+	wr.Int(c.lastKey)
+	wr.Int(c.keyStep)
+}
+
+// handleCommand parses COMMAND, COMMAND COUNT, COMMAND INFO [command ...]
+// and COMMAND GETKEYS command [arg ...]
+func (s *server) handleCommand(cn *Conn, ss []string) (err error) {
+	s.commandsMu.RLock()
+	cmds := make([]*command, 0, len(s.commands))
+	for _, c := range s.commands {
+		cmds = append(cmds, c)
+	}
+	s.commandsMu.RUnlock()
+	if len(ss) == 0 {
+		sort.Slice(cmds, func(i, j int) bool { return cmds[i].name < cmds[j].name })
+		cn.wr.Array(len(cmds))
+		for _, c := range cmds {
+			c.writeInfo(cn.wr)
+		}
+		return
+	}
+
+	switch sub := strings.ToLower(ss[0]); {
+	case sub == "count" && len(ss) == 1:
+		cn.wr.Int(len(cmds))
+	case sub == "info":
+		cn.wr.Array(len(ss) - 1)
+		for _, name := range ss[1:] {
+			if c := s.lookupCommand(strings.ToLower(name)); c != nil {
+				c.writeInfo(cn.wr)
+			} else {
+				cn.wr.NullStringArray()
+			}
+		}
+	case sub == "getkeys" && len(ss) >= 2:
+		c := s.lookupCommand(strings.ToLower(ss[1]))
+		switch {
+		case c == nil:
+			return invalidCommand
+		case !c.checkArity(len(ss) - 1):
+			return invalidArguments
+		}
+		keys, err := c.keys(ss[1:])
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return noKeyArguments
+		}
+		bs := make([][]byte, len(keys))
+		for i, key := range keys {
+			bs[i] = []byte(key)
+		}
+		cn.wr.StringArray(bs)
+	default:
+		err = fmt.Errorf("ERR Unknown COMMAND subcommand or wrong number of arguments for '%s'", ss[0])
+	}
+	return
+}
@@ -0,0 +1,44 @@
+package toyredis
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	server := NewServerWithConfig(Config{Port: "6805", SizeLimit: 20})
+	defer server.Stop()
+
+	c := dial(t, "6805")
+	defer c.Close()
+	c.send("command", "count")
+	c.expect(t, ":"+strconv.Itoa(len(commandTable)))
+	c.send("command", "info", "GET", "nosuch", "mset")
+	c.expect(t, "get :2 +readonly +fast :1 :1 :1 (nil) mset :-3 +write +denyoom :1 :-1 :2")
+
+	c.send("command", "getkeys", "mset", "a", "1", "b", "2")
+	c.expect(t, "a b")
+	c.send("command", "getkeys", "eval", "return 1", "2", "x", "y", "z")
+	c.expect(t, "x y")
+	c.send("command", "getkeys", "zunionstore", "dst", "2", "a", "b", "weights", "1", "2")
+	c.expect(t, "dst a b")
+	c.send("command", "getkeys", "eval", "return 1", "3", "x")
+	c.expect(t, "-ERR Invalid number of arguments specified for command")
+	c.send("command", "getkeys", "get")
+	c.expect(t, "-ERR Invalid number of arguments specified for command")
+	c.send("command", "getkeys", "nosuch", "a")
+	c.expect(t, "-ERR Invalid command specified")
+	c.send("command", "getkeys", "ping")
+	c.expect(t, "-ERR The command has no key arguments")
+	c.send("command", "nosuch")
+	c.expect(t, "-ERR Unknown COMMAND subcommand or wrong number of arguments for 'nosuch'")
+
+	// the arity is checked before running and while queuing
+	c.send("get")
+	c.expect(t, "-ERR wrong number of arguments")
+	c.send("multi")
+	c.send("get", "a", "b")
+	c.send("exec")
+	c.expect(t, "+OK", "-ERR wrong number of arguments",
+		"-EXECABORT Transaction discarded because of previous errors.")
+}
@@ -0,0 +1,83 @@
+package toyredis
+
+// globMatch reports whether s matches pattern, with the glob syntax
+// understood by redis: * and ? wildcards, [abc], [^abc] and [a-z]
+// classes, and \ to escape a special character.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			i := 1
+			not := i < len(pattern) && pattern[i] == '^'
+			if not {
+				i++
+			}
+			match := false
+			for ; i < len(pattern) && pattern[i] != ']'; i++ {
+				switch {
+				case pattern[i] == '\\' && i+1 < len(pattern):
+					i++
+					if pattern[i] == s[0] {
+						match = true
+					}
+				case i+2 < len(pattern) && pattern[i+1] == '-':
+					lo, hi := pattern[i], pattern[i+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if s[0] >= lo && s[0] <= hi {
+						match = true
+					}
+					i += 2
+				case pattern[i] == s[0]:
+					match = true
+				}
+			}
+			// an unterminated class ends with the pattern
+			if i == len(pattern) {
+				i--
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s = s[1:]
+			pattern = pattern[i:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
@@ -1,3 +1,5 @@
 module github.com/Shenmin-Z/toyredis
 
 go 1.16
+
+require github.com/yuin/gopher-lua v1.1.1
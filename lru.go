@@ -5,10 +5,16 @@ Based on https://github.com/golang/groupcache/blob/master/lru/lru.go
 package toyredis
 
 import (
+	"bytes"
 	"container/list"
 	"errors"
+	"fmt"
+	"math"
 	"math/rand"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,24 +27,168 @@ const (
 	Minute      = 60000
 )
 
+// EvictionPolicy decides which entries are removed once the cache
+// grows over its size limit.
+type EvictionPolicy int
+
+const (
+	AllKeysLRU EvictionPolicy = iota
+	NoEviction
+	VolatileLRU
+	AllKeysRandom
+	VolatileRandom
+	VolatileTTL
+	AllKeysLFU
+	VolatileLFU
+)
+
+var policyNames = []string{
+	AllKeysLRU:     "allkeys-lru",
+	NoEviction:     "noeviction",
+	VolatileLRU:    "volatile-lru",
+	AllKeysRandom:  "allkeys-random",
+	VolatileRandom: "volatile-random",
+	VolatileTTL:    "volatile-ttl",
+	AllKeysLFU:     "allkeys-lfu",
+	VolatileLFU:    "volatile-lfu",
+}
+
+func (p EvictionPolicy) String() string {
+	return policyNames[p]
+}
+
+func (p EvictionPolicy) isLFU() bool {
+	return p == AllKeysLFU || p == VolatileLFU
+}
+
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	for p, name := range policyNames {
+		if name == s {
+			return EvictionPolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid maxmemory-policy: %s", s)
+}
+
+// number of keys inspected by the sampling policies, same as redis'
+// default maxmemory-samples
+const evictionSamples = 5
+
+const (
+	lfuInitVal          = 5
+	defaultLFULogFactor = 10
+	defaultLFUDecayTime = 1 // minutes
+)
+
 type Cache struct {
-	sizeLimit int
-	size      int
+	// the size limit and lock, shared with the other caches of a group
+	mem    *memory
+	size   int
+	policy EvictionPolicy
+
+	lfuLogFactor int
+	lfuDecayTime int
 
 	ll    *list.List
 	cache map[string]*list.Element
 	array []*list.Element
+	// entries with an expire set, for the volatile-* policies
+	volatile []*list.Element
+
+	// receives the events of the cache, see OnEvent
+	onEvent func(Event)
+	// version of the keys that do not exist, see Version
+	absentVersion uint64
+	// counts the calls to Flush, the sizes Unlink estimated before one
+	// are not corrected
+	epoch int
 
-	mu   sync.Mutex
+	mu   *sync.Mutex
 	quit chan interface{}
 }
 
+// memory is the size limit of a group of caches, as the databases of a
+// server share one. Eviction removes entries of any of them, so they share
+// a single lock too.
+type memory struct {
+	mu     sync.Mutex
+	limit  int
+	caches []*Cache
+	// see SetPassive and ShowExpired
+	passive, showExpired bool
+}
+
+// used returns the size of the caches, mu must be held
+func (m *memory) used() (size int) {
+	for _, c := range m.caches {
+		size += c.size
+	}
+	return
+}
+
+// Event is a change of a key, named after the keyspace notifications of
+// redis: "set", "del", "lpush", "expire"... for the changes made through the
+// methods of the cache, "expired" when its expire passed and "evicted" when
+// the eviction policy removed it.
+type Event struct {
+	Name string
+	Key  string
+}
+
+// OnEvent sets the function the events are passed to, nil to stop. It is
+// called with the cache locked, so it must not call the cache back.
+func (c *Cache) OnEvent(f func(Event)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.onEvent = f
+}
+
+// versions are taken from a counter shared by all caches, so that a
+// version is never found again, even in another cache after SWAPDB
+var versionClock uint64
+
+func nextVersion() uint64 {
+	return atomic.AddUint64(&versionClock, 1)
+}
+
+// notify records a change of key
+func (c *Cache) notify(name, key string) {
+	if ele, hit := c.cache[key]; hit {
+		ele.Value.(*entry).version = nextVersion()
+	} else {
+		// a key removed may have been seen by Version as any key that
+		// does not exist
+		c.absentVersion = nextVersion()
+	}
+	if c.onEvent != nil {
+		c.onEvent(Event{Name: name, Key: key})
+	}
+}
+
 type entry struct {
-	key    string
-	value  interface{} // []byte or map[string][]byte
+	key string
+	// []byte, map[string][]byte (hash), *list.List, map[string]struct{} (set)
+	// or *zset
+	value  interface{}
 	expire time.Time
 
-	pos int
+	pos  int
+	vpos int // position in volatile, -1 if no expire is set
+
+	version uint64
+
+	// time of the last access
+	atime time.Time
+	// logarithmic access counter and the time it was last decremented,
+	// only maintained under the LFU policies
+	freq uint8
+	ldt  time.Time
+}
+
+// expired tells whether kv is past its expire and to be treated as missing
+func (c *Cache) expired(kv *entry) bool {
+	return kv.hasExpired() && !(c.mem.passive && c.mem.showExpired)
 }
 
 func (kv *entry) hasExpired() bool {
@@ -49,18 +199,7 @@ func (kv *entry) hasExpired() bool {
 }
 
 func NewCache(sizeLimit int) *Cache {
-	if sizeLimit <= 0 {
-		panic("Size limit should be greater than 0.")
-	}
-
-	cache := &Cache{
-		sizeLimit: sizeLimit,
-		size:      0,
-		ll:        list.New(),
-		cache:     make(map[string]*list.Element),
-		array:     make([]*list.Element, 0),
-		quit:      make(chan interface{}),
-	}
+	cache := NewCaches(1, sizeLimit)[0]
 
 	ticker := time.NewTicker(100 * time.Millisecond)
 	go func() {
@@ -78,41 +217,189 @@ func NewCache(sizeLimit int) *Cache {
 	return cache
 }
 
+// NewCaches returns n caches whose sizes add up against the same limit,
+// once it is reached the eviction policy of the cache written to picks
+// the entries to remove from all of them. Unlike NewCache, expired entries
+// are only removed as they are accessed or by ActiveExpire.
+func NewCaches(n int, sizeLimit int) []*Cache {
+	if sizeLimit <= 0 {
+		panic("Size limit should be greater than 0.")
+	}
+
+	mem := &memory{limit: sizeLimit}
+	for i := 0; i < n; i++ {
+		cache := &Cache{
+			mem:          mem,
+			size:         0,
+			lfuLogFactor: defaultLFULogFactor,
+			lfuDecayTime: defaultLFUDecayTime,
+			ll:           list.New(),
+			cache:        make(map[string]*list.Element),
+			array:        make([]*list.Element, 0),
+			volatile:     make([]*list.Element, 0),
+			mu:           &mem.mu,
+			quit:         make(chan interface{}),
+
+			absentVersion: nextVersion(),
+		}
+		mem.caches = append(mem.caches, cache)
+	}
+	return mem.caches
+}
+
 var nilTime = time.Time{}
 
 var (
 	nilValue  = errors.New("nil value not allowed")
 	wrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	oomError  = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+	noLFU     = errors.New("ERR An LFU maxmemory policy is not selected, access frequency not tracked")
+
+	noSuchKey       = errors.New("ERR no such key")
+	indexOutOfRange = errors.New("ERR index out of range")
+	sameObject      = errors.New("ERR source and destination objects are the same")
+	busyKey         = errors.New("BUSYKEY Target key name already exists.")
+
+	overflowError     = errors.New("ERR increment or decrement would overflow")
+	nanOrInfError     = errors.New("ERR increment would produce NaN or Infinity")
+	hashNotIntError   = errors.New("ERR hash value is not an integer")
+	hashNotFloatError = errors.New("ERR hash value is not a float")
+
+	nanScore          = errors.New("ERR resulting score is not a number (NaN)")
+	invalidScoreRange = errors.New("ERR min or max is not a float")
+	invalidLexRange   = errors.New("ERR min or max not valid string range item")
 )
 
 func (c *Cache) Set(key string, value []byte) (err error) {
+	_, _, err = c.SetWithOptions(key, value, SetOptions{})
+	return
+}
+
+// SetOptions are the flags of the SET command
+type SetOptions struct {
+	NX, XX  bool      // only set new keys / only overwrite existing ones
+	Expire  time.Time // expire of the key, nilTime for none
+	KeepTTL bool      // keep the expire of an existing key
+	Get     bool      // return the old value, which must be a string
+}
+
+// SetWithOptions stores value at key, replacing whatever type it held.
+// ok is false if NX or XX prevented the write, old is only filled in
+// if opt.Get is set.
+func (c *Cache) SetWithOptions(key string, value []byte, opt SetOptions) (old []byte, ok bool, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	return c.setWithOptions(key, value, opt)
+}
+
+func (c *Cache) setWithOptions(key string, value []byte, opt SetOptions) (old []byte, ok bool, err error) {
 	if value == nil {
 		panic(nilValue)
 	}
+	if err = c.freeMemory(); err != nil {
+		return
+	}
 
-	if ee, ok := c.cache[key]; ok {
-		switch oldValue := ee.Value.(*entry).value.(type) {
-		case []byte:
-			c.size += len(value)
-			c.size -= len(oldValue)
-			c.ll.MoveToFront(ee)
-			ee.Value.(*entry).value = value
-			ee.Value.(*entry).expire = nilTime
-		case map[string][]byte:
-			return wrongType
+	ele := c.lookup(key)
+	if ele != nil && opt.Get {
+		v, isString := ele.Value.(*entry).value.([]byte)
+		if !isString {
+			return nil, false, wrongType
 		}
-	} else {
-		c.size += len(key) + len(value)
-		ele := c.ll.PushFront(&entry{key, value, nilTime, len(c.array)})
-		c.cache[key] = ele
-		c.array = append(c.array, ele)
+		old = v
+	}
+	if (opt.NX && ele != nil) || (opt.XX && ele == nil) {
+		return
+	}
+
+	expire := opt.Expire
+	if ele != nil {
+		if opt.KeepTTL {
+			expire = ele.Value.(*entry).expire
+		}
+		if _, isString := ele.Value.(*entry).value.([]byte); !isString {
+			c.removeElement(ele)
+			ele = nil
+		}
+	}
+	ele = c.setString(ele, key, value)
+	c.setExpire(ele, expire)
+	c.notify("set", key)
+
+	c.freeMemory()
+	return old, true, nil
+}
+
+// Version returns the version of key, which changes whenever the key is
+// written, expires, is evicted or flushed. Versions of keys that do not
+// exist may change when other keys are removed too.
+func (c *Cache) Version(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.version(key)
+}
+
+func (c *Cache) version(key string) uint64 {
+	if ele := c.lookup(key); ele != nil {
+		return ele.Value.(*entry).version
+	}
+	return c.absentVersion
+}
+
+// CompareAndSwap stores value at key as Set does, provided the version of
+// key is still version. ok reports whether it did.
+func (c *Cache) CompareAndSwap(key string, version uint64, value []byte) (ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.version(key) != version {
+		return
+	}
+	_, ok, err = c.setWithOptions(key, value, SetOptions{})
+	return
+}
+
+// GetDel returns the string at key and deletes it
+func (c *Cache) GetDel(key string) (value []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele := c.lookup(key)
+	if ele == nil {
+		return
 	}
+	value, ok := ele.Value.(*entry).value.([]byte)
+	if !ok {
+		return nil, wrongType
+	}
+	c.removeElement(ele)
+	c.notify("del", key)
+	return
+}
+
+// GetEx returns the string at key and updates its expire, to expire if
+// it is set or removing it if persist is set.
+func (c *Cache) GetEx(key string, expire time.Time, persist bool) (value []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	for c.sizeLimit != 0 && c.size > c.sizeLimit {
-		c.removeOldest()
+	ele := c.lookup(key)
+	if ele == nil {
+		return
+	}
+	value, ok := ele.Value.(*entry).value.([]byte)
+	if !ok {
+		return nil, wrongType
+	}
+	c.touch(ele)
+	if persist {
+		c.setExpire(ele, nilTime)
+		c.notify("persist", key)
+	} else if expire != nilTime {
+		c.setExpire(ele, expire)
+		c.notify("expire", key)
 	}
 	return
 }
@@ -124,11 +411,12 @@ func (c *Cache) HSet(key string, vk string, vv []byte) (err error) {
 	if vv == nil {
 		panic(nilValue)
 	}
+	if err = c.freeMemory(); err != nil {
+		return
+	}
 
 	if ee, ok := c.cache[key]; ok {
 		switch oldValue := ee.Value.(*entry).value.(type) {
-		case []byte:
-			return wrongType
 		case map[string][]byte:
 			if oldVv, ok := oldValue[vk]; ok {
 				c.size += len(vv)
@@ -137,37 +425,108 @@ func (c *Cache) HSet(key string, vk string, vv []byte) (err error) {
 				c.size += len(vk) + len(vv)
 			}
 			oldValue[vk] = vv
-			c.ll.MoveToFront(ee)
-			ee.Value.(*entry).expire = nilTime
+			c.touch(ee)
+			c.setExpire(ee, nilTime)
+		default:
+			return wrongType
 		}
 	} else {
-		c.size += len(vk) + len(vv)
-		ele := c.ll.PushFront(&entry{key, map[string][]byte{vk: vv}, nilTime, len(c.array)})
-		c.cache[key] = ele
-		c.array = append(c.array, ele)
+		c.size += len(key) + len(vk) + len(vv)
+		c.insert(key, map[string][]byte{vk: vv})
 	}
+	c.notify("hset", key)
 
-	for c.sizeLimit != 0 && c.size > c.sizeLimit {
-		c.removeOldest()
-	}
+	c.freeMemory()
 	return
 }
 
-// ttl: milliseconds
+// ttl: milliseconds, 0 removes the expire and a negative ttl deletes
+// the key right away
 func (c *Cache) Expire(key string, ttl int) int {
+	if ttl != 0 {
+		return c.ExpireAt(key, time.Now().Add(time.Millisecond*time.Duration(ttl)), ExpireOptions{})
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if ee, ok := c.cache[key]; ok {
-		expireAt := nilTime
-		if ttl > 0 {
-			expireAt = time.Now().Add(time.Millisecond * time.Duration(ttl))
-		}
-		ee.Value.(*entry).expire = expireAt
+	if ele := c.lookup(key); ele != nil {
+		c.setExpire(ele, nilTime)
+		c.notify("persist", key)
 		return 1
-	} else {
+	}
+	return 0
+}
+
+// ExpireOptions are the flags of the EXPIRE command, a key without an
+// expire counts as having an infinite ttl for GT and LT.
+type ExpireOptions struct {
+	NX, XX bool // only if the key has no expire / has one
+	GT, LT bool // only if the new expire is later / earlier
+}
+
+// ExpireAt sets the expire of key to a point in time, a time that is not
+// in the future deletes the key. It returns 0 if there is no such key
+// or opt prevented the update.
+func (c *Cache) ExpireAt(key string, at time.Time, opt ExpireOptions) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele := c.lookup(key)
+	if ele == nil {
+		return 0
+	}
+	cur := ele.Value.(*entry).expire
+	if (opt.NX && cur != nilTime) || (opt.XX && cur == nilTime) ||
+		(opt.GT && (cur == nilTime || !at.After(cur))) ||
+		(opt.LT && cur != nilTime && !at.Before(cur)) {
+		return 0
+	}
+	if !at.After(time.Now()) {
+		c.removeElement(ele)
+		c.notify("del", key)
+		return 1
+	}
+	c.setExpire(ele, at)
+	c.notify("expire", key)
+	return 1
+}
+
+// ExpireTime returns the expire of key, nilTime if it has none. exists
+// is false if there is no such key.
+func (c *Cache) ExpireTime(key string) (expire time.Time, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele := c.lookup(key)
+	if ele == nil {
+		return
+	}
+	return ele.Value.(*entry).expire, true
+}
+
+// Persist removes the expire of key, it returns 0 if there is no such key
+// or it had no expire.
+func (c *Cache) Persist(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele := c.lookup(key)
+	if ele == nil || ele.Value.(*entry).expire == nilTime {
 		return 0
 	}
+	c.setExpire(ele, nilTime)
+	c.notify("persist", key)
+	return 1
+}
+
+// has reports whether key is held, expired or not
+func (c *Cache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, hit := c.cache[key]
+	return hit
 }
 
 func (c *Cache) Exists(key string) int {
@@ -176,8 +535,8 @@ func (c *Cache) Exists(key string) int {
 
 	if ele, hit := c.cache[key]; hit {
 		kv := ele.Value.(*entry)
-		if kv.hasExpired() {
-			c.removeElement(ele)
+		if c.expired(kv) {
+			c.expireElement(ele)
 			return 0
 		}
 		return 1
@@ -191,13 +550,13 @@ func (c *Cache) Get(key string) (value []byte, err error) {
 
 	if ele, hit := c.cache[key]; hit {
 		kv := ele.Value.(*entry)
-		if kv.hasExpired() {
-			c.removeElement(ele)
+		if c.expired(kv) {
+			c.expireElement(ele)
 			return
 		}
 		switch v := kv.value.(type) {
 		case []byte:
-			c.ll.MoveToFront(ele)
+			c.touch(ele)
 			return v, nil
 		default:
 			return nil, wrongType
@@ -212,13 +571,13 @@ func (c *Cache) HGet(key string, vk string) (value []byte, err error) {
 
 	if ele, hit := c.cache[key]; hit {
 		kv := ele.Value.(*entry)
-		if kv.hasExpired() {
-			c.removeElement(ele)
+		if c.expired(kv) {
+			c.expireElement(ele)
 			return
 		}
 		switch v := kv.value.(type) {
 		case map[string][]byte:
-			c.ll.MoveToFront(ele)
+			c.touch(ele)
 			vv := v[vk]
 			return vv, nil
 		default:
@@ -234,13 +593,13 @@ func (c *Cache) HGetAll(key string) (value [][]byte, err error) {
 
 	if ele, hit := c.cache[key]; hit {
 		kv := ele.Value.(*entry)
-		if kv.hasExpired() {
-			c.removeElement(ele)
+		if c.expired(kv) {
+			c.expireElement(ele)
 			return
 		}
 		switch v := kv.value.(type) {
 		case map[string][]byte:
-			c.ll.MoveToFront(ele)
+			c.touch(ele)
 			list := make([][]byte, len(v)*2)
 			idx := 0
 			for vk, vv := range v {
@@ -262,18 +621,23 @@ func (c *Cache) HDel(key string, kk []string) (num int, err error) {
 
 	if ele, hit := c.cache[key]; hit {
 		kv := ele.Value.(*entry)
-		if kv.hasExpired() {
-			c.removeElement(ele)
+		if c.expired(kv) {
+			c.expireElement(ele)
 			return
 		}
 		switch v := kv.value.(type) {
 		case map[string][]byte:
 			for _, k := range kk {
-				if _, ok := v[k]; ok {
+				if vv, ok := v[k]; ok {
 					num++
+					c.size -= len(k) + len(vv)
 					delete(v, k)
 				}
 			}
+			if num > 0 {
+				c.notify("hdel", key)
+			}
+			c.removeIfEmpty(ele)
 			return
 		default:
 			return 0, wrongType
@@ -288,8 +652,8 @@ func (c *Cache) HExists(key, k string) (num int, err error) {
 
 	if ele, hit := c.cache[key]; hit {
 		kv := ele.Value.(*entry)
-		if kv.hasExpired() {
-			c.removeElement(ele)
+		if c.expired(kv) {
+			c.expireElement(ele)
 			return
 		}
 		switch v := kv.value.(type) {
@@ -304,78 +668,2654 @@ func (c *Cache) HExists(key, k string) (num int, err error) {
 	return
 }
 
-func (c *Cache) Remove(key []string) (num int) {
+// IncrBy adds incr to the integer stored at key, a missing key counts
+// as 0. The expire of the key is kept.
+func (c *Cache) IncrBy(key string, incr int64) (n int64, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	for _, k := range key {
-		if ele, hit := c.cache[k]; hit {
-			c.removeElement(ele)
-			num++
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele := c.lookup(key)
+	if ele != nil {
+		v, ok := ele.Value.(*entry).value.([]byte)
+		if !ok {
+			return 0, wrongType
+		}
+		if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return 0, notIntError
 		}
 	}
+	if (incr < 0 && n < math.MinInt64-incr) || (incr > 0 && n > math.MaxInt64-incr) {
+		return 0, overflowError
+	}
+	n += incr
+	c.setString(ele, key, []byte(strconv.FormatInt(n, 10)))
+	c.notify("incrby", key)
+
+	c.freeMemory()
 	return
 }
 
-func (c *Cache) removeOldest() {
-	ele := c.ll.Back()
-	if ele != nil {
-		c.removeElement(ele)
+func (c *Cache) IncrByFloat(key string, incr float64) (f float64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
 		return
 	}
-}
 
-func (c *Cache) removeElement(e *list.Element) {
-	c.ll.Remove(e)
-	kv := e.Value.(*entry)
-	delete(c.cache, kv.key)
-	c.size -= len(kv.key)
-	switch v := kv.value.(type) {
-	case []byte:
-		c.size -= len(v)
-	case map[string][]byte:
-		for vk, vv := range v {
-			c.size -= len(vk) + len(vv)
+	ele := c.lookup(key)
+	if ele != nil {
+		v, ok := ele.Value.(*entry).value.([]byte)
+		if !ok {
+			return 0, wrongType
+		}
+		if f, err = strconv.ParseFloat(string(v), 64); err != nil || math.IsNaN(f) {
+			return 0, notFloatError
 		}
 	}
-	// move the last one to the deleted position
-	// update position
-	// shrink size by 1
-	c.array[kv.pos] = c.array[len(c.array)-1]
-	c.array[len(c.array)-1].Value.(*entry).pos = kv.pos
-	c.array = c.array[:len(c.array)-1]
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, nanOrInfError
+	}
+	c.setString(ele, key, []byte(strconv.FormatFloat(f, 'f', -1, 64)))
+	c.notify("incrbyfloat", key)
+
+	c.freeMemory()
+	return
 }
 
-func (c *Cache) Flush() {
+func (c *Cache) HIncrBy(key string, field string, incr int64) (n int64, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.size = 0
-	c.ll = list.New()
-	c.cache = make(map[string]*list.Element)
-	c.array = make([]*list.Element, 0)
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele, v, err := c.hashAt(key)
+	if err != nil {
+		return
+	}
+	if vv, ok := v[field]; ok {
+		if n, err = strconv.ParseInt(string(vv), 10, 64); err != nil {
+			return 0, hashNotIntError
+		}
+	}
+	if (incr < 0 && n < math.MinInt64-incr) || (incr > 0 && n > math.MaxInt64-incr) {
+		return 0, overflowError
+	}
+	n += incr
+	c.setField(ele, key, field, []byte(strconv.FormatInt(n, 10)))
+	c.notify("hincrby", key)
+
+	c.freeMemory()
+	return
 }
 
-func (c *Cache) Stop() {
-	close(c.quit)
+func (c *Cache) HIncrByFloat(key string, field string, incr float64) (f float64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele, v, err := c.hashAt(key)
+	if err != nil {
+		return
+	}
+	if vv, ok := v[field]; ok {
+		if f, err = strconv.ParseFloat(string(vv), 64); err != nil || math.IsNaN(f) {
+			return 0, hashNotFloatError
+		}
+	}
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, nanOrInfError
+	}
+	c.setField(ele, key, field, []byte(strconv.FormatFloat(f, 'f', -1, 64)))
+	c.notify("hincrbyfloat", key)
+
+	c.freeMemory()
+	return
 }
 
-func (c *Cache) GetSize() int {
-	return c.size
+// setString stores value in the string entry ele, or in a new entry for
+// key if ele is nil, keeping any expire.
+func (c *Cache) setString(ele *list.Element, key string, value []byte) *list.Element {
+	if ele == nil {
+		c.size += len(key) + len(value)
+		return c.insert(key, value)
+	}
+	kv := ele.Value.(*entry)
+	c.size += len(value) - len(kv.value.([]byte))
+	kv.value = value
+	c.touch(ele)
+	return ele
 }
 
-func (c *Cache) GetSizeLimit() int {
-	return c.sizeLimit
+// setField stores a field in the hash entry ele, or in a new entry for
+// key if ele is nil, keeping any expire.
+func (c *Cache) setField(ele *list.Element, key string, field string, value []byte) {
+	if ele == nil {
+		c.size += len(key) + len(field) + len(value)
+		c.insert(key, map[string][]byte{field: value})
+		return
+	}
+	v := ele.Value.(*entry).value.(map[string][]byte)
+	if old, ok := v[field]; ok {
+		c.size += len(value) - len(old)
+	} else {
+		c.size += len(field) + len(value)
+	}
+	v[field] = value
+	c.touch(ele)
 }
 
-func (c *Cache) SetSizeLimit(sizeLimit int) {
-	c.sizeLimit = sizeLimit
+// hashAt looks up key and makes sure it holds a hash
+func (c *Cache) hashAt(key string) (ele *list.Element, v map[string][]byte, err error) {
+	if ele = c.lookup(key); ele == nil {
+		return
+	}
+	v, ok := ele.Value.(*entry).value.(map[string][]byte)
+	if !ok {
+		return nil, nil, wrongType
+	}
+	return
+}
+
+// IdleTime returns the time since key was last accessed
+func (c *Cache) IdleTime(key string) (idle time.Duration, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ele := c.lookup(key); ele != nil {
+		return time.Since(ele.Value.(*entry).atime), true
+	}
+	return
+}
+
+// Freq returns the access frequency counter of key, exists is false if
+// there is no such key.
+func (c *Cache) Freq(key string) (freq int, exists bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.policy.isLFU() {
+		return 0, false, noLFU
+	}
+	if ele, hit := c.cache[key]; hit {
+		kv := ele.Value.(*entry)
+		if c.expired(kv) {
+			c.expireElement(ele)
+			return
+		}
+		return int(c.lfuDecr(kv)), true, nil
+	}
+	return
+}
+
+func (c *Cache) LPush(key string, values [][]byte) (length int, err error) {
+	return c.push(key, values, true)
+}
+
+func (c *Cache) RPush(key string, values [][]byte) (length int, err error) {
+	return c.push(key, values, false)
+}
+
+var (
+	pushEvents = map[bool]string{true: "lpush", false: "rpush"}
+	popEvents  = map[bool]string{true: "lpop", false: "rpop"}
+)
+
+func (c *Cache) push(key string, values [][]byte, front bool) (length int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele, l, err := c.listAt(key)
+	if err != nil {
+		return
+	}
+	if ele == nil {
+		c.size += len(key)
+		l = list.New()
+		ele = c.insert(key, l)
+	} else {
+		c.touch(ele)
+	}
+	for _, v := range values {
+		if v == nil {
+			panic(nilValue)
+		}
+		if front {
+			l.PushFront(v)
+		} else {
+			l.PushBack(v)
+		}
+		c.size += len(v)
+	}
+	length = l.Len()
+	c.notify(pushEvents[front], key)
+
+	c.freeMemory()
+	return
+}
+
+func (c *Cache) LPop(key string, count int) (values [][]byte, err error) {
+	return c.pop(key, count, true)
+}
+
+func (c *Cache) RPop(key string, count int) (values [][]byte, err error) {
+	return c.pop(key, count, false)
+}
+
+// pop removes up to count values, values is nil if there is no such key
+func (c *Cache) pop(key string, count int, front bool) (values [][]byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, l, err := c.listAt(key)
+	if ele == nil {
+		return
+	}
+	values = make([][]byte, 0, count)
+	for len(values) < count && l.Len() > 0 {
+		var e *list.Element
+		if front {
+			e = l.Front()
+		} else {
+			e = l.Back()
+		}
+		v := l.Remove(e).([]byte)
+		c.size -= len(v)
+		values = append(values, v)
+	}
+	if len(values) > 0 {
+		c.notify(popEvents[front], key)
+	}
+	c.removeIfEmpty(ele)
+	return
+}
+
+// LMove pops a value from one end of src and pushes it to one end of dst,
+// value is nil if there is no such key
+func (c *Cache) LMove(src, dst string, srcFront, dstFront bool) (value []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	srcEle, srcList, err := c.listAt(src)
+	if err != nil {
+		return
+	}
+	dstEle, dstList, err := c.listAt(dst)
+	if err != nil || srcEle == nil {
+		return
+	}
+	c.touch(srcEle)
+	e := srcList.Back()
+	if srcFront {
+		e = srcList.Front()
+	}
+	value = srcList.Remove(e).([]byte)
+	if dstEle == nil {
+		c.size += len(dst)
+		dstList = list.New()
+		c.insert(dst, dstList)
+	}
+	if dstFront {
+		dstList.PushFront(value)
+	} else {
+		dstList.PushBack(value)
+	}
+	c.notify(popEvents[srcFront], src)
+	c.notify(pushEvents[dstFront], dst)
+	c.removeIfEmpty(srcEle)
+	return
+}
+
+func (c *Cache) LLen(key string) (length int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, l, err := c.listAt(key)
+	if ele == nil {
+		return
+	}
+	return l.Len(), nil
+}
+
+func (c *Cache) LRange(key string, start, stop int) (values [][]byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, l, err := c.listAt(key)
+	if ele == nil {
+		return [][]byte{}, err
+	}
+	c.touch(ele)
+	start, stop, ok := rangeIndex(start, stop, l.Len())
+	if !ok {
+		return [][]byte{}, nil
+	}
+	values = make([][]byte, 0, stop-start+1)
+	for e := listIndex(l, start); len(values) < stop-start+1; e = e.Next() {
+		values = append(values, e.Value.([]byte))
+	}
+	return
+}
+
+func (c *Cache) LIndex(key string, index int) (value []byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, l, err := c.listAt(key)
+	if ele == nil {
+		return
+	}
+	c.touch(ele)
+	if e := listIndex(l, index); e != nil {
+		return e.Value.([]byte), nil
+	}
+	return
+}
+
+func (c *Cache) LSet(key string, index int, value []byte) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if value == nil {
+		panic(nilValue)
+	}
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele, l, err := c.listAt(key)
+	if err != nil {
+		return
+	}
+	if ele == nil {
+		return noSuchKey
+	}
+	e := listIndex(l, index)
+	if e == nil {
+		return indexOutOfRange
+	}
+	c.touch(ele)
+	c.size += len(value) - len(e.Value.([]byte))
+	e.Value = value
+	c.notify("lset", key)
+
+	c.freeMemory()
+	return
+}
+
+// LRem removes the first count occurrences of value, from the tail if
+// count is negative and all of them if count is 0.
+func (c *Cache) LRem(key string, count int, value []byte) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, l, err := c.listAt(key)
+	if ele == nil {
+		return
+	}
+	if count >= 0 {
+		for e := l.Front(); e != nil && (count == 0 || num < count); {
+			next := e.Next()
+			if bytes.Equal(e.Value.([]byte), value) {
+				c.size -= len(l.Remove(e).([]byte))
+				num++
+			}
+			e = next
+		}
+	} else {
+		for e := l.Back(); e != nil && num < -count; {
+			prev := e.Prev()
+			if bytes.Equal(e.Value.([]byte), value) {
+				c.size -= len(l.Remove(e).([]byte))
+				num++
+			}
+			e = prev
+		}
+	}
+	if num > 0 {
+		c.notify("lrem", key)
+	}
+	c.removeIfEmpty(ele)
+	return
+}
+
+func (c *Cache) LTrim(key string, start, stop int) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, l, err := c.listAt(key)
+	if ele == nil {
+		return
+	}
+	start, stop, ok := rangeIndex(start, stop, l.Len())
+	if !ok {
+		start, stop = l.Len(), l.Len()
+	}
+	for i := 0; i < start; i++ {
+		c.size -= len(l.Remove(l.Front()).([]byte))
+	}
+	for l.Len() > stop-start+1 {
+		c.size -= len(l.Remove(l.Back()).([]byte))
+	}
+	c.notify("ltrim", key)
+	c.removeIfEmpty(ele)
+	return
+}
+
+// LInsert inserts value next to the first occurrence of pivot. It
+// returns the new length, or -1 if pivot was not found.
+func (c *Cache) LInsert(key string, before bool, pivot, value []byte) (length int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if value == nil {
+		panic(nilValue)
+	}
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele, l, err := c.listAt(key)
+	if ele == nil {
+		return
+	}
+	c.touch(ele)
+	for e := l.Front(); e != nil; e = e.Next() {
+		if bytes.Equal(e.Value.([]byte), pivot) {
+			if before {
+				l.InsertBefore(value, e)
+			} else {
+				l.InsertAfter(value, e)
+			}
+			c.size += len(value)
+			c.notify("linsert", key)
+			c.freeMemory()
+			return l.Len(), nil
+		}
+	}
+	return -1, nil
+}
+
+func (c *Cache) SAdd(key string, members []string) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele, set, err := c.setAt(key)
+	if err != nil {
+		return
+	}
+	if ele == nil {
+		c.size += len(key)
+		set = make(map[string]struct{})
+		ele = c.insert(key, set)
+	} else {
+		c.touch(ele)
+	}
+	for _, m := range members {
+		if _, ok := set[m]; !ok {
+			set[m] = struct{}{}
+			c.size += len(m)
+			num++
+		}
+	}
+	if num > 0 {
+		c.notify("sadd", key)
+	}
+
+	c.freeMemory()
+	return
+}
+
+func (c *Cache) SRem(key string, members []string) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, set, err := c.setAt(key)
+	if ele == nil {
+		return
+	}
+	for _, m := range members {
+		if _, ok := set[m]; ok {
+			delete(set, m)
+			c.size -= len(m)
+			num++
+		}
+	}
+	if num > 0 {
+		c.notify("srem", key)
+	}
+	c.removeIfEmpty(ele)
+	return
+}
+
+func (c *Cache) SMembers(key string) (members [][]byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, set, err := c.setAt(key)
+	if ele == nil {
+		return [][]byte{}, err
+	}
+	c.touch(ele)
+	return setMembers(set), nil
+}
+
+func (c *Cache) SIsMember(key string, member string) (num int, err error) {
+	nums, err := c.SMIsMember(key, []string{member})
+	if err != nil {
+		return
+	}
+	return nums[0], nil
+}
+
+func (c *Cache) SMIsMember(key string, members []string) (nums []int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, set, err := c.setAt(key)
+	if err != nil {
+		return
+	}
+	if ele != nil {
+		c.touch(ele)
+	}
+	nums = make([]int, len(members))
+	for i, m := range members {
+		if _, ok := set[m]; ok {
+			nums[i] = 1
+		}
+	}
+	return
+}
+
+func (c *Cache) SCard(key string) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, set, err := c.setAt(key)
+	if ele == nil {
+		return
+	}
+	return len(set), nil
+}
+
+// SPop removes and returns up to count random members, members is nil
+// if there is no such key.
+func (c *Cache) SPop(key string, count int) (members [][]byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, set, err := c.setAt(key)
+	if ele == nil {
+		return
+	}
+	members = make([][]byte, 0, count)
+	for m := range set {
+		if len(members) >= count {
+			break
+		}
+		delete(set, m)
+		c.size -= len(m)
+		members = append(members, []byte(m))
+	}
+	if len(members) > 0 {
+		c.notify("spop", key)
+	}
+	c.removeIfEmpty(ele)
+	return
+}
+
+// SRandMember returns count distinct random members, or -count members
+// that may repeat if count is negative.
+func (c *Cache) SRandMember(key string, count int) (members [][]byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, set, err := c.setAt(key)
+	if ele == nil {
+		return
+	}
+	c.touch(ele)
+	all := setMembers(set)
+	if count < 0 {
+		members = make([][]byte, -count)
+		for i := range members {
+			members[i] = all[rand.Intn(len(all))]
+		}
+		return
+	}
+	if count > len(all) {
+		count = len(all)
+	}
+	members = make([][]byte, count)
+	for i, x := range rand.Perm(len(all))[:count] {
+		members[i] = all[x]
+	}
+	return
+}
+
+func (c *Cache) SMove(src, dst string, member string) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	srcEle, srcSet, err := c.setAt(src)
+	if err != nil {
+		return
+	}
+	dstEle, dstSet, err := c.setAt(dst)
+	if err != nil || srcEle == nil {
+		return
+	}
+	if _, ok := srcSet[member]; !ok {
+		return
+	}
+	if src == dst {
+		return 1, nil
+	}
+	delete(srcSet, member)
+	c.size -= len(member)
+	if dstEle == nil {
+		c.size += len(dst)
+		dstSet = make(map[string]struct{})
+		c.insert(dst, dstSet)
+	}
+	if _, ok := dstSet[member]; !ok {
+		dstSet[member] = struct{}{}
+		c.size += len(member)
+	}
+	c.notify("srem", src)
+	c.notify("sadd", dst)
+	c.removeIfEmpty(srcEle)
+	return 1, nil
+}
+
+const (
+	setUnion = iota
+	setInter
+	setDiff
+)
+
+var (
+	setStoreEvents  = []string{setUnion: "sunionstore", setInter: "sinterstore", setDiff: "sdiffstore"}
+	zsetStoreEvents = []string{setUnion: "zunionstore", setInter: "zinterstore"}
+)
+
+func (c *Cache) SUnion(keys []string) ([][]byte, error) {
+	return c.setOperation(setUnion, keys)
+}
+
+func (c *Cache) SInter(keys []string) ([][]byte, error) {
+	return c.setOperation(setInter, keys)
+}
+
+func (c *Cache) SDiff(keys []string) ([][]byte, error) {
+	return c.setOperation(setDiff, keys)
+}
+
+func (c *Cache) SUnionStore(dst string, keys []string) (int, error) {
+	return c.setOperationStore(setUnion, dst, keys)
+}
+
+func (c *Cache) SInterStore(dst string, keys []string) (int, error) {
+	return c.setOperationStore(setInter, dst, keys)
+}
+
+func (c *Cache) SDiffStore(dst string, keys []string) (int, error) {
+	return c.setOperationStore(setDiff, dst, keys)
+}
+
+func (c *Cache) setOperation(op int, keys []string) (members [][]byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	set, err := c.combineSets(op, keys)
+	if err != nil {
+		return
+	}
+	return setMembers(set), nil
+}
+
+// setOperationStore overwrites dst with the result, whatever type it was
+func (c *Cache) setOperationStore(op int, dst string, keys []string) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	set, err := c.combineSets(op, keys)
+	if err != nil {
+		return
+	}
+	ele := c.lookup(dst)
+	if ele != nil {
+		c.removeElement(ele)
+	}
+	if len(set) > 0 {
+		c.size += len(dst)
+		for m := range set {
+			c.size += len(m)
+		}
+		c.insert(dst, set)
+		c.notify(setStoreEvents[op], dst)
+	} else if ele != nil {
+		c.notify("del", dst)
+	}
+
+	c.freeMemory()
+	return len(set), nil
+}
+
+// combineSets returns a new set, missing keys count as empty sets
+func (c *Cache) combineSets(op int, keys []string) (map[string]struct{}, error) {
+	sets := make([]map[string]struct{}, len(keys))
+	for i, k := range keys {
+		ele, set, err := c.setAt(k)
+		if err != nil {
+			return nil, err
+		}
+		if ele != nil {
+			c.touch(ele)
+		}
+		sets[i] = set
+	}
+
+	result := make(map[string]struct{})
+	switch op {
+	case setUnion:
+		for _, set := range sets {
+			for m := range set {
+				result[m] = struct{}{}
+			}
+		}
+	case setInter:
+	outer:
+		for m := range sets[0] {
+			for _, set := range sets[1:] {
+				if _, ok := set[m]; !ok {
+					continue outer
+				}
+			}
+			result[m] = struct{}{}
+		}
+	case setDiff:
+		for m := range sets[0] {
+			result[m] = struct{}{}
+		}
+		for _, set := range sets[1:] {
+			for m := range set {
+				delete(result, m)
+			}
+		}
+	}
+	return result, nil
+}
+
+// setAt looks up key and makes sure it holds a set
+func (c *Cache) setAt(key string) (ele *list.Element, set map[string]struct{}, err error) {
+	if ele = c.lookup(key); ele == nil {
+		return
+	}
+	set, ok := ele.Value.(*entry).value.(map[string]struct{})
+	if !ok {
+		return nil, nil, wrongType
+	}
+	return
+}
+
+func setMembers(set map[string]struct{}) [][]byte {
+	members := make([][]byte, 0, len(set))
+	for m := range set {
+		members = append(members, []byte(m))
+	}
+	return members
+}
+
+// ZMember is a member of a sorted set along with its score
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// ZAddOptions are the flags of the ZADD command
+type ZAddOptions struct {
+	NX, XX bool // only add new members / only update existing ones
+	GT, LT bool // only update if the new score is greater / less
+	CH     bool // count changed members as well as added ones
+}
+
+// ZAdd adds members with their scores and returns the number of added
+// members, plus the updated ones if CH is set.
+func (c *Cache) ZAdd(key string, opt ZAddOptions, members []ZMember) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele, zs, err := c.zsetAt(key)
+	if err != nil {
+		return
+	}
+	if ele == nil {
+		if opt.XX {
+			return
+		}
+		c.size += len(key)
+		zs = newZset()
+		ele = c.insert(key, zs)
+	} else {
+		c.touch(ele)
+	}
+	changed := false
+	for _, m := range members {
+		added, updated, _ := c.zadd(zs, opt, m.Member, m.Score)
+		if added || (opt.CH && updated) {
+			num++
+		}
+		changed = changed || added || updated
+	}
+	if changed {
+		c.notify("zadd", key)
+	}
+	c.removeIfEmpty(ele)
+
+	c.freeMemory()
+	return
+}
+
+// ZIncrBy adds incr to the score of member, ok is false if the options
+// prevented the update.
+func (c *Cache) ZIncrBy(key string, opt ZAddOptions, incr float64, member string) (score float64, ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele, zs, err := c.zsetAt(key)
+	if err != nil {
+		return
+	}
+	if ele == nil {
+		if opt.XX {
+			return
+		}
+		c.size += len(key)
+		zs = newZset()
+		ele = c.insert(key, zs)
+	} else {
+		c.touch(ele)
+	}
+	score = incr
+	if cur, exists := zs.dict[member]; exists {
+		if score += cur; math.IsNaN(score) {
+			c.removeIfEmpty(ele)
+			return 0, false, nanScore
+		}
+	}
+	_, _, ok = c.zadd(zs, opt, member, score)
+	if ok {
+		c.notify("zincr", key)
+	}
+	c.removeIfEmpty(ele)
+
+	c.freeMemory()
+	return
+}
+
+// zadd sets the score of member as restricted by opt, ok is false if the
+// options prevented it.
+func (c *Cache) zadd(zs *zset, opt ZAddOptions, member string, score float64) (added, updated, ok bool) {
+	cur, exists := zs.dict[member]
+	switch {
+	case exists:
+		if opt.NX || (opt.GT && score <= cur) || (opt.LT && score >= cur) {
+			return
+		}
+		if score != cur {
+			zs.zsl.delete(cur, member)
+			zs.zsl.insert(score, member)
+			zs.dict[member] = score
+			updated = true
+		}
+	case opt.XX:
+		return
+	default:
+		zs.zsl.insert(score, member)
+		zs.dict[member] = score
+		c.size += len(member) + 8
+		added = true
+	}
+	return added, updated, true
+}
+
+func (c *Cache) ZRem(key string, members []string) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, zs, err := c.zsetAt(key)
+	if ele == nil {
+		return
+	}
+	for _, m := range members {
+		if c.zrem(zs, m) {
+			num++
+		}
+	}
+	if num > 0 {
+		c.notify("zrem", key)
+	}
+	c.removeIfEmpty(ele)
+	return
+}
+
+func (c *Cache) zrem(zs *zset, member string) bool {
+	score, ok := zs.dict[member]
+	if !ok {
+		return false
+	}
+	zs.zsl.delete(score, member)
+	delete(zs.dict, member)
+	c.size -= len(member) + 8
+	return true
+}
+
+func (c *Cache) ZScore(key string, member string) (score float64, ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, zs, err := c.zsetAt(key)
+	if ele == nil {
+		return
+	}
+	c.touch(ele)
+	score, ok = zs.dict[member]
+	return
+}
+
+func (c *Cache) ZCard(key string) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, zs, err := c.zsetAt(key)
+	if ele == nil {
+		return
+	}
+	return zs.zsl.length, nil
+}
+
+// ZRank returns the 0 based rank of member, ordered from the highest
+// score if rev is set.
+func (c *Cache) ZRank(key string, member string, rev bool) (rank int, ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, zs, err := c.zsetAt(key)
+	if ele == nil {
+		return
+	}
+	c.touch(ele)
+	score, ok := zs.dict[member]
+	if !ok {
+		return
+	}
+	rank = zs.zsl.rank(score, member) - 1
+	if rev {
+		rank = zs.zsl.length - 1 - rank
+	}
+	return
+}
+
+func (c *Cache) ZCount(key string, r ScoreRange) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele, zs, err := c.zsetAt(key)
+	if ele == nil {
+		return
+	}
+	first := zs.zsl.firstInRange(r)
+	if first == nil {
+		return
+	}
+	last := zs.zsl.lastInRange(r)
+	return zs.zsl.rank(last.score, last.member) - zs.zsl.rank(first.score, first.member) + 1, nil
+}
+
+// ZRange returns the members with ranks between start and stop, which
+// may be negative to count from the end.
+func (c *Cache) ZRange(key string, start, stop int, rev bool) (members []ZMember, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members = []ZMember{}
+	ele, zs, err := c.zsetAt(key)
+	if ele == nil {
+		return
+	}
+	c.touch(ele)
+	start, stop, ok := rangeIndex(start, stop, zs.zsl.length)
+	if !ok {
+		return
+	}
+	var x *skiplistNode
+	if rev {
+		x = zs.zsl.byRank(zs.zsl.length - start)
+	} else {
+		x = zs.zsl.byRank(start + 1)
+	}
+	for i := start; i <= stop; i++ {
+		members = append(members, ZMember{x.member, x.score})
+		x = x.next(rev)
+	}
+	return
+}
+
+// ZRangeByScore returns the members with scores in r, skipping offset of
+// them and returning at most count if count is not negative.
+func (c *Cache) ZRangeByScore(key string, r ScoreRange, rev bool, offset, count int) (members []ZMember, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members = []ZMember{}
+	ele, zs, err := c.zsetAt(key)
+	if ele == nil {
+		return
+	}
+	c.touch(ele)
+	var x *skiplistNode
+	if rev {
+		x = zs.zsl.lastInRange(r)
+	} else {
+		x = zs.zsl.firstInRange(r)
+	}
+	for ; x != nil && offset > 0; offset-- {
+		x = x.next(rev)
+	}
+	for ; x != nil && count != 0; count-- {
+		if (rev && !r.gteMin(x.score)) || (!rev && !r.lteMax(x.score)) {
+			break
+		}
+		members = append(members, ZMember{x.member, x.score})
+		x = x.next(rev)
+	}
+	return
+}
+
+// ZRangeByLex is ZRangeByScore comparing members instead of scores, it
+// expects all members to have the same score.
+func (c *Cache) ZRangeByLex(key string, r LexRange, rev bool, offset, count int) (members []ZMember, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members = []ZMember{}
+	ele, zs, err := c.zsetAt(key)
+	if ele == nil {
+		return
+	}
+	c.touch(ele)
+	var x *skiplistNode
+	if rev {
+		x = zs.zsl.lastInLexRange(r)
+	} else {
+		x = zs.zsl.firstInLexRange(r)
+	}
+	for ; x != nil && offset > 0; offset-- {
+		x = x.next(rev)
+	}
+	for ; x != nil && count != 0; count-- {
+		if (rev && !r.gteMin(x.member)) || (!rev && !r.lteMax(x.member)) {
+			break
+		}
+		members = append(members, ZMember{x.member, x.score})
+		x = x.next(rev)
+	}
+	return
+}
+
+func (c *Cache) ZPopMin(key string, count int) ([]ZMember, error) {
+	return c.zpop(key, count, false)
+}
+
+func (c *Cache) ZPopMax(key string, count int) ([]ZMember, error) {
+	return c.zpop(key, count, true)
+}
+
+func (c *Cache) zpop(key string, count int, max bool) (members []ZMember, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members = []ZMember{}
+	ele, zs, err := c.zsetAt(key)
+	if ele == nil {
+		return
+	}
+	for len(members) < count && zs.zsl.length > 0 {
+		x := zs.zsl.header.level[0].forward
+		if max {
+			x = zs.zsl.tail
+		}
+		members = append(members, ZMember{x.member, x.score})
+		c.zrem(zs, x.member)
+	}
+	if len(members) > 0 {
+		c.notify(map[bool]string{false: "zpopmin", true: "zpopmax"}[max], key)
+	}
+	c.removeIfEmpty(ele)
+	return
+}
+
+const (
+	AggregateSum = iota
+	AggregateMin
+	AggregateMax
+)
+
+func (c *Cache) ZUnionStore(dst string, keys []string, weights []float64, aggregate int) (int, error) {
+	return c.zsetOperationStore(setUnion, dst, keys, weights, aggregate)
+}
+
+func (c *Cache) ZInterStore(dst string, keys []string, weights []float64, aggregate int) (int, error) {
+	return c.zsetOperationStore(setInter, dst, keys, weights, aggregate)
+}
+
+// zsetOperationStore combines sorted sets, or plain sets whose members
+// count as having score 1, and overwrites dst with the result. weights
+// may be nil.
+func (c *Cache) zsetOperationStore(op int, dst string, keys []string, weights []float64, aggregate int) (num int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	inputs := make([]map[string]float64, len(keys))
+	for i, k := range keys {
+		ele := c.lookup(k)
+		if ele == nil {
+			continue
+		}
+		switch v := ele.Value.(*entry).value.(type) {
+		case *zset:
+			inputs[i] = v.dict
+		case map[string]struct{}:
+			inputs[i] = make(map[string]float64, len(v))
+			for m := range v {
+				inputs[i][m] = 1
+			}
+		default:
+			return 0, wrongType
+		}
+	}
+
+	result := make(map[string]float64)
+	for i, input := range inputs {
+		for m, score := range input {
+			if weights != nil {
+				score *= weights[i]
+			}
+			if math.IsNaN(score) {
+				score = 0
+			}
+			if cur, exists := result[m]; exists {
+				result[m] = aggregateScores(aggregate, cur, score)
+			} else if op == setUnion || i == 0 {
+				result[m] = score
+			}
+		}
+		if op == setInter && i > 0 {
+			for m := range result {
+				if _, ok := input[m]; !ok {
+					delete(result, m)
+				}
+			}
+		}
+	}
+
+	ele := c.lookup(dst)
+	if ele != nil {
+		c.removeElement(ele)
+	}
+	if len(result) > 0 {
+		zs := newZset()
+		c.size += len(dst)
+		c.insert(dst, zs)
+		for m, score := range result {
+			c.zadd(zs, ZAddOptions{}, m, score)
+		}
+		c.notify(zsetStoreEvents[op], dst)
+	} else if ele != nil {
+		c.notify("del", dst)
+	}
+
+	c.freeMemory()
+	return len(result), nil
+}
+
+func aggregateScores(aggregate int, a, b float64) float64 {
+	switch aggregate {
+	case AggregateMin:
+		return math.Min(a, b)
+	case AggregateMax:
+		return math.Max(a, b)
+	}
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+}
+
+// zsetAt looks up key and makes sure it holds a sorted set
+func (c *Cache) zsetAt(key string) (ele *list.Element, zs *zset, err error) {
+	if ele = c.lookup(key); ele == nil {
+		return
+	}
+	zs, ok := ele.Value.(*entry).value.(*zset)
+	if !ok {
+		return nil, nil, wrongType
+	}
+	return
+}
+
+// ScoreRange is an interval of scores, see ParseScoreRange
+type ScoreRange struct {
+	min, max     float64
+	minex, maxex bool
+}
+
+// ParseScoreRange parses min and max as in ZRANGEBYSCORE, where a leading
+// "(" excludes the bound and "-inf" and "+inf" are allowed.
+func ParseScoreRange(min, max string) (r ScoreRange, err error) {
+	parse := func(s string) (f float64, ex bool, err error) {
+		if strings.HasPrefix(s, "(") {
+			s, ex = s[1:], true
+		}
+		f, err = strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) {
+			err = invalidScoreRange
+		}
+		return
+	}
+	if r.min, r.minex, err = parse(min); err != nil {
+		return
+	}
+	r.max, r.maxex, err = parse(max)
+	return
+}
+
+func (r ScoreRange) gteMin(score float64) bool {
+	if r.minex {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r ScoreRange) lteMax(score float64) bool {
+	if r.maxex {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+// lexBound is a member, or -inf / +inf if inf is -1 / 1
+type lexBound struct {
+	value string
+	ex    bool
+	inf   int
+}
+
+// LexRange is an interval of members, see ParseLexRange
+type LexRange struct {
+	min, max lexBound
+}
+
+// ParseLexRange parses min and max as in ZRANGEBYLEX: each starts with
+// "[" or "(" for an inclusive or exclusive bound, or is "-" or "+".
+func ParseLexRange(min, max string) (r LexRange, err error) {
+	parse := func(s string) (b lexBound, err error) {
+		switch {
+		case s == "-":
+			b.inf = -1
+		case s == "+":
+			b.inf = 1
+		case strings.HasPrefix(s, "["):
+			b.value = s[1:]
+		case strings.HasPrefix(s, "("):
+			b.value, b.ex = s[1:], true
+		default:
+			err = invalidLexRange
+		}
+		return
+	}
+	if r.min, err = parse(min); err != nil {
+		return
+	}
+	r.max, err = parse(max)
+	return
+}
+
+func (r LexRange) gteMin(member string) bool {
+	switch {
+	case r.min.inf != 0:
+		return r.min.inf < 0
+	case r.min.ex:
+		return member > r.min.value
+	default:
+		return member >= r.min.value
+	}
+}
+
+func (r LexRange) lteMax(member string) bool {
+	switch {
+	case r.max.inf != 0:
+		return r.max.inf > 0
+	case r.max.ex:
+		return member < r.max.value
+	default:
+		return member <= r.max.value
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// zset keeps members both in a map for score lookups and in a skiplist
+// ordered by score then member.
+type zset struct {
+	dict map[string]float64
+	zsl  *skiplist
+}
+
+func newZset() *zset {
+	return &zset{
+		dict: make(map[string]float64),
+		zsl:  newSkiplist(),
+	}
+}
+
+// add inserts a member that is not in the set yet, it returns false if
+// the member exists or the score is NaN.
+func (zs *zset) add(member string, score float64) bool {
+	if _, ok := zs.dict[member]; ok || math.IsNaN(score) {
+		return false
+	}
+	zs.zsl.insert(score, member)
+	zs.dict[member] = score
+	return true
+}
+
+// Based on the skiplist of redis' t_zset.c, every level also records the
+// number of nodes it skips so that ranks can be computed in O(log n).
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func (x *skiplistNode) next(rev bool) *skiplistNode {
+	if rev {
+		return x.backward
+	}
+	return x.level[0].forward
+}
+
+// before reports whether the node sorts before score and member
+func (x *skiplistNode) before(score float64, member string) bool {
+	return x.score < score || (x.score == score && x.member < member)
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+func (zsl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i != zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+	return true
+}
+
+// rank returns the 1 based rank of the node, 0 if it is not found
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.before(score, member) || x.level[i].forward.member == member) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node with the given 1 based rank
+func (zsl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+func (zsl *skiplist) firstInRange(r ScoreRange) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+func (zsl *skiplist) lastInRange(r ScoreRange) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.score) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !r.gteMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+func (zsl *skiplist) firstInLexRange(r LexRange) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.gteMin(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !r.lteMax(x.member) {
+		return nil
+	}
+	return x
+}
+
+func (zsl *skiplist) lastInLexRange(r LexRange) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.lteMax(x.level[i].forward.member) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !r.gteMin(x.member) {
+		return nil
+	}
+	return x
+}
+
+//------------------------------------------------------------------------------
+
+// Keys returns all keys matching the glob-style pattern
+func (c *Cache) Keys(pattern string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0)
+	for key, ele := range c.cache {
+		if !c.expired(ele.Value.(*entry)) && globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Scan visits count entries of the cache starting at cursor, 0 to start
+// a new iteration, and returns the keys matching pattern and typ, either
+// of which may be empty to match everything. It returns the cursor to
+// continue from, or 0 once the iteration is complete.
+//
+// Entries are visited from the end of c.array towards its start. As
+// removeElement only ever moves the last entry, which has been visited
+// already unless it sits below the cursor too, every key present for the
+// whole iteration is returned at least once.
+func (c *Cache) Scan(cursor int, count int, pattern string, typ string) (next int, keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cursor <= 0 || cursor > len(c.array) {
+		cursor = len(c.array)
+	}
+	keys = make([]string, 0)
+	for ; cursor > 0 && count > 0; count-- {
+		cursor--
+		kv := c.array[cursor].Value.(*entry)
+		if c.expired(kv) ||
+			(typ != "" && typeOf(kv.value) != typ) ||
+			(pattern != "" && !globMatch(pattern, kv.key)) {
+			continue
+		}
+		keys = append(keys, kv.key)
+	}
+	return cursor, keys
+}
+
+// HScan returns the fields and values of the hash at key matching pattern.
+// Go maps cannot be iterated incrementally, so collections are always
+// scanned in a single call.
+func (c *Cache) HScan(key string, pattern string) (fields [][]byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fields = make([][]byte, 0)
+	ele, v, err := c.hashAt(key)
+	if ele == nil {
+		return
+	}
+	for vk, vv := range v {
+		if pattern == "" || globMatch(pattern, vk) {
+			fields = append(fields, []byte(vk), vv)
+		}
+	}
+	return
+}
+
+// SScan returns the members of the set at key matching pattern
+func (c *Cache) SScan(key string, pattern string) (members [][]byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members = make([][]byte, 0)
+	ele, set, err := c.setAt(key)
+	if ele == nil {
+		return
+	}
+	for m := range set {
+		if pattern == "" || globMatch(pattern, m) {
+			members = append(members, []byte(m))
+		}
+	}
+	return
+}
+
+// ZScan returns the members of the sorted set at key matching pattern
+func (c *Cache) ZScan(key string, pattern string) (members []ZMember, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	members = make([]ZMember, 0)
+	ele, zs, err := c.zsetAt(key)
+	if ele == nil {
+		return
+	}
+	for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		if pattern == "" || globMatch(pattern, x.member) {
+			members = append(members, ZMember{x.member, x.score})
+		}
+	}
+	return
+}
+
+// typeOf returns the name of the type of a value as used by redis
+func typeOf(value interface{}) string {
+	switch value.(type) {
+	case []byte:
+		return "string"
+	case map[string][]byte:
+		return "hash"
+	case *list.List:
+		return "list"
+	case map[string]struct{}:
+		return "set"
+	case *zset:
+		return "zset"
+	}
+	return "none"
+}
+
+// lookup returns the element of key, or nil if there is none. Expired
+// entries are deleted on the way.
+func (c *Cache) lookup(key string) *list.Element {
+	if ele, hit := c.cache[key]; hit {
+		if c.expired(ele.Value.(*entry)) {
+			c.expireElement(ele)
+			return nil
+		}
+		return ele
+	}
+	return nil
+}
+
+// listAt looks up key and makes sure it holds a list
+func (c *Cache) listAt(key string) (ele *list.Element, l *list.List, err error) {
+	if ele = c.lookup(key); ele == nil {
+		return
+	}
+	l, ok := ele.Value.(*entry).value.(*list.List)
+	if !ok {
+		return nil, nil, wrongType
+	}
+	return
+}
+
+// removeIfEmpty deletes keys whose collection became empty, as redis
+// never keeps empty aggregate values around.
+func (c *Cache) removeIfEmpty(e *list.Element) {
+	empty := false
+	switch v := e.Value.(*entry).value.(type) {
+	case map[string][]byte:
+		empty = len(v) == 0
+	case *list.List:
+		empty = v.Len() == 0
+	case map[string]struct{}:
+		empty = len(v) == 0
+	case *zset:
+		empty = v.zsl.length == 0
+	}
+	if empty {
+		c.removeElement(e)
+		c.notify("del", e.Value.(*entry).key)
+	}
+}
+
+// rangeIndex turns start and stop, which may be negative to count from
+// the end, into a range within [0, n). ok is false if it is empty.
+func rangeIndex(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// listIndex walks to the index-th element of l, from whichever end is
+// closer. Negative indexes count from the tail.
+func listIndex(l *list.List, index int) *list.Element {
+	if index < 0 {
+		index += l.Len()
+	}
+	if index < 0 || index >= l.Len() {
+		return nil
+	}
+	if index < l.Len()/2 {
+		e := l.Front()
+		for ; index > 0; index-- {
+			e = e.Next()
+		}
+		return e
+	}
+	e := l.Back()
+	for index = l.Len() - 1 - index; index > 0; index-- {
+		e = e.Prev()
+	}
+	return e
+}
+
+// Type returns the type name of the value at key, "none" if there is no
+// such key.
+func (c *Cache) Type(key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele := c.lookup(key)
+	if ele == nil {
+		return "none"
+	}
+	return typeOf(ele.Value.(*entry).value)
+}
+
+// Rename moves the value and expire of src to dst, overwriting dst unless
+// nx is set. ok is false if nx prevented it.
+func (c *Cache) Rename(src, dst string, nx bool) (ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele := c.lookup(src)
+	if ele == nil {
+		return false, noSuchKey
+	}
+	if src == dst {
+		return !nx, nil
+	}
+	if d := c.lookup(dst); d != nil {
+		if nx {
+			return false, nil
+		}
+		c.removeElement(d)
+	}
+	kv := ele.Value.(*entry)
+	delete(c.cache, src)
+	kv.key = dst
+	c.cache[dst] = ele
+	c.size += len(dst) - len(src)
+	c.touch(ele)
+	c.notify("rename_from", src)
+	c.notify("rename_to", dst)
+	return true, nil
+}
+
+// Copy duplicates the value and expire of src at dst. It returns 0 if
+// src does not exist or dst does and replace is not set.
+func (c *Cache) Copy(src, dst string, replace bool) (num int, err error) {
+	if src == dst {
+		return 0, sameObject
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele := c.lookup(src)
+	if ele == nil {
+		return
+	}
+	if d := c.lookup(dst); d != nil {
+		if !replace {
+			return
+		}
+		c.removeElement(d)
+	}
+	kv := ele.Value.(*entry)
+	c.size += len(dst) + valueSize(kv.value)
+	c.setExpire(c.insert(dst, copyValue(kv.value)), kv.expire)
+	c.notify("copy_to", dst)
+
+	c.freeMemory()
+	return 1, nil
+}
+
+// copyValue returns a deep copy of a value
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string][]byte:
+		h := make(map[string][]byte, len(v))
+		for vk, vv := range v {
+			h[vk] = vv
+		}
+		return h
+	case *list.List:
+		l := list.New()
+		l.PushBackList(v)
+		return l
+	case map[string]struct{}:
+		set := make(map[string]struct{}, len(v))
+		for m := range v {
+			set[m] = struct{}{}
+		}
+		return set
+	case *zset:
+		zs := newZset()
+		for x := v.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			zs.add(x.member, x.score)
+		}
+		return zs
+	}
+	// strings are never modified in place
+	return value
+}
+
+// Dump serializes the value at key in the format of redis' DUMP, nil if
+// there is no such key.
+func (c *Cache) Dump(key string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ele := c.lookup(key)
+	if ele == nil {
+		return nil
+	}
+	return dumpValue(ele.Value.(*entry).value)
+}
+
+// RestoreOptions are the options of Restore
+type RestoreOptions struct {
+	// overwrite an existing key
+	Replace bool
+	// the key is not created if it is in the past, zero for no expire
+	Expire time.Time
+	// under an LFU policy the access counter is set to Freq if SetFreq is
+	// set, under the others the key is last accessed IdleTime ago if it is
+	// over 0
+	IdleTime time.Duration
+	Freq     uint8
+	SetFreq  bool
+}
+
+// Restore creates key from a payload made by Dump
+func (c *Cache) Restore(key string, payload []byte, opt RestoreOptions) (err error) {
+	value, err := restoreValue(payload)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.freeMemory(); err != nil {
+		return
+	}
+
+	ele := c.lookup(key)
+	if ele != nil {
+		if !opt.Replace {
+			return busyKey
+		}
+		c.removeElement(ele)
+	}
+	if opt.Expire != nilTime && opt.Expire.Before(time.Now()) {
+		return
+	}
+	c.size += len(key) + valueSize(value)
+	ele = c.insert(key, value)
+	c.setExpire(ele, opt.Expire)
+	if c.policy.isLFU() {
+		if opt.SetFreq {
+			ele.Value.(*entry).freq = opt.Freq
+		}
+	} else if opt.IdleTime > 0 {
+		ele.Value.(*entry).atime = time.Now().Add(-opt.IdleTime)
+		c.placeByAccess(ele)
+	}
+	c.notify("restore", key)
+
+	c.freeMemory()
+	return
+}
+
+// RandomKey returns a random key, ok is false if the cache is empty
+func (c *Cache) RandomKey() (key string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for tries := 0; len(c.array) > 0; tries++ {
+		ele := c.array[rand.Intn(len(c.array))]
+		kv := ele.Value.(*entry)
+		if !c.expired(kv) {
+			return kv.key, true
+		}
+		if c.mem.passive {
+			// expired entries are kept, there may be nothing else
+			if tries == 100 {
+				return kv.key, true
+			}
+			continue
+		}
+		c.expireElement(ele)
+	}
+	return
+}
+
+// DBSize returns the number of keys, including expired ones that have
+// not been collected yet.
+func (c *Cache) DBSize() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.cache)
+}
+
+// Touch records an access to each of the keys and returns how many of
+// them exist.
+func (c *Cache) Touch(keys []string) (num int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, k := range keys {
+		if ele := c.lookup(k); ele != nil {
+			c.touch(ele)
+			num++
+		}
+	}
+	return
+}
+
+// values with more elements are released in the background by Unlink,
+// same as redis' LAZYFREE_THRESHOLD
+const lazyFreeThreshold = 64
+
+// lazyFree runs the release of unlinked values, replaced by tests
+var lazyFree = func(release func()) { go release() }
+
+// Unlink removes keys like Remove. The size of large values is estimated
+// to free it at once, and their elements are walked in the background to
+// correct it, instead of with the lock held.
+func (c *Cache) Unlink(keys []string) (num int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, k := range keys {
+		ele, hit := c.cache[k]
+		if !hit {
+			continue
+		}
+		num++
+		kv := ele.Value.(*entry)
+		if valueLen(kv.value) <= lazyFreeThreshold {
+			c.removeElement(ele)
+			c.notify("del", k)
+			continue
+		}
+		c.detach(ele)
+		estimate := estimateSize(kv.value)
+		c.size -= len(k) + estimate
+		c.notify("del", k)
+		lazyFree(func(value interface{}, epoch int) func() {
+			return func() {
+				size := valueSize(value)
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				if c.epoch == epoch {
+					c.size -= size - estimate
+				}
+			}
+		}(kv.value, c.epoch))
+	}
+	return
+}
+
+// moveMu serializes Move between caches of different groups, it is taken
+// before the locks of both so that opposite moves cannot deadlock
+var moveMu sync.Mutex
+
+// Move transfers key with its expire to dst. ok is false if key does not
+// exist or dst already has it.
+func (c *Cache) Move(key string, dst *Cache) (ok bool, err error) {
+	if c == dst {
+		return false, sameObject
+	}
+	if dst.mu != c.mu {
+		moveMu.Lock()
+		defer moveMu.Unlock()
+		dst.mu.Lock()
+		defer dst.mu.Unlock()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = dst.freeMemory(); err != nil {
+		return
+	}
+
+	ele := c.lookup(key)
+	if ele == nil || dst.lookup(key) != nil {
+		return
+	}
+	kv := ele.Value.(*entry)
+	expire := kv.expire
+	c.removeElement(ele)
+	dst.size += len(key) + valueSize(kv.value)
+	dst.setExpire(dst.insert(key, kv.value), expire)
+	c.notify("move_from", key)
+	dst.notify("move_to", key)
+
+	dst.freeMemory()
+	return true, nil
+}
+
+// ExpiresCount returns the number of keys with an expire set
+func (c *Cache) ExpiresCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.volatile)
+}
+
+// entries returns a point-in-time copy of the entries that have not
+// expired, for persistence
+func (c *Cache) entries() []*entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]*entry, 0, len(c.array))
+	for _, ele := range c.array {
+		kv := ele.Value.(*entry)
+		if c.expired(kv) {
+			continue
+		}
+		entries = append(entries, &entry{
+			key:    kv.key,
+			value:  copyValue(kv.value),
+			expire: kv.expire,
+		})
+	}
+	return entries
+}
+
+// load stores a value read back from persistence, replacing the key if
+// it exists. Like the other writes it may evict entries to make room.
+func (c *Cache) load(key string, value interface{}, expire time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ele, hit := c.cache[key]; hit {
+		c.removeElement(ele)
+	}
+	c.size += len(key) + valueSize(value)
+	c.setExpire(c.insert(key, value), expire)
+
+	c.freeMemory()
+}
+
+func (c *Cache) Remove(key []string) (num int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, k := range key {
+		if ele, hit := c.cache[k]; hit {
+			c.removeElement(ele)
+			c.notify("del", k)
+			num++
+		}
+	}
+	return
+}
+
+func (c *Cache) insert(key string, value interface{}) *list.Element {
+	ele := c.ll.PushFront(&entry{
+		key:     key,
+		value:   value,
+		pos:     len(c.array),
+		vpos:    -1,
+		atime:   time.Now(),
+		freq:    lfuInitVal,
+		ldt:     time.Now(),
+		version: nextVersion(),
+	})
+	c.cache[key] = ele
+	c.array = append(c.array, ele)
+	return ele
+}
+
+// placeByAccess moves e to where its access time puts it, so that the
+// entries stay ordered for the LRU policies
+func (c *Cache) placeByAccess(e *list.Element) {
+	atime := e.Value.(*entry).atime
+	for mark := c.ll.Front(); mark != nil; mark = mark.Next() {
+		if mark != e && mark.Value.(*entry).atime.Before(atime) {
+			c.ll.MoveBefore(e, mark)
+			return
+		}
+	}
+	c.ll.MoveToBack(e)
+}
+
+// touch records an access to the entry
+func (c *Cache) touch(e *list.Element) {
+	c.ll.MoveToFront(e)
+	kv := e.Value.(*entry)
+	kv.atime = time.Now()
+	if c.policy.isLFU() {
+		kv.freq = c.lfuLogIncr(c.lfuDecr(kv))
+		kv.ldt = time.Now()
+	}
+}
+
+// lfuLogIncr increments the counter with a probability that gets lower
+// the higher the counter already is.
+func (c *Cache) lfuLogIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return counter
+	}
+	baseval := float64(counter) - lfuInitVal
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*float64(c.lfuLogFactor) + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+// lfuDecr returns the counter decremented by one for every decay period
+// elapsed since the entry was last accessed.
+func (c *Cache) lfuDecr(kv *entry) uint8 {
+	if c.lfuDecayTime == 0 {
+		return kv.freq
+	}
+	periods := int(time.Since(kv.ldt) / (time.Minute * time.Duration(c.lfuDecayTime)))
+	if periods >= int(kv.freq) {
+		return 0
+	}
+	return kv.freq - uint8(periods)
+}
+
+// setExpire updates the deadline of an entry and keeps the volatile
+// index in sync with it.
+func (c *Cache) setExpire(e *list.Element, expire time.Time) {
+	kv := e.Value.(*entry)
+	if expire == nilTime && kv.vpos >= 0 {
+		last := c.volatile[len(c.volatile)-1]
+		c.volatile[kv.vpos] = last
+		last.Value.(*entry).vpos = kv.vpos
+		c.volatile = c.volatile[:len(c.volatile)-1]
+		kv.vpos = -1
+	} else if expire != nilTime && kv.vpos < 0 {
+		kv.vpos = len(c.volatile)
+		c.volatile = append(c.volatile, e)
+	}
+	kv.expire = expire
+}
+
+// freeMemory evicts entries according to the eviction policy until the
+// caches of the group fit in their size limit. oomError is returned if the
+// policy does not allow to free enough memory.
+func (c *Cache) freeMemory() error {
+	if c.mem.passive {
+		return nil
+	}
+	for c.mem.limit != 0 && c.mem.used() > c.mem.limit {
+		if !c.evict() {
+			return oomError
+		}
+	}
+	return nil
+}
+
+// evict removes the entry of the group the eviction policy of c picks and
+// reports whether there was anything it was allowed to remove.
+func (c *Cache) evict() bool {
+	var from *Cache
+	var ele *list.Element
+	switch c.policy {
+	case NoEviction:
+	case AllKeysRandom, VolatileRandom:
+		from, ele = c.mem.random(c.policy == VolatileRandom)
+	default:
+		for _, o := range c.mem.caches {
+			if e := c.victim(o); e != nil && (ele == nil || c.evictsFirst(e, ele)) {
+				from, ele = o, e
+			}
+		}
+	}
+	if ele == nil {
+		return false
+	}
+	from.removeElement(ele)
+	from.notify("evicted", ele.Value.(*entry).key)
+	return true
+}
+
+// victim returns the entry of o the eviction policy of c picks, nil if
+// there is none it may remove.
+func (c *Cache) victim(o *Cache) (ele *list.Element) {
+	switch c.policy {
+	case AllKeysLRU:
+		return o.ll.Back()
+	case VolatileLRU:
+		for e := o.ll.Back(); e != nil; e = e.Prev() {
+			if e.Value.(*entry).vpos >= 0 {
+				return e
+			}
+		}
+		return nil
+	}
+	pool := o.volatile
+	if c.policy == AllKeysLFU {
+		pool = o.array
+	}
+	for _, e := range sample(pool) {
+		if ele == nil || c.evictsFirst(e, ele) {
+			ele = e
+		}
+	}
+	return
+}
+
+// evictsFirst tells whether the eviction policy of c removes a before b
+func (c *Cache) evictsFirst(a, b *list.Element) bool {
+	x, y := a.Value.(*entry), b.Value.(*entry)
+	switch c.policy {
+	case VolatileTTL:
+		return x.expire.Before(y.expire)
+	case AllKeysLFU, VolatileLFU:
+		return c.lfuDecr(x) < c.lfuDecr(y)
+	}
+	return x.atime.Before(y.atime)
+}
+
+// random returns an entry picked uniformly from the caches, among those
+// with an expire set if volatile is set.
+func (m *memory) random(volatile bool) (*Cache, *list.Element) {
+	pools := make([][]*list.Element, len(m.caches))
+	total := 0
+	for i, c := range m.caches {
+		pools[i] = c.array
+		if volatile {
+			pools[i] = c.volatile
+		}
+		total += len(pools[i])
+	}
+	if total == 0 {
+		return nil, nil
+	}
+	n := rand.Intn(total)
+	for i, pool := range pools {
+		if n < len(pool) {
+			return m.caches[i], pool[n]
+		}
+		n -= len(pool)
+	}
+	return nil, nil
+}
+
+// sample picks evictionSamples distinct random entries of pool, or all
+// of them if the pool is not larger than that.
+func sample(pool []*list.Element) []*list.Element {
+	if len(pool) <= evictionSamples {
+		return pool
+	}
+	samples := make([]*list.Element, 0, evictionSamples)
+	picked := make(map[int]bool, evictionSamples)
+	for len(samples) < evictionSamples {
+		if i := rand.Intn(len(pool)); !picked[i] {
+			picked[i] = true
+			samples = append(samples, pool[i])
+		}
+	}
+	return samples
+}
+
+// expireElement removes an entry whose expire has passed, unless the
+// caches are passive
+func (c *Cache) expireElement(e *list.Element) {
+	if c.mem.passive {
+		return
+	}
+	c.removeElement(e)
+	c.notify("expired", e.Value.(*entry).key)
+}
+
+func (c *Cache) removeElement(e *list.Element) {
+	c.detach(e)
+	kv := e.Value.(*entry)
+	c.size -= len(kv.key) + valueSize(kv.value)
+}
+
+// detach unlinks an entry from the cache without updating its size
+func (c *Cache) detach(e *list.Element) {
+	c.ll.Remove(e)
+	kv := e.Value.(*entry)
+	c.setExpire(e, nilTime)
+	delete(c.cache, kv.key)
+	// move the last one to the deleted position
+	// update position
+	// shrink size by 1
+	c.array[kv.pos] = c.array[len(c.array)-1]
+	c.array[len(c.array)-1].Value.(*entry).pos = kv.pos
+	c.array = c.array[:len(c.array)-1]
+}
+
+// valueLen returns the number of elements of a collection, 1 for strings
+func valueLen(value interface{}) int {
+	switch v := value.(type) {
+	case map[string][]byte:
+		return len(v)
+	case *list.List:
+		return v.Len()
+	case map[string]struct{}:
+		return len(v)
+	case *zset:
+		return len(v.dict)
+	}
+	return 1
+}
+
+// estimateSize estimates valueSize from the first lazyFreeThreshold
+// elements of a collection
+func estimateSize(value interface{}) (size int) {
+	n := 0
+	switch v := value.(type) {
+	case map[string][]byte:
+		for vk, vv := range v {
+			if n == lazyFreeThreshold {
+				break
+			}
+			size += len(vk) + len(vv)
+			n++
+		}
+	case *list.List:
+		for e := v.Front(); e != nil && n < lazyFreeThreshold; e = e.Next() {
+			size += len(e.Value.([]byte))
+			n++
+		}
+	case map[string]struct{}:
+		for m := range v {
+			if n == lazyFreeThreshold {
+				break
+			}
+			size += len(m)
+			n++
+		}
+	case *zset:
+		for m := range v.dict {
+			if n == lazyFreeThreshold {
+				break
+			}
+			size += len(m) + 8
+			n++
+		}
+	default:
+		return valueSize(value)
+	}
+	if n == 0 {
+		return 0
+	}
+	return size * valueLen(value) / n
+}
+
+// valueSize returns what a value counts for in the size of the cache
+func valueSize(value interface{}) (size int) {
+	switch v := value.(type) {
+	case []byte:
+		size = len(v)
+	case map[string][]byte:
+		for vk, vv := range v {
+			size += len(vk) + len(vv)
+		}
+	case *list.List:
+		for e := v.Front(); e != nil; e = e.Next() {
+			size += len(e.Value.([]byte))
+		}
+	case map[string]struct{}:
+		for m := range v {
+			size += len(m)
+		}
+	case *zset:
+		for m := range v.dict {
+			size += len(m) + 8
+		}
+	}
+	return
+}
+
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = 0
+	c.epoch++
+	c.absentVersion = nextVersion()
+	c.ll = list.New()
+	c.cache = make(map[string]*list.Element)
+	c.array = make([]*list.Element, 0)
+	c.volatile = make([]*list.Element, 0)
+}
+
+func (c *Cache) Stop() {
+	close(c.quit)
+}
+
+func (c *Cache) GetSize() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// GetSizeLimit returns the size limit of the group of c
+func (c *Cache) GetSizeLimit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mem.limit
+}
+
+// SetSizeLimit sets the size limit of the group of c
+func (c *Cache) SetSizeLimit(sizeLimit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mem.limit = sizeLimit
+}
+
+// SetPassive stops the caches of the group of c from removing entries on
+// their own, as replicas leave it to their master: entries past their
+// expire are kept, though treated as missing, and the size limit is not
+// enforced.
+func (c *Cache) SetPassive(passive bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mem.passive = passive
+}
+
+// ShowExpired makes passive caches of the group of c treat the entries
+// past their expire they keep as existing, as the writes of the master
+// must until it deletes them.
+func (c *Cache) ShowExpired(show bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.mem.showExpired = show
+}
+
+// UsedMemory returns the size of the caches of the group of c
+func (c *Cache) UsedMemory() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.mem.used()
+}
+
+// FreeMemory evicts entries of the group of c until it is within the
+// limit, it returns oomError if the policy does not allow it
+func (c *Cache) FreeMemory() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.freeMemory()
+}
+
+func (c *Cache) GetPolicy() EvictionPolicy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.policy
+}
+
+func (c *Cache) SetPolicy(policy EvictionPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.policy = policy
+}
+
+func (c *Cache) GetLFULogFactor() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lfuLogFactor
+}
+
+func (c *Cache) SetLFULogFactor(factor int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lfuLogFactor = factor
+}
+
+func (c *Cache) GetLFUDecayTime() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lfuDecayTime
+}
+
+// decay: minutes, 0 disables decaying
+func (c *Cache) SetLFUDecayTime(decay int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lfuDecayTime = decay
+}
+
+// ActiveExpire removes entries that have expired without being accessed
+func (c *Cache) ActiveExpire() {
+	c.gc()
 }
 
 // test 20 random entries and delete those have expired
 // if more than 25% were expired, repeat
 func (c *Cache) gc() {
 	c.mu.Lock()
+	if c.mem.passive {
+		c.mu.Unlock()
+		return
+	}
 
 	total := 0
 	expired := make([]*list.Element, 0, 20)
@@ -385,13 +3325,13 @@ func (c *Cache) gc() {
 		if i >= 20 {
 			break
 		}
-		if kv := c.array[x].Value.(*entry); kv.hasExpired() {
+		if kv := c.array[x].Value.(*entry); c.expired(kv) {
 			expired = append(expired, c.array[x])
 		}
 		total++
 	}
 	for _, i := range expired {
-		c.removeElement(i)
+		c.expireElement(i)
 	}
 
 	c.mu.Unlock()
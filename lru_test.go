@@ -2,6 +2,11 @@ package toyredis
 
 import (
 	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -136,3 +141,821 @@ func TestExpire(t *testing.T) {
 
 	lru.Stop()
 }
+
+func TestEvictionPolicy(t *testing.T) {
+	lru := NewCache(50)
+	lru.SetPolicy(NoEviction)
+	for i := 0; i < 6; i++ {
+		lru.Set(fmt.Sprintf("%d", i), []byte("123456789"))
+	}
+	if err := lru.Set("6", []byte("123456789")); err != oomError {
+		t.Fatalf("expected OOM error, got %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if val, _ := lru.Get(fmt.Sprintf("%d", i)); val == nil {
+			t.Fatalf("%d should be present.", i)
+		}
+	}
+	lru.Stop()
+
+	lru = NewCache(50)
+	lru.SetPolicy(VolatileLRU)
+	for i := 0; i < 5; i++ {
+		lru.Set(fmt.Sprintf("%d", i), []byte("123456789"))
+	}
+	lru.Expire("3", 10000)
+	lru.Set("5", []byte("123456789"))
+	if val, _ := lru.Get("3"); val != nil {
+		t.Fatal("3 should have been evicted.")
+	}
+	if val, _ := lru.Get("0"); val == nil {
+		t.Fatal("0 should be present.")
+	}
+	if err := lru.Set("6", []byte("123456789")); err != nil {
+		t.Fatalf("first write over the limit should succeed, got %v", err)
+	}
+	if err := lru.Set("7", []byte("123456789")); err != oomError {
+		t.Fatalf("expected OOM error without volatile keys, got %v", err)
+	}
+	lru.Stop()
+
+	lru = NewCache(50)
+	lru.SetPolicy(VolatileTTL)
+	for i := 0; i < 5; i++ {
+		lru.Set(fmt.Sprintf("%d", i), []byte("123456789"))
+		lru.Expire(fmt.Sprintf("%d", i), 10000*(i+1))
+	}
+	lru.Set("5", []byte("123456789"))
+	if val, _ := lru.Get("0"); val != nil {
+		t.Fatal("0 should have been evicted.")
+	}
+	lru.Stop()
+
+	lru = NewCache(50)
+	lru.SetPolicy(AllKeysRandom)
+	for i := 10; i < 30; i++ {
+		lru.Set(fmt.Sprintf("%d", i), []byte("12345678"))
+	}
+	if lru.GetSize() > 50 || len(lru.array) != 5 {
+		t.Fatalf("expected 5 entries, got %d", len(lru.array))
+	}
+	lru.Stop()
+}
+
+func TestLFU(t *testing.T) {
+	lru := NewCache(40)
+	if _, _, err := lru.Freq("0"); err != noLFU {
+		t.Fatalf("expected error without LFU policy, got %v", err)
+	}
+	lru.SetPolicy(AllKeysLFU)
+	for i := 0; i < 3; i++ {
+		lru.Set(fmt.Sprintf("%d", i), []byte("123456789"))
+		for j := 0; j < 100; j++ {
+			lru.Get(fmt.Sprintf("%d", i))
+		}
+	}
+	freq, exists, _ := lru.Freq("0")
+	if !exists || freq <= lfuInitVal {
+		t.Fatalf("frequency should have grown, got %d", freq)
+	}
+	if _, exists, _ := lru.Freq("none"); exists {
+		t.Fatal("none should not exist.")
+	}
+
+	// a scan over cold keys must not push out the hot ones
+	for i := 10; i < 30; i++ {
+		lru.Set(fmt.Sprintf("%d", i), []byte("12345678"))
+	}
+	for i := 0; i < 3; i++ {
+		if _, exists, _ := lru.Freq(fmt.Sprintf("%d", i)); !exists {
+			t.Fatalf("%d should be present.", i)
+		}
+	}
+
+	kv := lru.cache["0"].Value.(*entry)
+	kv.ldt = kv.ldt.Add(-3 * time.Minute)
+	if decayed, _, _ := lru.Freq("0"); decayed != freq-3 {
+		t.Fatalf("expected %d after decay, got %d", freq-3, decayed)
+	}
+	lru.Stop()
+}
+
+func TestList(t *testing.T) {
+	lru := NewCache(MB)
+	toStrings := func(bs [][]byte) string {
+		ss := make([]string, len(bs))
+		for i, b := range bs {
+			ss[i] = string(b)
+		}
+		return fmt.Sprint(ss)
+	}
+
+	lru.RPush("l", [][]byte{[]byte("b"), []byte("c")})
+	n, _ := lru.LPush("l", [][]byte{[]byte("a")})
+	if n != 3 {
+		t.Fatalf("expected length 3, got %d", n)
+	}
+	if size := lru.GetSize(); size != 4 {
+		t.Fatalf("expected size 4, got %d", size)
+	}
+	if val, _ := lru.LRange("l", 0, -1); toStrings(val) != "[a b c]" {
+		t.Fatalf("LRange failed, got %s", toStrings(val))
+	}
+	if val, _ := lru.LRange("l", -2, 10); toStrings(val) != "[b c]" {
+		t.Fatalf("LRange failed, got %s", toStrings(val))
+	}
+	if val, _ := lru.LIndex("l", -1); string(val) != "c" {
+		t.Fatalf("LIndex failed, got %s", val)
+	}
+	if err := lru.LSet("l", 5, []byte("x")); err != indexOutOfRange {
+		t.Fatalf("expected out of range, got %v", err)
+	}
+	lru.LInsert("l", false, []byte("a"), []byte("b"))
+	lru.RPush("l", [][]byte{[]byte("b")})
+	if num, _ := lru.LRem("l", -2, []byte("b")); num != 2 {
+		t.Fatalf("LRem failed, got %d", num)
+	}
+	if val, _ := lru.LRange("l", 0, -1); toStrings(val) != "[a b c]" {
+		t.Fatalf("LRem failed, got %s", toStrings(val))
+	}
+	lru.LTrim("l", 1, 1)
+	if val, _ := lru.LRange("l", 0, -1); toStrings(val) != "[b]" {
+		t.Fatalf("LTrim failed, got %s", toStrings(val))
+	}
+	if _, err := lru.Get("l"); err != wrongType {
+		t.Fatal("Get on a list should fail.")
+	}
+	if err := lru.HSet("l", "k", []byte("v")); err != wrongType {
+		t.Fatal("HSet on a list should fail.")
+	}
+
+	val, _ := lru.RPop("l", 5)
+	if toStrings(val) != "[b]" {
+		t.Fatalf("RPop failed, got %s", toStrings(val))
+	}
+	if lru.Exists("l") != 0 || lru.GetSize() != 0 {
+		t.Fatal("empty list should have been removed.")
+	}
+	if val, _ := lru.LPop("l", 1); val != nil {
+		t.Fatal("LPop on missing key should return nil.")
+	}
+	lru.Stop()
+}
+
+func TestSet(t *testing.T) {
+	lru := NewCache(MB)
+	members := func(bs [][]byte) string {
+		ss := make([]string, len(bs))
+		for i, b := range bs {
+			ss[i] = string(b)
+		}
+		sort.Strings(ss)
+		return fmt.Sprint(ss)
+	}
+
+	if num, _ := lru.SAdd("s1", []string{"a", "b", "c", "a"}); num != 3 {
+		t.Fatalf("SAdd failed, got %d", num)
+	}
+	lru.SAdd("s2", []string{"b", "c", "d"})
+	if size := lru.GetSize(); size != 10 {
+		t.Fatalf("expected size 10, got %d", size)
+	}
+	if val, _ := lru.SInter([]string{"s1", "s2"}); members(val) != "[b c]" {
+		t.Fatalf("SInter failed, got %s", members(val))
+	}
+	if val, _ := lru.SUnion([]string{"s1", "s2", "none"}); members(val) != "[a b c d]" {
+		t.Fatalf("SUnion failed, got %s", members(val))
+	}
+	if val, _ := lru.SDiff([]string{"s1", "s2"}); members(val) != "[a]" {
+		t.Fatalf("SDiff failed, got %s", members(val))
+	}
+	if val, _ := lru.SInter([]string{"s1", "none"}); len(val) != 0 {
+		t.Fatalf("SInter with a missing key should be empty, got %s", members(val))
+	}
+	if num, _ := lru.SDiffStore("s3", []string{"s2", "s1"}); num != 1 {
+		t.Fatalf("SDiffStore failed, got %d", num)
+	}
+	if num, _ := lru.SMove("s3", "s1", "d"); num != 1 {
+		t.Fatalf("SMove failed, got %d", num)
+	}
+	if lru.Exists("s3") != 0 {
+		t.Fatal("s3 should have been removed.")
+	}
+	if nums, _ := lru.SMIsMember("s1", []string{"d", "e"}); fmt.Sprint(nums) != "[1 0]" {
+		t.Fatalf("SMIsMember failed, got %v", nums)
+	}
+	if val, _ := lru.SRandMember("s1", -10); len(val) != 10 {
+		t.Fatalf("SRandMember should repeat members, got %d", len(val))
+	}
+	if val, _ := lru.SRandMember("s1", 10); members(val) != "[a b c d]" {
+		t.Fatalf("SRandMember failed, got %s", members(val))
+	}
+	lru.Set("str", []byte("x"))
+	if _, err := lru.SAdd("str", []string{"a"}); err != wrongType {
+		t.Fatal("SAdd on a string should fail.")
+	}
+	if _, err := lru.SUnion([]string{"s1", "str"}); err != wrongType {
+		t.Fatal("SUnion with a string should fail.")
+	}
+
+	val, _ := lru.SPop("s1", 10)
+	if members(val) != "[a b c d]" || lru.Exists("s1") != 0 {
+		t.Fatalf("SPop failed, got %s", members(val))
+	}
+	lru.SRem("s2", []string{"b", "c", "d"})
+	lru.Remove([]string{"str"})
+	if lru.GetSize() != 0 {
+		t.Fatalf("expected size 0, got %d", lru.GetSize())
+	}
+	lru.Stop()
+}
+
+func TestSkiplist(t *testing.T) {
+	zsl := newSkiplist()
+	scores := make(map[string]float64)
+	for i := 0; i < 1000; i++ {
+		m := fmt.Sprintf("m%d", rand.Intn(500))
+		if score, ok := scores[m]; ok {
+			if !zsl.delete(score, m) {
+				t.Fatalf("%s should have been deleted", m)
+			}
+			delete(scores, m)
+		} else {
+			scores[m] = float64(rand.Intn(50))
+			zsl.insert(scores[m], m)
+		}
+	}
+
+	sorted := make([]ZMember, 0, len(scores))
+	for m, score := range scores {
+		sorted = append(sorted, ZMember{m, score})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Score < sorted[j].Score ||
+			(sorted[i].Score == sorted[j].Score && sorted[i].Member < sorted[j].Member)
+	})
+	if zsl.length != len(sorted) {
+		t.Fatalf("expected length %d, got %d", len(sorted), zsl.length)
+	}
+	for i, m := range sorted {
+		if rank := zsl.rank(m.Score, m.Member); rank != i+1 {
+			t.Fatalf("expected rank %d for %s, got %d", i+1, m.Member, rank)
+		}
+		if x := zsl.byRank(i + 1); x.member != m.Member {
+			t.Fatalf("expected %s at rank %d, got %s", m.Member, i+1, x.member)
+		}
+	}
+	if zsl.tail.member != sorted[len(sorted)-1].Member {
+		t.Fatal("wrong tail")
+	}
+}
+
+func TestSortedSet(t *testing.T) {
+	lru := NewCache(MB)
+	names := func(ms []ZMember) string {
+		ss := make([]string, len(ms))
+		for i, m := range ms {
+			ss[i] = m.Member
+		}
+		return fmt.Sprint(ss)
+	}
+
+	lru.ZAdd("z", ZAddOptions{}, []ZMember{{"a", 1}, {"b", 2}, {"c", 3}, {"d", 4}})
+	if num, _ := lru.ZAdd("z", ZAddOptions{GT: true, CH: true}, []ZMember{{"a", 5}, {"b", 0}, {"e", 6}}); num != 2 {
+		t.Fatalf("ZAdd GT CH failed, got %d", num)
+	}
+	if val, _ := lru.ZRange("z", 0, -1, false); names(val) != "[b c d a e]" {
+		t.Fatalf("ZRange failed, got %s", names(val))
+	}
+	if val, _ := lru.ZRange("z", 0, 1, true); names(val) != "[e a]" {
+		t.Fatalf("ZRange REV failed, got %s", names(val))
+	}
+	if rank, _, _ := lru.ZRank("z", "d", false); rank != 2 {
+		t.Fatalf("ZRank failed, got %d", rank)
+	}
+	r, _ := ParseScoreRange("(2", "+inf")
+	if num, _ := lru.ZCount("z", r); num != 4 {
+		t.Fatalf("ZCount failed, got %d", num)
+	}
+	if val, _ := lru.ZRangeByScore("z", r, true, 1, 2); names(val) != "[a d]" {
+		t.Fatalf("ZRangeByScore failed, got %s", names(val))
+	}
+	if score, ok, _ := lru.ZIncrBy("z", ZAddOptions{}, 1.5, "c"); !ok || score != 4.5 {
+		t.Fatalf("ZIncrBy failed, got %v", score)
+	}
+	if _, ok, _ := lru.ZIncrBy("z", ZAddOptions{LT: true}, 1, "c"); ok {
+		t.Fatal("ZIncrBy LT should not have updated c")
+	}
+
+	lru.ZAdd("lex", ZAddOptions{}, []ZMember{{"a", 0}, {"b", 0}, {"c", 0}, {"d", 0}})
+	lr, _ := ParseLexRange("(a", "[c")
+	if val, _ := lru.ZRangeByLex("lex", lr, false, 0, -1); names(val) != "[b c]" {
+		t.Fatalf("ZRangeByLex failed, got %s", names(val))
+	}
+	lr, _ = ParseLexRange("-", "+")
+	if val, _ := lru.ZRangeByLex("lex", lr, true, 0, 2); names(val) != "[d c]" {
+		t.Fatalf("ZRangeByLex REV failed, got %s", names(val))
+	}
+
+	lru.SAdd("s", []string{"a", "x"})
+	if num, _ := lru.ZInterStore("out", []string{"z", "s"}, []float64{2, 10}, AggregateSum); num != 1 {
+		t.Fatalf("ZInterStore failed, got %d", num)
+	}
+	if score, _, _ := lru.ZScore("out", "a"); score != 20 {
+		t.Fatalf("expected 2*5+10, got %v", score)
+	}
+	if num, _ := lru.ZUnionStore("out", []string{"lex", "s"}, nil, AggregateMax); num != 5 {
+		t.Fatalf("ZUnionStore failed, got %d", num)
+	}
+
+	if val, _ := lru.ZPopMin("z", 2); names(val) != "[b d]" {
+		t.Fatalf("ZPopMin failed, got %s", names(val))
+	}
+	if val, _ := lru.ZPopMax("z", 10); names(val) != "[e a c]" {
+		t.Fatalf("ZPopMax failed, got %s", names(val))
+	}
+	if lru.Exists("z") != 0 {
+		t.Fatal("empty sorted set should have been removed.")
+	}
+	lru.Remove([]string{"lex", "s", "out"})
+	if lru.GetSize() != 0 {
+		t.Fatalf("expected size 0, got %d", lru.GetSize())
+	}
+	lru.Stop()
+}
+
+func TestIncr(t *testing.T) {
+	lru := NewCache(MB)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			for j := 0; j < 100; j++ {
+				lru.IncrBy("n", 1)
+				lru.HIncrBy("h", "f", 2)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if val, _ := lru.Get("n"); string(val) != "1000" {
+		t.Fatalf("expected 1000, got %s", val)
+	}
+	if val, _ := lru.HGet("h", "f"); string(val) != "2000" {
+		t.Fatalf("expected 2000, got %s", val)
+	}
+
+	lru.Expire("n", 10000)
+	lru.IncrBy("n", -1000)
+	if kv := lru.cache["n"].Value.(*entry); kv.expire == nilTime || string(kv.value.([]byte)) != "0" {
+		t.Fatal("IncrBy should keep the expire.")
+	}
+	lru.Set("n", []byte("9223372036854775807"))
+	if _, err := lru.IncrBy("n", 1); err != overflowError {
+		t.Fatalf("expected overflow, got %v", err)
+	}
+	lru.Set("s", []byte("abc"))
+	if _, err := lru.IncrBy("s", 1); err != notIntError {
+		t.Fatalf("expected not an integer, got %v", err)
+	}
+	if f, _ := lru.IncrByFloat("f", 10.5); f != 10.5 {
+		t.Fatalf("expected 10.5, got %v", f)
+	}
+	if f, _ := lru.IncrByFloat("f", 5e3); f != 5010.5 {
+		t.Fatalf("expected 5010.5, got %v", f)
+	}
+	if val, _ := lru.Get("f"); string(val) != "5010.5" {
+		t.Fatalf("expected 5010.5, got %s", val)
+	}
+	if f, _ := lru.HIncrByFloat("h", "f", -0.5); f != 1999.5 {
+		t.Fatalf("expected 1999.5, got %v", f)
+	}
+	if _, err := lru.HIncrBy("h", "f", 1); err != hashNotIntError {
+		t.Fatalf("expected hash value is not an integer, got %v", err)
+	}
+	lru.Stop()
+}
+
+func TestSetOptions(t *testing.T) {
+	lru := NewCache(MB)
+
+	if _, ok, _ := lru.SetWithOptions("k", []byte("v1"), SetOptions{XX: true}); ok {
+		t.Fatal("XX should not create a key.")
+	}
+	if _, ok, _ := lru.SetWithOptions("k", []byte("v1"), SetOptions{NX: true}); !ok {
+		t.Fatal("NX should create a key.")
+	}
+	if _, ok, _ := lru.SetWithOptions("k", []byte("v2"), SetOptions{NX: true}); ok {
+		t.Fatal("NX should not overwrite a key.")
+	}
+	expire := time.Now().Add(time.Hour)
+	old, ok, _ := lru.SetWithOptions("k", []byte("v3"), SetOptions{XX: true, Get: true, Expire: expire})
+	if !ok || string(old) != "v1" {
+		t.Fatalf("expected v1, got %s", old)
+	}
+	lru.SetWithOptions("k", []byte("v4"), SetOptions{KeepTTL: true})
+	if kv := lru.cache["k"].Value.(*entry); kv.expire != expire {
+		t.Fatal("KeepTTL should keep the expire.")
+	}
+	lru.Set("k", []byte("v5"))
+	if kv := lru.cache["k"].Value.(*entry); kv.expire != nilTime {
+		t.Fatal("Set should clear the expire.")
+	}
+
+	lru.HSet("h", "f", []byte("v"))
+	if _, _, err := lru.SetWithOptions("h", []byte("v"), SetOptions{Get: true}); err != wrongType {
+		t.Fatal("Get on a hash should fail.")
+	}
+	lru.Set("h", []byte("v"))
+	if val, _ := lru.Get("h"); string(val) != "v" {
+		t.Fatal("Set should overwrite a hash.")
+	}
+	if size := lru.GetSize(); size != 5 {
+		t.Fatalf("expected size 5, got %d", size)
+	}
+
+	if val, _ := lru.GetEx("k", time.Now().Add(-time.Second), false); string(val) != "v5" {
+		t.Fatalf("expected v5, got %s", val)
+	}
+	if val, _ := lru.Get("k"); val != nil {
+		t.Fatal("k should have expired.")
+	}
+	if val, _ := lru.GetDel("h"); string(val) != "v" || lru.Exists("h") != 0 {
+		t.Fatal("GetDel failed.")
+	}
+	lru.Stop()
+}
+
+func TestExpireAt(t *testing.T) {
+	lru := NewCache(MB)
+	lru.Set("k", []byte("v"))
+
+	hour := time.Now().Add(time.Hour)
+	if lru.ExpireAt("k", hour, ExpireOptions{GT: true}) != 0 {
+		t.Fatal("GT should fail on a key without expire.")
+	}
+	if lru.ExpireAt("k", hour, ExpireOptions{XX: true}) != 0 {
+		t.Fatal("XX should fail on a key without expire.")
+	}
+	if lru.ExpireAt("k", hour, ExpireOptions{LT: true}) != 1 {
+		t.Fatal("LT should succeed on a key without expire.")
+	}
+	if lru.ExpireAt("k", hour.Add(time.Hour), ExpireOptions{NX: true}) != 0 {
+		t.Fatal("NX should fail on a key with expire.")
+	}
+	if lru.ExpireAt("k", hour.Add(-time.Minute), ExpireOptions{GT: true}) != 0 {
+		t.Fatal("GT should fail with an earlier expire.")
+	}
+	if expire, exists := lru.ExpireTime("k"); !exists || expire != hour {
+		t.Fatal("ExpireTime failed.")
+	}
+	if lru.Persist("k") != 1 || lru.Persist("k") != 0 {
+		t.Fatal("Persist failed.")
+	}
+	if expire, _ := lru.ExpireTime("k"); expire != nilTime {
+		t.Fatal("Persist should remove the expire.")
+	}
+	if _, exists := lru.ExpireTime("none"); exists {
+		t.Fatal("none should not exist.")
+	}
+
+	if lru.Expire("k", -1) != 1 || lru.Exists("k") != 0 {
+		t.Fatal("a negative ttl should delete the key.")
+	}
+	if len(lru.volatile) != 0 || lru.GetSize() != 0 {
+		t.Fatal("deleted key should not be accounted for.")
+	}
+	lru.Stop()
+}
+
+func TestScan(t *testing.T) {
+	lru := NewCache(MB)
+	for i := 0; i < 1000; i++ {
+		lru.Set(fmt.Sprintf("key:%d", i), []byte("v"))
+	}
+	lru.SAdd("set", []string{"a"})
+
+	// keys below 500 stay for the whole iteration, the others are removed
+	// while new ones get added
+	seen := make(map[string]bool)
+	cursor, removed := 0, 500
+	for {
+		next, keys := lru.Scan(cursor, 10, "key:*", "string")
+		for _, k := range keys {
+			seen[k] = true
+		}
+		if removed < 1000 {
+			lru.Remove([]string{fmt.Sprintf("key:%d", removed)})
+			lru.Set(fmt.Sprintf("new:%d", removed), []byte("v"))
+			removed++
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	for i := 0; i < 500; i++ {
+		if !seen[fmt.Sprintf("key:%d", i)] {
+			t.Fatalf("key:%d was not returned", i)
+		}
+	}
+	if seen["set"] || seen["new:500"] {
+		t.Fatal("scan should only return matching strings.")
+	}
+
+	if keys := lru.Keys("key:1?"); len(keys) != 10 {
+		t.Fatalf("expected 10 keys, got %d", len(keys))
+	}
+	lru.ZAdd("z", ZAddOptions{}, []ZMember{{"a1", 1}, {"b1", 2}, {"a2", 3}})
+	if members, _ := lru.ZScan("z", "a*"); len(members) != 2 || members[1].Member != "a2" {
+		t.Fatalf("ZScan failed, got %v", members)
+	}
+	lru.Stop()
+}
+
+func TestKeyCommands(t *testing.T) {
+	lru := NewCache(MB)
+	lru.Set("foo", []byte("bar"))
+	lru.Expire("foo", 10000)
+	lru.SAdd("set", []string{"a", "b"})
+
+	if typ := lru.Type("set"); typ != "set" {
+		t.Fatalf("expected set, got %s", typ)
+	}
+	if _, err := lru.Rename("none", "x", false); err != noSuchKey {
+		t.Fatalf("expected %v, got %v", noSuchKey, err)
+	}
+	if ok, _ := lru.Rename("foo", "set", true); ok {
+		t.Fatal("renamenx should not overwrite.")
+	}
+	lru.Rename("foo", "baz", false)
+	if v, _ := lru.Get("baz"); string(v) != "bar" {
+		t.Fatalf("expected bar, got %s", v)
+	}
+	if _, exists := lru.ExpireTime("baz"); !exists || lru.Type("foo") != "none" {
+		t.Fatal("rename should keep the ttl and remove the source.")
+	}
+
+	if num, _ := lru.Copy("set", "set2", false); num != 1 {
+		t.Fatal("copy failed.")
+	}
+	lru.SAdd("set2", []string{"c"})
+	if n, _ := lru.SCard("set"); n != 2 {
+		t.Fatal("copy should not share the value.")
+	}
+	if num, _ := lru.Copy("set", "set2", false); num != 0 {
+		t.Fatal("copy should not overwrite without replace.")
+	}
+
+	if n := lru.DBSize(); n != 3 {
+		t.Fatalf("expected 3 keys, got %d", n)
+	}
+	if key, ok := lru.RandomKey(); !ok || lru.Type(key) == "none" {
+		t.Fatalf("bad random key %s", key)
+	}
+	if n := lru.Touch([]string{"baz", "none"}); n != 1 {
+		t.Fatalf("expected 1, got %d", n)
+	}
+	lru.Stop()
+
+	// the values of unlinked keys are walked once the lock is released
+	var releases []func()
+	defer func(f func(func())) { lazyFree = f }(lazyFree)
+	lazyFree = func(release func()) { releases = append(releases, release) }
+
+	lru = NewCache(MB)
+	members := make([]string, 1000)
+	for i := range members {
+		members[i] = fmt.Sprint(i)
+	}
+	lru.SAdd("big", members)
+	for i := 0; i < 1000; i++ {
+		lru.HSet("hash", fmt.Sprint(i), []byte(strings.Repeat("x", 10+i%10)))
+	}
+	used := lru.GetSize()
+	if n := lru.Unlink([]string{"big", "hash", "none"}); n != 2 || len(releases) != 2 {
+		t.Fatalf("expected 2 keys released later, got %d, %d", n, len(releases))
+	}
+	// estimated at once
+	if size := lru.GetSize(); size > used/4 || size < -used/4 {
+		t.Fatalf("size should be about 0 after unlink, got %d", size)
+	}
+	for _, release := range releases {
+		release()
+	}
+	if lru.GetSize() != 0 {
+		t.Fatalf("size should be 0 once released, got %d", lru.GetSize())
+	}
+	// sizes reset since are not corrected
+	lru.HSet("hash", "a", []byte(strings.Repeat("x", 100)))
+	for i := 0; i < 100; i++ {
+		lru.HSet("hash", fmt.Sprint(i), []byte("x"))
+	}
+	lru.Unlink([]string{"hash"})
+	lru.Flush()
+	releases[2]()
+	if lru.GetSize() != 0 {
+		t.Fatalf("size should be 0 after flush, got %d", lru.GetSize())
+	}
+	if _, err := lru.Copy("foo", "foo", true); err != sameObject {
+		t.Fatalf("expected %v, got %v", sameObject, err)
+	}
+	lru.Stop()
+}
+
+func TestMove(t *testing.T) {
+	db0, db1 := NewCache(MB), NewCache(MB)
+	db0.Set("foo", []byte("bar"))
+	db0.Expire("foo", 10000)
+	db1.Set("baz", []byte("1"))
+	db0.Set("baz", []byte("0"))
+
+	if ok, _ := db0.Move("foo", db1); !ok {
+		t.Fatal("move failed.")
+	}
+	if db0.Exists("foo") != 0 || db0.GetSize() != 4 {
+		t.Fatalf("foo should be removed from the source, size %d", db0.GetSize())
+	}
+	if _, exists := db1.ExpireTime("foo"); !exists || db1.ExpiresCount() != 1 {
+		t.Fatal("move should keep the ttl.")
+	}
+	if ok, _ := db0.Move("baz", db1); ok {
+		t.Fatal("move should not overwrite.")
+	}
+	if _, err := db0.Move("baz", db0); err != sameObject {
+		t.Fatalf("expected %v, got %v", sameObject, err)
+	}
+
+	// moves in opposite directions do not deadlock
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, dbs := range [][2]*Cache{{db0, db1}, {db1, db0}} {
+		wg.Add(1)
+		go func(src, dst *Cache) {
+			defer wg.Done()
+			<-start
+			for i := 0; i < 100000; i++ {
+				src.Move("foo", dst)
+			}
+		}(dbs[0], dbs[1])
+	}
+	close(start)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("moves deadlocked.")
+	}
+	if db0.Exists("foo")+db1.Exists("foo") != 1 {
+		t.Fatal("foo should be in one of them.")
+	}
+	db0.Stop()
+	db1.Stop()
+}
+
+func TestSharedLimit(t *testing.T) {
+	dbs := NewCaches(3, 50)
+	for _, db := range dbs {
+		db.SetPolicy(NoEviction)
+	}
+	dbs[0].Set("a", []byte("123456789"))
+	dbs[1].Set("b", []byte("123456789"))
+	dbs[2].Set("c", []byte("123456789"))
+	dbs[0].Set("d", []byte("123456789"))
+	dbs[1].Set("e", []byte("123456789"))
+	// over the limit once written
+	dbs[2].Set("f", []byte("123456789"))
+	if err := dbs[0].Set("g", []byte("123456789")); err != oomError {
+		t.Fatalf("expected %v, got %v", oomError, err)
+	}
+	if used := dbs[0].UsedMemory(); used != 60 {
+		t.Fatalf("expected 60, got %d", used)
+	}
+
+	// the least recently used keys of any of them are evicted
+	for _, db := range dbs {
+		db.SetPolicy(AllKeysLRU)
+	}
+	dbs[0].Get("a")
+	dbs[2].Set("g", []byte("123456789"))
+	if dbs[1].Exists("b") != 0 || dbs[2].Exists("c") != 0 || dbs[0].Exists("a") != 1 || dbs[2].Exists("g") != 1 {
+		t.Fatal("b and c should have been evicted.")
+	}
+	if used := dbs[0].UsedMemory(); used > 50 {
+		t.Fatalf("expected at most 50, got %d", used)
+	}
+	if ok, _ := dbs[2].Move("g", dbs[1]); !ok || dbs[1].Exists("g") != 1 {
+		t.Fatal("move failed.")
+	}
+	for _, db := range dbs {
+		db.Stop()
+	}
+}
+
+func TestPassive(t *testing.T) {
+	dbs := NewCaches(2, 20)
+	dbs[0].SetPassive(true)
+	dbs[0].Set("foo", []byte("bar"))
+	dbs[0].ExpireAt("foo", time.Now().Add(10*time.Millisecond), ExpireOptions{})
+	dbs[1].Set("a", []byte("123456789"))
+	dbs[1].Set("b", []byte("123456789"))
+	dbs[1].Set("c", []byte("123456789"))
+	time.Sleep(20 * time.Millisecond)
+	dbs[0].ActiveExpire()
+	// neither expired nor evicted until the master removes them, but
+	// expired keys are only seen by its writes
+	if v, _ := dbs[0].Get("foo"); v != nil || !dbs[0].has("foo") {
+		t.Fatal("foo should be kept and hidden.")
+	}
+	dbs[0].ShowExpired(true)
+	if v, _ := dbs[0].Get("foo"); string(v) != "bar" || dbs[1].Exists("a")+dbs[1].Exists("b")+dbs[1].Exists("c") != 3 {
+		t.Fatal("keys should not have been removed.")
+	}
+	dbs[0].ShowExpired(false)
+
+	dbs[1].SetPassive(false)
+	if v, _ := dbs[0].Get("foo"); v != nil {
+		t.Fatal("foo should have expired.")
+	}
+	dbs[1].Set("d", []byte("123456789"))
+	if used := dbs[0].UsedMemory(); used > 20 {
+		t.Fatalf("expected at most 20, got %d", used)
+	}
+	for _, db := range dbs {
+		db.Stop()
+	}
+}
+
+func TestEvents(t *testing.T) {
+	lru := NewCache(20)
+	var events []string
+	lru.OnEvent(func(e Event) {
+		events = append(events, e.Name+" "+e.Key)
+	})
+	lru.Set("a", []byte("123456789"))
+	lru.Set("b", []byte("123456789"))
+	lru.Set("c", []byte("123456789"))
+	lru.Expire("c", 1)
+	time.Sleep(2 * time.Millisecond)
+	lru.Get("c")
+	lru.RPush("l", [][]byte{[]byte("1")})
+	lru.LPop("l", 1)
+	lru.Rename("b", "d", false)
+	// also waits for a gc in progress
+	lru.OnEvent(nil)
+	lru.Stop()
+
+	want := "set a,set b,set c,evicted a,expire c,expired c,rpush l,lpop l,del l,rename_from b,rename_to d"
+	if s := strings.Join(events, ","); s != want {
+		t.Fatalf("unexpected events %s", s)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	lru := NewCache(100)
+	defer lru.Stop()
+
+	absent := lru.Version("foo")
+	if ok, _ := lru.CompareAndSwap("foo", absent, []byte("1")); !ok {
+		t.Fatal("should set a key that did not change.")
+	}
+	v := lru.Version("foo")
+	if v == absent {
+		t.Fatal("version should change on write.")
+	}
+	lru.Get("foo")
+	if lru.Version("foo") != v {
+		t.Fatal("version should not change on read.")
+	}
+	lru.Set("foo", []byte("2"))
+	if ok, _ := lru.CompareAndSwap("foo", v, []byte("3")); ok {
+		t.Fatal("should not set a key that changed.")
+	}
+	if v, _ := lru.Get("foo"); string(v) != "2" {
+		t.Fatalf("expected 2, got %s", v)
+	}
+
+	// removals change the version of keys that do not exist
+	absent = lru.Version("bar")
+	lru.Set("bar", []byte("1"))
+	lru.Remove([]string{"bar"})
+	if lru.Version("bar") == absent {
+		t.Fatal("version should change when the key is set and removed.")
+	}
+	absent = lru.Version("bar")
+	lru.Flush()
+	if lru.Version("bar") == absent {
+		t.Fatal("version should change on flush.")
+	}
+	lru.Set("foo", []byte("1"))
+	v = lru.Version("foo")
+	lru.Expire("foo", 1)
+	if lru.Version("foo") == v {
+		t.Fatal("version should change on expire.")
+	}
+}
@@ -0,0 +1,134 @@
+package toyredis
+
+import "errors"
+
+// LZF is the compression redis uses for long strings in RDB files, this is
+// a port of liblzf. A compressed stream is a sequence of literal runs,
+// whose control byte is the run length minus 1 (below 32), and back
+// references of 3 bits of length and 13 bits of offset.
+
+const (
+	lzfHashLog   = 14
+	lzfMaxLit    = 1 << 5
+	lzfMaxOffset = 1 << 13
+	lzfMaxRef    = (1 << 8) + (1 << 3)
+)
+
+var lzfCorrupt = errors.New("corrupt lzf data")
+
+// lzfCompress returns the compressed data, or nil if it would not be
+// smaller than in.
+func lzfCompress(in []byte) []byte {
+	htab := make([]int, 1<<lzfHashLog) // positions plus 1
+	out := make([]byte, 0, len(in))
+
+	// index of the control byte of the current literal run
+	lit, ctrl := 0, 0
+	out = append(out, 0)
+	closeLiteral := func() {
+		if lit > 0 {
+			out[ctrl] = byte(lit - 1)
+		} else {
+			out = out[:ctrl]
+		}
+	}
+	openLiteral := func() {
+		lit, ctrl = 0, len(out)
+		out = append(out, 0)
+	}
+
+	ip := 0
+	for ip+2 < len(in) {
+		h := (uint32(in[ip])<<16 | uint32(in[ip+1])<<8 | uint32(in[ip+2])) * 2654435761 >> (32 - lzfHashLog)
+		ref := htab[h] - 1
+		htab[h] = ip + 1
+
+		if off := ip - ref - 1; ref >= 0 && off < lzfMaxOffset &&
+			in[ref] == in[ip] && in[ref+1] == in[ip+1] && in[ref+2] == in[ip+2] {
+			n := 3
+			for n < lzfMaxRef && ip+n < len(in) && in[ref+n] == in[ip+n] {
+				n++
+			}
+			closeLiteral()
+			if l := n - 2; l < 7 {
+				out = append(out, byte(off>>8|l<<5))
+			} else {
+				out = append(out, byte(off>>8|7<<5), byte(l-7))
+			}
+			out = append(out, byte(off))
+			ip += n
+			openLiteral()
+			if len(out) >= len(in) {
+				return nil
+			}
+			continue
+		}
+
+		out = append(out, in[ip])
+		ip++
+		if lit++; lit == lzfMaxLit {
+			closeLiteral()
+			openLiteral()
+		}
+		if len(out) >= len(in) {
+			return nil
+		}
+	}
+	for ; ip < len(in); ip++ {
+		out = append(out, in[ip])
+		if lit++; lit == lzfMaxLit {
+			closeLiteral()
+			openLiteral()
+		}
+	}
+	closeLiteral()
+
+	if len(out) >= len(in) {
+		return nil
+	}
+	return out
+}
+
+// lzfDecompress decompresses in, which must expand to exactly n bytes
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < lzfMaxLit {
+			l := ctrl + 1
+			if ip+l > len(in) || len(out)+l > n {
+				return nil, lzfCorrupt
+			}
+			out = append(out, in[ip:ip+l]...)
+			ip += l
+			continue
+		}
+
+		l := ctrl >> 5
+		if l == 7 {
+			if ip >= len(in) {
+				return nil, lzfCorrupt
+			}
+			l += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, lzfCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		l += 2
+		if ref < 0 || len(out)+l > n {
+			return nil, lzfCorrupt
+		}
+		// the reference may overlap with what it produces
+		for i := 0; i < l; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != n {
+		return nil, lzfCorrupt
+	}
+	return out, nil
+}
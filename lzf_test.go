@@ -0,0 +1,39 @@
+package toyredis
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestLZF(t *testing.T) {
+	random := make([]byte, 1000)
+	rand.Read(random)
+	cases := [][]byte{
+		[]byte(strings.Repeat("a", 1000)),
+		[]byte(strings.Repeat("hello world ", 50)),
+		append([]byte(strings.Repeat("ab", 100)), random[:100]...),
+	}
+	for _, in := range cases {
+		c := lzfCompress(in)
+		if c == nil || len(c) >= len(in) {
+			t.Fatalf("%q should compress", in)
+		}
+		out, err := lzfDecompress(c, len(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(in, out) {
+			t.Fatalf("expected %q, got %q", in, out)
+		}
+	}
+
+	if c := lzfCompress(random); c != nil {
+		t.Fatal("random data should not compress")
+	}
+	c := lzfCompress(cases[0])
+	if _, err := lzfDecompress(c, len(cases[0])-1); err != lzfCorrupt {
+		t.Fatalf("expected %v, got %v", lzfCorrupt, err)
+	}
+}
@@ -0,0 +1,116 @@
+package toyredis
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Commands registered with RegisterCommand are run like the stock ones:
+// their arity is checked first, denyoom ones are refused once no memory
+// can be freed, writes are refused on replicas and run with execMu held
+// exclusively, so no other command runs meanwhile, and reads with it
+// shared, so no write runs meanwhile. They can be queued in transactions
+// and called from scripts.
+//
+// A write is logged to the append only file and sent to the replicas and
+// the CDC feed as it was received, unless the handler propagates other
+// commands. The append only file is loaded before the server is returned,
+// so with appendonly on, writes are only accepted through Config.Commands
+// to be replayed. Writes that are not propagated as stock commands can
+// only be applied by replicas that registered them too.
+
+// Args are the arguments of a command, without its name
+type Args []string
+
+// Bytes returns argument i
+func (a Args) Bytes(i int) []byte {
+	return []byte(a[i])
+}
+
+// Int parses argument i as an integer
+func (a Args) Int(i int) (int64, error) {
+	n, err := strconv.ParseInt(a[i], 10, 64)
+	if err != nil {
+		return 0, notIntError
+	}
+	return n, nil
+}
+
+// Float parses argument i as a float
+func (a Args) Float(i int) (float64, error) {
+	return parseFloat(a[i])
+}
+
+// CommandContext is what a registered command runs with
+type CommandContext struct {
+	Args Args
+	// the reply is written here, unless the handler returns an error
+	Writer *Writer
+	// the database selected by the client
+	DB *Cache
+
+	cn *Conn
+}
+
+// Propagate replaces what a write command propagates with cmds, nothing if
+// empty
+func (ctx *CommandContext) Propagate(cmds ...[]string) {
+	ctx.cn.propagated = append([][]string{}, cmds...)
+}
+
+// CommandHandler runs a registered command, an error it returns is the
+// reply
+type CommandHandler func(ctx *CommandContext) error
+
+// Command is a command to register, see RegisterCommand
+type Command struct {
+	Name    string
+	Arity   int
+	Flags   CommandFlags
+	Handler CommandHandler
+}
+
+var (
+	noHandler     = errors.New("command handler is nil")
+	writeAfterAOF = errors.New("write commands are registered through Config.Commands when appendonly is on")
+)
+
+// RegisterCommand adds a command to the server. Arity is the number of
+// arguments including the name, at least -arity if negative. Commands
+// with movable keys cannot be registered, and registered commands do not
+// report keys. With appendonly on, writes are refused, as the file was
+// loaded without them.
+func (s *server) RegisterCommand(name string, arity int, flags CommandFlags, handler CommandHandler) error {
+	if flags&FlagWrite != 0 && s.aof != nil {
+		return writeAfterAOF
+	}
+	return s.addCommand(Command{name, arity, flags, handler})
+}
+
+// addCommand registers cmd, see RegisterCommand
+func (s *server) addCommand(cmd Command) error {
+	name, arity, flags, handler := strings.ToLower(cmd.Name), cmd.Arity, cmd.Flags, cmd.Handler
+	switch {
+	case name == "" || strings.ContainsAny(name, " \t\r\n"):
+		return fmt.Errorf("invalid command name %q", name)
+	case arity == 0:
+		return fmt.Errorf("invalid arity of command %s", name)
+	case flags&FlagMovableKeys != 0:
+		return fmt.Errorf("command %s cannot have movable keys", name)
+	case handler == nil:
+		return noHandler
+	}
+	c := &command{name, arity, flags, 0, 0, 0, func(s *server, cn *Conn, args []string) error {
+		return handler(&CommandContext{Args: args, Writer: cn.wr, DB: s.db(cn), cn: cn})
+	}}
+
+	s.commandsMu.Lock()
+	defer s.commandsMu.Unlock()
+	if _, ok := s.commands[name]; ok {
+		return fmt.Errorf("command %s already exists", name)
+	}
+	s.commands[name] = c
+	return nil
+}
@@ -0,0 +1,137 @@
+package toyredis
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRegisterCommand(t *testing.T) {
+	server := NewServerWithConfig(Config{Port: "6806", SizeLimit: 20})
+	defer server.Stop()
+
+	// SETMAX key n sets key to n unless it holds a greater integer
+	err := server.RegisterCommand("SETMAX", 3, FlagWrite|FlagDenyOOM, func(ctx *CommandContext) error {
+		n, err := ctx.Args.Int(1)
+		if err != nil {
+			return err
+		}
+		key := ctx.Args[0]
+		old, err := ctx.DB.Get(key)
+		if err != nil {
+			return err
+		}
+		if m, err := strconv.ParseInt(string(old), 10, 64); err == nil && m >= n {
+			ctx.Writer.Int(0)
+			ctx.Propagate()
+			return nil
+		}
+		if err := ctx.DB.Set(key, ctx.Args.Bytes(1)); err != nil {
+			return err
+		}
+		ctx.Writer.Int(1)
+		ctx.Propagate([]string{"set", key, ctx.Args[1]})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RegisterCommand("echo2", -2, FlagReadOnly|FlagFast, func(ctx *CommandContext) error {
+		ctx.Writer.String([]byte(strings.Join(ctx.Args, " ")))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"get", "setmax", ""} {
+		if err := server.RegisterCommand(name, 2, 0, func(*CommandContext) error { return nil }); err == nil {
+			t.Fatalf("expected %q not to be registered", name)
+		}
+	}
+	if err := server.RegisterCommand("keys2", -2, FlagMovableKeys, func(*CommandContext) error { return nil }); err == nil {
+		t.Fatal("expected movable keys to be refused")
+	}
+	if err := server.RegisterCommand("nohandler", 1, 0, nil); err != noHandler {
+		t.Fatalf("expected %v, got %v", noHandler, err)
+	}
+
+	cdc, rd := openCDC(t, "6806")
+	defer cdc.Close()
+
+	c := dial(t, "6806")
+	defer c.Close()
+	c.send("setmax", "foo", "5")
+	c.send("setmax", "foo", "3")
+	c.send("setmax", "foo", "x")
+	c.send("setmax", "foo")
+	c.send("get", "foo")
+	c.expect(t, ":1", ":0", "-ERR value is not an integer or out of range",
+		"-ERR wrong number of arguments", "5")
+	c.send("echo2", "a", "b")
+	c.expect(t, "a b")
+
+	// in transactions and scripts
+	c.send("multi")
+	c.send("setmax", "foo", "7")
+	c.send("exec")
+	c.expect(t, "+OK", "+QUEUED", ":1")
+	c.send("eval", "return redis.call('setmax', KEYS[1], ARGV[1])", "1", "foo", "9")
+	c.expect(t, ":1")
+
+	c.send("command", "info", "setmax")
+	c.expect(t, "setmax :3 +write +denyoom :0 :0 :0")
+
+	want := []string{
+		"0 0 set foo 5",
+		"1 0 multi", "2 0 set foo 7", "3 0 exec",
+		"4 0 multi", "5 0 set foo 9", "6 0 exec",
+	}
+	for _, w := range want {
+		ss, err := rd.ReadRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(ss, " "); got != w {
+			t.Fatalf("expected %s, got %s", w, got)
+		}
+	}
+}
+
+func TestConfigCommands(t *testing.T) {
+	// APPENDX key value appends value to key, logged as it is
+	appendx := Command{"appendx", 3, FlagWrite | FlagDenyOOM, func(ctx *CommandContext) error {
+		old, err := ctx.DB.Get(ctx.Args[0])
+		if err != nil {
+			return err
+		}
+		if err := ctx.DB.Set(ctx.Args[0], append(old, ctx.Args[1]...)); err != nil {
+			return err
+		}
+		ctx.Writer.Status("OK")
+		return nil
+	}}
+	cfg := Config{
+		Port:        "6808",
+		SizeLimit:   20,
+		Dir:         t.TempDir(),
+		AppendOnly:  true,
+		AppendFsync: FsyncAlways,
+		Commands:    []Command{appendx},
+	}
+	server := NewServerWithConfig(cfg)
+	if err := server.RegisterCommand("setx", 3, FlagWrite, func(*CommandContext) error { return nil }); err != writeAfterAOF {
+		t.Fatalf("expected %v, got %v", writeAfterAOF, err)
+	}
+	if err := server.RegisterCommand("getx", 2, FlagReadOnly, func(*CommandContext) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	sendCommands(t, cfg.Port, []string{"appendx", "foo", "a"}, []string{"appendx", "foo", "b"})
+	server.Stop()
+
+	// the log is replayed with the commands of the config
+	cfg.Port = "6809"
+	server = NewServerWithConfig(cfg)
+	defer server.Stop()
+	if v, _ := server.dbs[0].Get("foo"); string(v) != "ab" {
+		t.Fatalf("expected ab, got %s", v)
+	}
+}
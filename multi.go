@@ -0,0 +1,158 @@
+package toyredis
+
+import (
+	"errors"
+	"strings"
+)
+
+// Commands sent after MULTI are queued until EXEC, which runs them with
+// execMu held exclusively so that no other command runs in between. When
+// the transaction writes, the writes are propagated between a MULTI and an
+// EXEC, so that replicas apply them at once too.
+//
+// EXEC replies with a null array and runs nothing if one of the keys the
+// connection watched changed since WATCH, as told by the versions of the
+// databases.
+
+var (
+	nestedMulti       = errors.New("ERR MULTI calls can not be nested")
+	execWithoutMulti  = errors.New("ERR EXEC without MULTI")
+	discardNoMulti    = errors.New("ERR DISCARD without MULTI")
+	notInTransaction  = errors.New("ERR Command not allowed inside a transaction")
+	watchInMulti      = errors.New("ERR WATCH inside MULTI is not allowed")
+	transactionFailed = errors.New("EXECABORT Transaction discarded because of previous errors.")
+)
+
+// commands run at once while a transaction is open
+var transactionCommands = map[string]bool{
+	"multi": true, "exec": true, "discard": true, "watch": true,
+}
+
+// queue adds a command to the transaction of cn. Commands that would fail
+// whatever the data abort the transaction.
+func (s *server) queue(cn *Conn, cmd *command, ss []string) (err error) {
+	switch {
+	case cmd == nil:
+		err = unsupportedRequest
+	case !cmd.checkArity(len(ss)):
+		err = arityError
+	case cmd.flags&FlagNoMulti != 0:
+		err = notInTransaction
+	case cmd.flags&FlagWrite != 0 && !cn.master && s.isReplica():
+		err = readOnlyReplica
+	}
+	if err != nil {
+		cn.aborted = true
+		return
+	}
+	cn.queued = append(cn.queued, ss)
+	cn.wr.Status("QUEUED")
+	return
+}
+
+func (s *server) handleMulti(cn *Conn, ss []string) (err error) {
+	switch {
+	case cn.multi:
+		err = nestedMulti
+	default:
+		cn.multi = true
+		cn.wr.Status("OK")
+	}
+	return
+}
+
+func (s *server) handleDiscard(cn *Conn, ss []string) (err error) {
+	switch {
+	case !cn.multi:
+		err = discardNoMulti
+	default:
+		cn.resetTransaction()
+		cn.wr.Status("OK")
+	}
+	return
+}
+
+// handleExec runs the queued commands and replies with an array of their
+// replies, execMu must be held exclusively
+func (s *server) handleExec(cn *Conn, ss []string) (err error) {
+	if !cn.multi {
+		return execWithoutMulti
+	}
+	// cn.multi stays set while the commands run, so that they do not block
+	defer cn.resetTransaction()
+	if cn.aborted {
+		return transactionFailed
+	}
+	dbs := s.allDBs()
+	for _, w := range cn.watched {
+		if dbs[w.db].Version(w.key) != w.version {
+			cn.wr.NullStringArray()
+			return
+		}
+	}
+
+	cn.wr.Array(len(cn.queued))
+	for _, args := range cn.queued {
+		cmd := s.lookupCommand(strings.ToLower(args[0]))
+		if cmd.flags&FlagWrite != 0 {
+			s.propagateMulti(cn)
+		}
+		if err := s.run(cn, cmd, args); err != nil {
+			cn.wr.Error(err.Error())
+		}
+	}
+	s.propagateExec(cn)
+	return
+}
+
+// propagateMulti propagates a MULTI before the first write of the
+// transaction or script run by cn, scripts in a transaction share the one
+// of the transaction
+func (s *server) propagateMulti(cn *Conn) {
+	if !cn.inMulti {
+		cn.propagated = nil
+		s.propagate(cn, "multi", []string{"multi"})
+		cn.inMulti = true
+	}
+}
+
+// propagateExec propagates the EXEC due after the writes of cn
+func (s *server) propagateExec(cn *Conn) {
+	if cn.inMulti {
+		cn.propagated = nil
+		s.propagate(cn, "exec", []string{"exec"})
+		cn.inMulti = false
+	}
+}
+
+func (cn *Conn) resetTransaction() {
+	cn.multi, cn.aborted, cn.queued, cn.watched = false, false, nil, nil
+}
+
+// watchedKey is a key as it was when WATCH was sent
+type watchedKey struct {
+	db      int
+	key     string
+	version uint64
+}
+
+// handleWatch parses WATCH key [key ...]
+func (s *server) handleWatch(cn *Conn, ss []string) (err error) {
+	switch {
+	case cn.multi:
+		err = watchInMulti
+	default:
+		db := s.db(cn)
+		for _, key := range ss {
+			cn.watched = append(cn.watched, watchedKey{cn.db, key, db.Version(key)})
+		}
+		cn.wr.Status("OK")
+	}
+	return
+}
+
+func (s *server) handleUnwatch(cn *Conn, ss []string) (err error) {
+	cn.watched = nil
+	cn.wr.Status("OK")
+	return
+}
@@ -0,0 +1,126 @@
+package toyredis
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransaction(t *testing.T) {
+	server := NewServerWithConfig(Config{Port: "6802", SizeLimit: 20})
+	defer server.Stop()
+
+	cdc, rd := openCDC(t, "6802")
+	defer cdc.Close()
+
+	c := dial(t, "6802")
+	defer c.Close()
+	c.send("exec")
+	c.expect(t, "-ERR EXEC without MULTI")
+
+	c.send("multi")
+	c.send("set", "foo", "1")
+	c.send("incr", "foo")
+	c.send("get", "foo")
+	// does not block
+	c.send("blpop", "list", "0")
+	c.send("exec")
+	c.expect(t, "+OK", "+QUEUED", "+QUEUED", "+QUEUED", "+QUEUED", "+OK :2 2 (nil)")
+
+	// errors while running do not stop the others
+	c.send("multi")
+	c.send("select", "1")
+	c.send("sadd", "foo", "a")
+	c.send("incr", "foo")
+	c.send("exec")
+	c.expect(t, "+OK", "+QUEUED", "+QUEUED", "+QUEUED",
+		"+OK :1 -WRONGTYPE Operation against a key holding the wrong kind of value")
+
+	// errors while queuing abort
+	c.send("multi")
+	c.send("multi")
+	c.send("del", "foo")
+	c.send("nosuchcommand")
+	c.send("subscribe", "news")
+	c.send("exec")
+	c.expect(t, "+OK", "-ERR MULTI calls can not be nested", "+QUEUED", "-ERR unsupported command",
+		"-ERR Command not allowed inside a transaction",
+		"-EXECABORT Transaction discarded because of previous errors.")
+
+	c.send("multi")
+	c.send("del", "foo")
+	c.send("discard")
+	c.send("discard")
+	c.send("scard", "foo")
+	c.expect(t, "+OK", "+QUEUED", "+OK", "-ERR DISCARD without MULTI", ":1")
+
+	// the writes are propagated between MULTI and EXEC
+	want := []string{
+		"0 0 multi", "1 0 set foo 1", "2 0 incr foo", "3 0 exec",
+		"4 1 multi", "5 1 sadd foo a", "6 1 exec",
+	}
+	for _, w := range want {
+		ss, err := rd.ReadRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(ss, " "); got != w {
+			t.Fatalf("expected %s, got %s", w, got)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := NewServerWithConfig(Config{Port: "6803", SizeLimit: 20})
+	defer server.Stop()
+
+	c := dial(t, "6803")
+	defer c.Close()
+	c.send("watch", "foo", "bar")
+	c.send("multi")
+	c.send("watch", "baz")
+	c.send("set", "foo", "1")
+	c.send("exec")
+	c.expect(t, "+OK", "+OK", "-ERR WATCH inside MULTI is not allowed", "+QUEUED", "+OK")
+
+	// changed by another connection
+	c.send("watch", "foo")
+	c.expect(t, "+OK")
+	sendCommands(t, "6803", []string{"incr", "foo"})
+	c.send("multi")
+	c.send("set", "foo", "10")
+	c.send("exec")
+	c.send("get", "foo")
+	c.expect(t, "+OK", "+QUEUED", "(nil)", "2")
+
+	// EXEC unwatches
+	sendCommands(t, "6803", []string{"incr", "foo"})
+	c.send("multi")
+	c.send("exec")
+	c.expect(t, "+OK", "")
+
+	c.send("watch", "foo")
+	sendCommands(t, "6803", []string{"del", "foo"})
+	c.send("unwatch")
+	c.send("multi")
+	c.send("exec")
+	c.expect(t, "+OK", "+OK", "+OK", "")
+
+	// expired keys and keys of other databases
+	c.send("set", "foo", "1", "px", "1")
+	c.send("watch", "foo")
+	c.send("select", "1")
+	c.expect(t, "+OK", "+OK", "+OK")
+	time.Sleep(2 * time.Millisecond)
+	c.send("multi")
+	c.send("exec")
+	c.expect(t, "+OK", "(nil)")
+
+	// SWAPDB
+	c.send("watch", "foo")
+	c.expect(t, "+OK")
+	sendCommands(t, "6803", []string{"set", "foo", "1"}, []string{"swapdb", "0", "1"})
+	c.send("multi")
+	c.send("exec")
+	c.expect(t, "+OK", "(nil)")
+}
@@ -0,0 +1,89 @@
+package toyredis
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+)
+
+// Keyspace notifications follow redis: the events of the databases are
+// published to __keyspace@<db>__:<key> with the event as message and to
+// __keyevent@<db>__:<event> with the key as message, for the classes of
+// events enabled by the notify-keyspace-events flags.
+
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset | notifyExpired | notifyEvicted
+)
+
+var invalidNotifyFlags = errors.New("ERR invalid notify-keyspace-events")
+
+var notifyFlags = map[rune]int32{
+	'K': notifyKeyspace,
+	'E': notifyKeyevent,
+	'g': notifyGeneric,
+	'$': notifyString,
+	'l': notifyList,
+	's': notifySet,
+	'h': notifyHash,
+	'z': notifyZset,
+	'x': notifyExpired,
+	'e': notifyEvicted,
+	'A': notifyAll,
+}
+
+// class of each event of the cache
+var eventClasses = map[string]int32{
+	"del": notifyGeneric, "expire": notifyGeneric, "persist": notifyGeneric,
+	"rename_from": notifyGeneric, "rename_to": notifyGeneric, "copy_to": notifyGeneric,
+	"move_from": notifyGeneric, "move_to": notifyGeneric, "restore": notifyGeneric,
+	"set": notifyString, "incrby": notifyString, "incrbyfloat": notifyString,
+	"lpush": notifyList, "rpush": notifyList, "lpop": notifyList, "rpop": notifyList,
+	"lset": notifyList, "lrem": notifyList, "ltrim": notifyList, "linsert": notifyList,
+	"sadd": notifySet, "srem": notifySet, "spop": notifySet,
+	"sunionstore": notifySet, "sinterstore": notifySet, "sdiffstore": notifySet,
+	"hset": notifyHash, "hdel": notifyHash, "hincrby": notifyHash, "hincrbyfloat": notifyHash,
+	"zadd": notifyZset, "zincr": notifyZset, "zrem": notifyZset, "zpopmin": notifyZset,
+	"zpopmax": notifyZset, "zunionstore": notifyZset, "zinterstore": notifyZset,
+	"expired": notifyExpired,
+	"evicted": notifyEvicted,
+}
+
+// parseNotifyFlags parses the value of notify-keyspace-events
+func parseNotifyFlags(arg string) (int32, error) {
+	var flags int32
+	for _, r := range arg {
+		f, ok := notifyFlags[r]
+		if !ok {
+			return 0, invalidNotifyFlags
+		}
+		flags |= f
+	}
+	return flags, nil
+}
+
+// notifyKeyspaceEvent publishes event e of database db if the flags enable
+// it. It is called with the database locked.
+func (s *server) notifyKeyspaceEvent(db int, e Event) {
+	flags := atomic.LoadInt32(&s.notifyFlags)
+	if flags&eventClasses[e.Name] == 0 {
+		return
+	}
+	i := strconv.Itoa(db)
+	if flags&notifyKeyspace != 0 {
+		s.pubsub.publish("__keyspace@"+i+"__:"+e.Key, e.Name)
+	}
+	if flags&notifyKeyevent != 0 {
+		s.pubsub.publish("__keyevent@"+i+"__:"+e.Name, e.Key)
+	}
+}
@@ -0,0 +1,46 @@
+package toyredis
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyspaceNotifications(t *testing.T) {
+	server := NewServerWithConfig(Config{Port: "6801", SizeLimit: 20})
+	defer server.Stop()
+
+	sub := dial(t, "6801")
+	defer sub.Close()
+	sub.send("psubscribe", "__key*__:*")
+	sub.expect(t, "psubscribe __key*__:* :1")
+
+	c := dial(t, "6801")
+	defer c.Close()
+	// nothing is sent until enabled
+	c.send("set", "foo", "1")
+	c.expect(t, "+OK")
+	c.send("config", "set", "notify-keyspace-events", "KEA")
+	c.expect(t, "+OK")
+	c.send("incr", "foo")
+	c.expect(t, ":2")
+	sub.expect(t,
+		"pmessage __key*__:* __keyspace@0__:foo incrby",
+		"pmessage __key*__:* __keyevent@0__:incrby foo")
+
+	// only the expired events of database 1
+	c.send("config", "set", "notify-keyspace-events", "Ex")
+	c.expect(t, "+OK")
+	c.send("select", "1")
+	c.expect(t, "+OK")
+	c.send("rpush", "l", "a")
+	c.expect(t, ":1")
+	c.send("pexpire", "l", "1")
+	c.expect(t, ":1")
+	time.Sleep(2 * time.Millisecond)
+	c.send("exists", "l")
+	c.expect(t, ":0")
+	sub.expect(t, "pmessage __key*__:* __keyevent@1__:expired l")
+
+	c.send("config", "set", "notify-keyspace-events", "Kq")
+	c.expect(t, "-ERR invalid notify-keyspace-events")
+}
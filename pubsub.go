@@ -0,0 +1,273 @@
+package toyredis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Once a connection subscribes, everything sent to it goes through the
+// outbox of its subscriber, so that PUBLISH only has to queue messages. A
+// subscriber that lets more than subscriberLimit bytes pile up is
+// disconnected.
+
+const subscriberLimit = 32 * MB
+
+// commands allowed while a connection has subscriptions
+var subscribedCommands = map[string]bool{
+	"subscribe": true, "psubscribe": true, "unsubscribe": true, "punsubscribe": true, "ping": true,
+}
+
+type subscriber struct {
+	*outbox
+	conn net.Conn
+	// guarded by the mutex of the hub
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+// Write queues p, the connection is closed if the outbox is
+func (sub *subscriber) Write(p []byte) (int, error) {
+	n, err := sub.outbox.Write(p)
+	if err != nil {
+		// the write in progress may be stuck
+		sub.conn.Close()
+	}
+	return n, err
+}
+
+// serve writes the outbox to the connection until it is closed, then
+// closes the connection
+func (sub *subscriber) serve() {
+	defer sub.conn.Close()
+	for {
+		p, ok := sub.next()
+		if !ok {
+			return
+		}
+		if _, err := sub.conn.Write(p); err != nil {
+			return
+		}
+	}
+}
+
+// pubsub holds the subscriptions of all connections
+type pubsub struct {
+	mu       sync.RWMutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+}
+
+func newPubSub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+// subscribe adds channels, or patterns, to the subscriptions of sub and
+// replies for each of them
+func (ps *pubsub) subscribe(sub *subscriber, wr *Writer, names []string, pattern bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	kind, all, own := "subscribe", ps.channels, sub.channels
+	if pattern {
+		kind, all, own = "psubscribe", ps.patterns, sub.patterns
+	}
+	for _, name := range names {
+		if _, ok := own[name]; !ok {
+			own[name] = struct{}{}
+			if all[name] == nil {
+				all[name] = make(map[*subscriber]struct{})
+			}
+			all[name][sub] = struct{}{}
+		}
+		writeSubscription(wr, kind, []byte(name), len(sub.channels)+len(sub.patterns))
+	}
+}
+
+// unsubscribe removes channels, or patterns, from the subscriptions of sub
+// and replies for each of them, all of them if names is empty. wr may be
+// nil.
+func (ps *pubsub) unsubscribe(sub *subscriber, wr *Writer, names []string, pattern bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	kind, all, own := "unsubscribe", ps.channels, sub.channels
+	if pattern {
+		kind, all, own = "punsubscribe", ps.patterns, sub.patterns
+	}
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 && wr != nil {
+			writeSubscription(wr, kind, nil, len(sub.channels)+len(sub.patterns))
+		}
+	}
+	for _, name := range names {
+		if _, ok := own[name]; ok {
+			delete(own, name)
+			delete(all[name], sub)
+			if len(all[name]) == 0 {
+				delete(all, name)
+			}
+		}
+		if wr != nil {
+			writeSubscription(wr, kind, []byte(name), len(sub.channels)+len(sub.patterns))
+		}
+	}
+}
+
+func writeSubscription(wr *Writer, kind string, name []byte, count int) {
+	wr.Array(3)
+	wr.String([]byte(kind))
+	wr.String(name)
+	wr.Int(count)
+}
+
+// subscribed tells whether sub has subscriptions
+func (ps *pubsub) subscribed(sub *subscriber) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return len(sub.channels)+len(sub.patterns) > 0
+}
+
+// publish queues message for the subscribers of channel and returns how
+// many got it
+func (ps *pubsub) publish(channel, message string) (num int) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	if subs := ps.channels[channel]; len(subs) > 0 {
+		buf := new(bytes.Buffer)
+		NewWriter(buf).StringArray([][]byte{[]byte("message"), []byte(channel), []byte(message)})
+		for sub := range subs {
+			sub.Write(buf.Bytes())
+			num++
+		}
+	}
+	for pattern, subs := range ps.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		buf := new(bytes.Buffer)
+		NewWriter(buf).StringArray([][]byte{[]byte("pmessage"), []byte(pattern), []byte(channel), []byte(message)})
+		for sub := range subs {
+			sub.Write(buf.Bytes())
+			num++
+		}
+	}
+	return
+}
+
+// subscriberOf returns the subscriber of cn, which is created and takes
+// over the writes to the connection on the first subscription
+func (s *server) subscriberOf(cn *Conn) (*subscriber, error) {
+	if cn.sub != nil {
+		return cn.sub, nil
+	}
+	if cn.netConn == nil {
+		return nil, errors.New("ERR subscriptions are not allowed in this context")
+	}
+	sub := &subscriber{
+		outbox:   newOutbox(subscriberLimit),
+		conn:     cn.netConn,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}
+	if err := cn.bw.Flush(); err != nil {
+		return nil, err
+	}
+	cn.bw.Reset(sub)
+	cn.sub = sub
+	go sub.serve()
+	return sub, nil
+}
+
+func (s *server) handleSubscribe(cn *Conn, ss []string, pattern bool) (err error) {
+	sub, err := s.subscriberOf(cn)
+	if err != nil {
+		return
+	}
+	s.pubsub.subscribe(sub, cn.wr, ss, pattern)
+	return
+}
+
+func (s *server) handleUnsubscribe(cn *Conn, ss []string, pattern bool) (err error) {
+	sub := cn.sub
+	if sub == nil {
+		// nothing to remove, only the replies are needed
+		sub = &subscriber{channels: make(map[string]struct{}), patterns: make(map[string]struct{})}
+	}
+	s.pubsub.unsubscribe(sub, cn.wr, ss, pattern)
+	return
+}
+
+func (s *server) handlePublish(cn *Conn, ss []string) (err error) {
+	cn.wr.Int(s.pubsub.publish(ss[0], ss[1]))
+	return
+}
+
+// handlePing replies with PONG, or in the format of messages while the
+// connection has subscriptions
+func (s *server) handlePing(cn *Conn, ss []string) (err error) {
+	if len(ss) > 1 {
+		return arityError
+	}
+	switch {
+	case cn.sub != nil && s.pubsub.subscribed(cn.sub):
+		msg := []byte{}
+		if len(ss) == 1 {
+			msg = []byte(ss[0])
+		}
+		cn.wr.StringArray([][]byte{[]byte("pong"), msg})
+	case len(ss) == 1:
+		cn.wr.String([]byte(ss[0]))
+	default:
+		cn.wr.Status("PONG")
+	}
+	return
+}
+
+// handlePubSub parses PUBSUB CHANNELS [pattern], PUBSUB NUMSUB [channel
+// ...] and PUBSUB NUMPAT
+func (s *server) handlePubSub(cn *Conn, ss []string) (err error) {
+	ps := s.pubsub
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	switch sub := strings.ToLower(ss[0]); {
+	case sub == "channels" && len(ss) <= 2:
+		channels := make([]string, 0)
+		for channel := range ps.channels {
+			if len(ss) == 1 || globMatch(ss[1], channel) {
+				channels = append(channels, channel)
+			}
+		}
+		sort.Strings(channels)
+		bs := make([][]byte, len(channels))
+		for i, channel := range channels {
+			bs[i] = []byte(channel)
+		}
+		cn.wr.StringArray(bs)
+	case sub == "numsub":
+		cn.wr.Array(len(ss[1:]) * 2)
+		for _, channel := range ss[1:] {
+			cn.wr.String([]byte(channel))
+			cn.wr.Int(len(ps.channels[channel]))
+		}
+	case sub == "numpat" && len(ss) == 1:
+		cn.wr.Int(len(ps.patterns))
+	default:
+		err = fmt.Errorf("ERR Unknown PUBSUB subcommand or wrong number of arguments for '%s'", ss[0])
+	}
+	return
+}
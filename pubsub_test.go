@@ -0,0 +1,134 @@
+package toyredis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readReply reads a reply of any type, arrays are flattened and their
+// elements separated by spaces
+func readReply(rd *Reader) (string, error) {
+	line, err := rd.readline()
+	if err != nil {
+		return "", err
+	}
+	switch line[0] {
+	case StringReply:
+		if string(line) == "$-1" {
+			return "(nil)", nil
+		}
+		n, _ := strconv.Atoi(string(line[1:]))
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(rd.rd, b)
+		return string(b[:n]), err
+	case ArrayReply:
+		if string(line) == "*-1" {
+			return "(nil)", nil
+		}
+		n, _ := strconv.Atoi(string(line[1:]))
+		items := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := readReply(rd)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, item)
+		}
+		return strings.Join(items, " "), nil
+	}
+	return string(line), nil
+}
+
+// client is a connection that sends commands and reads replies apart
+type client struct {
+	net.Conn
+	bw *bufio.Writer
+	rd *Reader
+}
+
+func dial(t *testing.T, port string) *client {
+	cn, err := net.Dial("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &client{Conn: cn, bw: bufio.NewWriter(cn), rd: NewReader(cn)}
+}
+
+func (c *client) send(args ...string) {
+	NewWriter(c.bw).Request(args)
+	c.bw.Flush()
+}
+
+// expect reads the next replies and fails unless they are want
+func (c *client) expect(t *testing.T, want ...string) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	for _, w := range want {
+		got, err := readReply(c.rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != w {
+			t.Fatalf("expected %q, got %q", w, got)
+		}
+	}
+}
+
+func TestPubSub(t *testing.T) {
+	server := NewServerWithConfig(Config{Port: "6800", SizeLimit: 20})
+	defer server.Stop()
+
+	sub := dial(t, "6800")
+	defer sub.Close()
+	sub.send("subscribe", "news", "sport")
+	sub.send("psubscribe", "n*")
+	sub.send("get", "foo")
+	sub.send("ping")
+	sub.expect(t, "subscribe news :1", "subscribe sport :2", "psubscribe n* :3",
+		"-ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context",
+		"pong ")
+
+	replies := sendCommands(t, "6800",
+		[]string{"publish", "news", "hello"},
+		[]string{"publish", "other", "x"},
+		[]string{"pubsub", "numpat"},
+	)
+	if strings.Join(replies, " ") != ":2 :0 :1" {
+		t.Fatalf("unexpected replies %v", replies)
+	}
+	sub.expect(t, "message news hello", "pmessage n* news hello")
+
+	pub := dial(t, "6800")
+	defer pub.Close()
+	pub.send("pubsub", "channels")
+	pub.send("pubsub", "numsub", "news", "none")
+	pub.expect(t, "news sport", "news :1 none :0")
+
+	sub.send("unsubscribe")
+	sub.send("punsubscribe")
+	sub.send("ping")
+	sub.expect(t, "unsubscribe news :2", "unsubscribe sport :1", "punsubscribe n* :0", "+PONG")
+	pub.send("pubsub", "channels")
+	pub.expect(t, "")
+
+	// a subscriber that does not read is disconnected instead of slowing
+	// down publishers
+	sub.send("subscribe", "news")
+	sub.expect(t, "subscribe news :1")
+	big := strings.Repeat("x", MB)
+	pub.SetReadDeadline(time.Time{})
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("the subscriber should be disconnected.")
+		}
+		pub.send("publish", "news", big)
+		if reply, _ := readReply(pub.rd); reply == ":0" {
+			break
+		}
+	}
+}
@@ -0,0 +1,1067 @@
+package toyredis
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The RDB format of redis: "REDIS" and a 4 digit version, then opcodes
+// for aux fields, database selection and expires, and the keys as their
+// value type, name and value. The file ends with opEOF and the CRC-64 of
+// everything before it. Values are written in the plain encodings, and
+// read in the compact ones redis uses for small collections as well.
+
+const (
+	rdbVersion    = 9
+	rdbMaxVersion = 12
+
+	rdbOpSlotInfo = 0xf4
+	rdbOpIdle     = 0xf8
+	rdbOpFreq     = 0xf9
+	rdbOpAux      = 0xfa
+	rdbOpResizeDB = 0xfb
+	rdbOpExpireMs = 0xfc
+	rdbOpExpire   = 0xfd
+	rdbOpSelectDB = 0xfe
+	rdbOpEOF      = 0xff
+
+	rdbTypeString  = 0
+	rdbTypeList    = 1
+	rdbTypeSet     = 2
+	rdbTypeZSet    = 3
+	rdbTypeHash    = 4
+	rdbTypeZSet2   = 5
+	rdbTypeZipmap  = 9
+	rdbTypeZiplist = 10
+	rdbTypeIntset  = 11
+	rdbTypeZSetZip = 12
+	rdbTypeHashZip = 13
+	rdbTypeQuick   = 14
+	rdbTypeHashLP  = 16
+	rdbTypeZSetLP  = 17
+	rdbTypeQuick2  = 18
+	rdbTypeSetLP   = 20
+
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	rdbLen6Bit    = 0
+	rdbLen14Bit   = 1
+	rdbLen32Bit   = 0x80
+	rdbLen64Bit   = 0x81
+	rdbLenEncoded = 3
+
+	quicklistPlain  = 1
+	quicklistPacked = 2
+)
+
+var invalidRDB = errors.New("invalid rdb format")
+
+// crc64 of redis, the Jones polynomial without the inversions of
+// hash/crc64
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+type crc64Jones uint64
+
+func (c *crc64Jones) Write(p []byte) (int, error) {
+	*c = crc64Jones(^crc64.Update(^uint64(*c), crc64Table, p))
+	return len(p), nil
+}
+
+func (c *crc64Jones) Sum64() uint64 {
+	return uint64(*c)
+}
+
+//------------------------------------------------------------------------------
+
+type rdbEncoder struct {
+	bw  *bufio.Writer
+	crc crc64Jones
+	buf [8]byte
+}
+
+func newRDBEncoder(w io.Writer) *rdbEncoder {
+	return &rdbEncoder{bw: bufio.NewWriter(w)}
+}
+
+func (e *rdbEncoder) write(p []byte) {
+	// errors are kept by bufio.Writer and returned by Flush
+	e.bw.Write(p)
+	e.crc.Write(p)
+}
+
+func (e *rdbEncoder) writeByte(b byte) {
+	e.write([]byte{b})
+}
+
+func (e *rdbEncoder) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.writeByte(byte(n))
+	case n < 1<<14:
+		e.write([]byte{rdbLen14Bit<<6 | byte(n>>8), byte(n)})
+	case n <= math.MaxUint32:
+		e.writeByte(rdbLen32Bit)
+		binary.BigEndian.PutUint32(e.buf[:4], uint32(n))
+		e.write(e.buf[:4])
+	default:
+		e.writeByte(rdbLen64Bit)
+		binary.BigEndian.PutUint64(e.buf[:], n)
+		e.write(e.buf[:])
+	}
+}
+
+// writeString writes s as an integer if it is the canonical form of one,
+// and compresses long strings.
+func (e *rdbEncoder) writeString(s []byte) {
+	if len(s) <= 11 {
+		if n, err := strconv.ParseInt(string(s), 10, 32); err == nil && strconv.FormatInt(n, 10) == string(s) {
+			switch {
+			case n >= math.MinInt8 && n <= math.MaxInt8:
+				e.write([]byte{rdbLenEncoded<<6 | rdbEncInt8, byte(n)})
+			case n >= math.MinInt16 && n <= math.MaxInt16:
+				e.writeByte(rdbLenEncoded<<6 | rdbEncInt16)
+				binary.LittleEndian.PutUint16(e.buf[:2], uint16(n))
+				e.write(e.buf[:2])
+			default:
+				e.writeByte(rdbLenEncoded<<6 | rdbEncInt32)
+				binary.LittleEndian.PutUint32(e.buf[:4], uint32(n))
+				e.write(e.buf[:4])
+			}
+			return
+		}
+	}
+	if len(s) > 20 {
+		if c := lzfCompress(s); c != nil {
+			e.writeByte(rdbLenEncoded<<6 | rdbEncLZF)
+			e.writeLength(uint64(len(c)))
+			e.writeLength(uint64(len(s)))
+			e.write(c)
+			return
+		}
+	}
+	e.writeLength(uint64(len(s)))
+	e.write(s)
+}
+
+// rdbType returns the type a value is written as
+func rdbType(value interface{}) byte {
+	switch value.(type) {
+	case map[string][]byte:
+		return rdbTypeHash
+	case *list.List:
+		return rdbTypeList
+	case map[string]struct{}:
+		return rdbTypeSet
+	case *zset:
+		return rdbTypeZSet2
+	}
+	return rdbTypeString
+}
+
+// writeValue writes a value in the encoding of its rdbType
+func (e *rdbEncoder) writeValue(value interface{}) {
+	switch v := value.(type) {
+	case []byte:
+		e.writeString(v)
+	case map[string][]byte:
+		e.writeLength(uint64(len(v)))
+		for vk, vv := range v {
+			e.writeString([]byte(vk))
+			e.writeString(vv)
+		}
+	case *list.List:
+		e.writeLength(uint64(v.Len()))
+		for ele := v.Front(); ele != nil; ele = ele.Next() {
+			e.writeString(ele.Value.([]byte))
+		}
+	case map[string]struct{}:
+		e.writeLength(uint64(len(v)))
+		for m := range v {
+			e.writeString([]byte(m))
+		}
+	case *zset:
+		e.writeLength(uint64(len(v.dict)))
+		for x := v.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			e.writeString([]byte(x.member))
+			binary.LittleEndian.PutUint64(e.buf[:], math.Float64bits(x.score))
+			e.write(e.buf[:])
+		}
+	}
+}
+
+func (e *rdbEncoder) writeAux(key, value string) {
+	e.writeByte(rdbOpAux)
+	e.writeString([]byte(key))
+	e.writeString([]byte(value))
+}
+
+// writeRDB writes the entries of each database to w
+func writeRDB(w io.Writer, dbs [][]*entry) error {
+	e := newRDBEncoder(w)
+	e.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion)))
+	e.writeAux("redis-bits", strconv.Itoa(strconv.IntSize))
+	e.writeAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	for i, entries := range dbs {
+		if len(entries) == 0 {
+			continue
+		}
+		e.writeByte(rdbOpSelectDB)
+		e.writeLength(uint64(i))
+		expires := 0
+		for _, kv := range entries {
+			if kv.expire != nilTime {
+				expires++
+			}
+		}
+		e.writeByte(rdbOpResizeDB)
+		e.writeLength(uint64(len(entries)))
+		e.writeLength(uint64(expires))
+		for _, kv := range entries {
+			if kv.expire != nilTime {
+				e.writeByte(rdbOpExpireMs)
+				binary.LittleEndian.PutUint64(e.buf[:], uint64(fromTime(kv.expire, time.Millisecond)))
+				e.write(e.buf[:])
+			}
+			e.writeByte(rdbType(kv.value))
+			e.writeString([]byte(kv.key))
+			e.writeValue(kv.value)
+		}
+	}
+	e.writeByte(rdbOpEOF)
+	binary.LittleEndian.PutUint64(e.buf[:], e.crc.Sum64())
+	e.bw.Write(e.buf[:])
+	return e.bw.Flush()
+}
+
+// WriteRDB writes the databases to w in the RDB format of redis, dbs[i]
+// being database i.
+func WriteRDB(w io.Writer, dbs []*Cache) error {
+	entries := make([][]*entry, len(dbs))
+	for i, db := range dbs {
+		entries[i] = db.entries()
+	}
+	return writeRDB(w, entries)
+}
+
+// writeRDBFile writes the file to a temporary file first, so that path
+// always holds a complete one.
+func writeRDBFile(path string, dbs [][]*entry) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = writeRDB(f, dbs); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+//------------------------------------------------------------------------------
+
+type rdbDecoder struct {
+	br  *bufio.Reader
+	crc crc64Jones
+}
+
+func newRDBDecoder(r io.Reader) *rdbDecoder {
+	return &rdbDecoder{br: bufio.NewReader(r)}
+}
+
+func (d *rdbDecoder) ReadByte() (byte, error) {
+	b, err := d.br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (d *rdbDecoder) read(n uint64) ([]byte, error) {
+	// do not trust n for the allocation
+	p := make([]byte, 0, minUint64(n, 4096))
+	for uint64(len(p)) < n {
+		chunk := make([]byte, minUint64(n-uint64(len(p)), 4096))
+		if _, err := io.ReadFull(d.br, chunk); err != nil {
+			return nil, invalidRDB
+		}
+		p = append(p, chunk...)
+	}
+	d.crc.Write(p)
+	return p, nil
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// readLength returns a length, or the string encoding if encoded is set
+func (d *rdbDecoder) readLength() (n uint64, encoded bool, err error) {
+	b, err := d.ReadByte()
+	if err != nil {
+		return 0, false, invalidRDB
+	}
+	switch {
+	case b>>6 == rdbLen6Bit:
+		return uint64(b & 0x3f), false, nil
+	case b>>6 == rdbLen14Bit:
+		b2, err := d.ReadByte()
+		if err != nil {
+			return 0, false, invalidRDB
+		}
+		return uint64(b&0x3f)<<8 | uint64(b2), false, nil
+	case b>>6 == rdbLenEncoded:
+		return uint64(b & 0x3f), true, nil
+	case b == rdbLen32Bit:
+		p, err := d.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case b == rdbLen64Bit:
+		p, err := d.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, invalidRDB
+}
+
+func (d *rdbDecoder) readLen() (uint64, error) {
+	n, encoded, err := d.readLength()
+	if err == nil && encoded {
+		err = invalidRDB
+	}
+	return n, err
+}
+
+func (d *rdbDecoder) readString() ([]byte, error) {
+	n, encoded, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return d.read(n)
+	}
+
+	switch n {
+	case rdbEncInt8:
+		p, err := d.read(1)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int8(p[0])))), nil
+	case rdbEncInt16:
+		p, err := d.read(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(p))))), nil
+	case rdbEncInt32:
+		p, err := d.read(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(p))))), nil
+	case rdbEncLZF:
+		clen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		p, err := d.read(clen)
+		if err != nil {
+			return nil, err
+		}
+		if ulen > math.MaxInt32 {
+			return nil, invalidRDB
+		}
+		return lzfDecompress(p, int(ulen))
+	}
+	return nil, invalidRDB
+}
+
+// readScore reads a score of the old zset type, a string with a one
+// byte length where 253 to 255 stand for nan, inf and -inf.
+func (d *rdbDecoder) readScore() (float64, error) {
+	b, err := d.ReadByte()
+	if err != nil {
+		return 0, invalidRDB
+	}
+	switch b {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	p, err := d.read(uint64(b))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(p), 64)
+}
+
+// readStrings reads the strings of the plain list and set types
+func (d *rdbDecoder) readStrings() (ss [][]byte, err error) {
+	n, err := d.readLen()
+	if err != nil {
+		return
+	}
+	for i := uint64(0); i < n; i++ {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+	return
+}
+
+// readPacked reads a ziplist, listpack, intset or zipmap stored as a
+// string and returns its elements.
+func (d *rdbDecoder) readPacked(parse func([]byte) ([][]byte, error)) ([][]byte, error) {
+	p, err := d.readString()
+	if err != nil {
+		return nil, err
+	}
+	return parse(p)
+}
+
+// readValue reads a value of type typ
+func (d *rdbDecoder) readValue(typ byte) (value interface{}, err error) {
+	var items [][]byte
+	switch typ {
+	case rdbTypeString:
+		return d.readString()
+
+	case rdbTypeList:
+		if items, err = d.readStrings(); err != nil {
+			return
+		}
+		return newList(items), nil
+	case rdbTypeZiplist:
+		if items, err = d.readPacked(ziplistEntries); err != nil {
+			return
+		}
+		return newList(items), nil
+	case rdbTypeQuick, rdbTypeQuick2:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < n; i++ {
+			container := uint64(quicklistPacked)
+			if typ == rdbTypeQuick2 {
+				if container, err = d.readLen(); err != nil {
+					return nil, err
+				}
+			}
+			p, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case typ == rdbTypeQuick:
+				p, err := ziplistEntries(p)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, p...)
+			case container == quicklistPlain:
+				items = append(items, p)
+			case container == quicklistPacked:
+				p, err := listpackEntries(p)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, p...)
+			default:
+				return nil, invalidRDB
+			}
+		}
+		return newList(items), nil
+
+	case rdbTypeSet:
+		items, err = d.readStrings()
+	case rdbTypeIntset:
+		items, err = d.readPacked(intsetEntries)
+	case rdbTypeSetLP:
+		items, err = d.readPacked(listpackEntries)
+
+	case rdbTypeHash:
+		var n uint64
+		if n, err = d.readLen(); err != nil {
+			return
+		}
+		for i := uint64(0); i < n*2; i++ {
+			s, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, s)
+		}
+		return newHash(items)
+	case rdbTypeZipmap:
+		if items, err = d.readPacked(zipmapEntries); err != nil {
+			return
+		}
+		return newHash(items)
+	case rdbTypeHashZip:
+		if items, err = d.readPacked(ziplistEntries); err != nil {
+			return
+		}
+		return newHash(items)
+	case rdbTypeHashLP:
+		if items, err = d.readPacked(listpackEntries); err != nil {
+			return
+		}
+		return newHash(items)
+
+	case rdbTypeZSet, rdbTypeZSet2:
+		n, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		zs := newZset()
+		for i := uint64(0); i < n; i++ {
+			m, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if typ == rdbTypeZSet {
+				if score, err = d.readScore(); err != nil {
+					return nil, invalidRDB
+				}
+			} else {
+				p, err := d.read(8)
+				if err != nil {
+					return nil, err
+				}
+				score = math.Float64frombits(binary.LittleEndian.Uint64(p))
+			}
+			if !zs.add(string(m), score) {
+				return nil, invalidRDB
+			}
+		}
+		return zs, nil
+	case rdbTypeZSetZip, rdbTypeZSetLP:
+		parse := ziplistEntries
+		if typ == rdbTypeZSetLP {
+			parse = listpackEntries
+		}
+		if items, err = d.readPacked(parse); err != nil {
+			return
+		}
+		if len(items)%2 != 0 {
+			return nil, invalidRDB
+		}
+		zs := newZset()
+		for i := 0; i < len(items); i += 2 {
+			score, err := strconv.ParseFloat(string(items[i+1]), 64)
+			if err != nil || !zs.add(string(items[i]), score) {
+				return nil, invalidRDB
+			}
+		}
+		return zs, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported rdb value type %d", typ)
+	}
+
+	// sets
+	if err != nil {
+		return
+	}
+	set := make(map[string]struct{}, len(items))
+	for _, m := range items {
+		set[string(m)] = struct{}{}
+	}
+	return set, nil
+}
+
+func newList(items [][]byte) *list.List {
+	l := list.New()
+	for _, v := range items {
+		l.PushBack(v)
+	}
+	return l
+}
+
+// newHash builds a hash from alternating fields and values
+func newHash(items [][]byte) (map[string][]byte, error) {
+	if len(items)%2 != 0 {
+		return nil, invalidRDB
+	}
+	h := make(map[string][]byte, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		h[string(items[i])] = items[i+1]
+	}
+	return h, nil
+}
+
+// ReadRDB loads an RDB file of redis into dbs, database i of the file
+// going to dbs[i]. Keys that have expired are skipped.
+func ReadRDB(r io.Reader, dbs []*Cache) error {
+	d := newRDBDecoder(r)
+	header, err := d.read(9)
+	if err != nil || string(header[:5]) != "REDIS" {
+		return invalidRDB
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil {
+		return invalidRDB
+	}
+	if version < 1 || version > rdbMaxVersion {
+		return fmt.Errorf("unsupported rdb version %d", version)
+	}
+
+	var db *Cache
+	expire := nilTime
+	now := time.Now()
+	for {
+		op, err := d.ReadByte()
+		if err != nil {
+			return invalidRDB
+		}
+		switch op {
+		case rdbOpEOF:
+			if version < 5 {
+				return nil
+			}
+			sum := d.crc.Sum64()
+			p := make([]byte, 8)
+			if _, err := io.ReadFull(d.br, p); err != nil {
+				return invalidRDB
+			}
+			// a zero checksum means it was disabled
+			if v := binary.LittleEndian.Uint64(p); v != 0 && v != sum {
+				return errors.New("wrong rdb checksum")
+			}
+			return nil
+		case rdbOpSelectDB:
+			i, err := d.readLen()
+			if err != nil {
+				return err
+			}
+			if i >= uint64(len(dbs)) {
+				return fmt.Errorf("rdb database %d is out of range", i)
+			}
+			db = dbs[i]
+		case rdbOpResizeDB:
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+		case rdbOpSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := d.readLen(); err != nil {
+					return err
+				}
+			}
+		case rdbOpAux:
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+			if _, err := d.readString(); err != nil {
+				return err
+			}
+		case rdbOpIdle:
+			if _, err := d.readLen(); err != nil {
+				return err
+			}
+		case rdbOpFreq:
+			if _, err := d.ReadByte(); err != nil {
+				return invalidRDB
+			}
+		case rdbOpExpire:
+			p, err := d.read(4)
+			if err != nil {
+				return err
+			}
+			expire = time.Unix(int64(binary.LittleEndian.Uint32(p)), 0)
+		case rdbOpExpireMs:
+			p, err := d.read(8)
+			if err != nil {
+				return err
+			}
+			expire = toTimeMs(int64(binary.LittleEndian.Uint64(p)))
+		default:
+			if db == nil {
+				// files without any SELECTDB are for database 0
+				if len(dbs) == 0 {
+					return invalidRDB
+				}
+				db = dbs[0]
+			}
+			key, err := d.readString()
+			if err != nil {
+				return err
+			}
+			value, err := d.readValue(op)
+			if err != nil {
+				return err
+			}
+			if expire == nilTime || expire.After(now) {
+				db.load(string(key), value, expire)
+			}
+			expire = nilTime
+		}
+	}
+}
+
+func toTimeMs(ms int64) time.Time {
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+}
+
+// readRDBFile loads the file at path, a missing file is not an error.
+// Snapshots in the format written before RDB files are loaded as well.
+func readRDBFile(path string, dbs []*Cache) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if magic, _ := br.Peek(len(snapshotMagic)); string(magic) == snapshotMagic {
+		return readSnapshot(br, dbs)
+	}
+	return ReadRDB(br, dbs)
+}
+
+//------------------------------------------------------------------------------
+// DUMP payloads are a value with its type as in RDB files, followed by the
+// RDB version as 2 bytes and the CRC-64 of everything before it.
+
+var (
+	invalidPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+	badDataFormat  = errors.New("ERR Bad data format")
+)
+
+// dumpValue serializes a value in the DUMP format
+func dumpValue(value interface{}) []byte {
+	buf := new(bytes.Buffer)
+	e := newRDBEncoder(buf)
+	e.writeByte(rdbType(value))
+	e.writeValue(value)
+	binary.LittleEndian.PutUint16(e.buf[:2], rdbVersion)
+	e.write(e.buf[:2])
+	binary.LittleEndian.PutUint64(e.buf[:], e.crc.Sum64())
+	e.bw.Write(e.buf[:])
+	e.bw.Flush()
+	return buf.Bytes()
+}
+
+// restoreValue parses a DUMP payload
+func restoreValue(payload []byte) (interface{}, error) {
+	if len(payload) < 11 {
+		return nil, invalidPayload
+	}
+	footer := payload[len(payload)-10:]
+	if binary.LittleEndian.Uint16(footer) > rdbMaxVersion {
+		return nil, invalidPayload
+	}
+	var crc crc64Jones
+	crc.Write(payload[:len(payload)-8])
+	if crc.Sum64() != binary.LittleEndian.Uint64(footer[2:]) {
+		return nil, invalidPayload
+	}
+
+	d := newRDBDecoder(bytes.NewReader(payload[:len(payload)-10]))
+	typ, err := d.ReadByte()
+	if err != nil {
+		return nil, badDataFormat
+	}
+	value, err := d.readValue(typ)
+	if err != nil {
+		return nil, badDataFormat
+	}
+	// the value must use the whole payload
+	if _, err := d.ReadByte(); err != io.EOF {
+		return nil, badDataFormat
+	}
+	return value, nil
+}
+
+//------------------------------------------------------------------------------
+// the compact encodings redis uses for small values
+
+// ziplistEntries returns the elements of a ziplist, integers in their
+// decimal form.
+func ziplistEntries(zl []byte) (items [][]byte, err error) {
+	// zlbytes, zltail and zllen come first
+	p := 10
+	for {
+		if p >= len(zl) {
+			return nil, invalidRDB
+		}
+		if zl[p] == 0xff {
+			return
+		}
+		// skip the length of the previous entry
+		if zl[p] < 254 {
+			p++
+		} else {
+			p += 5
+		}
+		if p >= len(zl) {
+			return nil, invalidRDB
+		}
+
+		enc := zl[p]
+		var l, size int
+		var n int64
+		switch {
+		case enc>>6 == 0:
+			l, size = int(enc&0x3f), 1
+		case enc>>6 == 1:
+			if p+1 >= len(zl) {
+				return nil, invalidRDB
+			}
+			l, size = int(enc&0x3f)<<8|int(zl[p+1]), 2
+		case enc>>6 == 2:
+			if p+5 > len(zl) {
+				return nil, invalidRDB
+			}
+			l, size = int(binary.BigEndian.Uint32(zl[p+1:])), 5
+		case enc == 0xc0:
+			size = 3
+		case enc == 0xd0:
+			size = 5
+		case enc == 0xe0:
+			size = 9
+		case enc == 0xf0:
+			size = 4
+		case enc == 0xfe:
+			size = 2
+		case enc >= 0xf1 && enc <= 0xfd:
+			n, size = int64(enc&0x0f)-1, 1
+		default:
+			return nil, invalidRDB
+		}
+		if l < 0 || p+size+l > len(zl) {
+			return nil, invalidRDB
+		}
+
+		if enc>>6 < 3 {
+			items = append(items, zl[p+size:p+size+l])
+			p += size + l
+			continue
+		}
+		b := zl[p+1 : p+size]
+		switch enc {
+		case 0xc0:
+			n = int64(int16(binary.LittleEndian.Uint16(b)))
+		case 0xd0:
+			n = int64(int32(binary.LittleEndian.Uint32(b)))
+		case 0xe0:
+			n = int64(binary.LittleEndian.Uint64(b))
+		case 0xf0:
+			n = int64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8)
+		case 0xfe:
+			n = int64(int8(b[0]))
+		}
+		items = append(items, []byte(strconv.FormatInt(n, 10)))
+		p += size
+	}
+}
+
+// listpackEntries returns the elements of a listpack, integers in their
+// decimal form.
+func listpackEntries(lp []byte) (items [][]byte, err error) {
+	// total bytes and number of elements come first
+	p := 6
+	for {
+		if p >= len(lp) {
+			return nil, invalidRDB
+		}
+		b := lp[p]
+		if b == 0xff {
+			return
+		}
+
+		var start, l, size int
+		var n int64
+		isInt := true
+		need := func(k int) bool {
+			return p+k <= len(lp)
+		}
+		switch {
+		case b&0x80 == 0:
+			n, size = int64(b&0x7f), 1
+		case b&0xc0 == 0x80:
+			isInt, start, l = false, 1, int(b&0x3f)
+		case b&0xe0 == 0xc0:
+			if !need(2) {
+				return nil, invalidRDB
+			}
+			n, size = int64(b&0x1f)<<8|int64(lp[p+1]), 2
+			if n >= 1<<12 {
+				n -= 1 << 13
+			}
+		case b&0xf0 == 0xe0:
+			if !need(2) {
+				return nil, invalidRDB
+			}
+			isInt, start, l = false, 2, int(b&0x0f)<<8|int(lp[p+1])
+		case b == 0xf0:
+			if !need(5) {
+				return nil, invalidRDB
+			}
+			isInt, start, l = false, 5, int(binary.LittleEndian.Uint32(lp[p+1:]))
+		case b == 0xf1:
+			size = 3
+		case b == 0xf2:
+			size = 4
+		case b == 0xf3:
+			size = 5
+		case b == 0xf4:
+			size = 9
+		default:
+			return nil, invalidRDB
+		}
+		if !isInt {
+			size = start + l
+		}
+		if l < 0 || !need(size) {
+			return nil, invalidRDB
+		}
+
+		switch {
+		case !isInt:
+			items = append(items, lp[p+start:p+size])
+		case b == 0xf1:
+			n = int64(int16(binary.LittleEndian.Uint16(lp[p+1:])))
+		case b == 0xf2:
+			n = int64(int32(uint32(lp[p+1])<<8|uint32(lp[p+2])<<16|uint32(lp[p+3])<<24) >> 8)
+		case b == 0xf3:
+			n = int64(int32(binary.LittleEndian.Uint32(lp[p+1:])))
+		case b == 0xf4:
+			n = int64(binary.LittleEndian.Uint64(lp[p+1:]))
+		}
+		if isInt {
+			items = append(items, []byte(strconv.FormatInt(n, 10)))
+		}
+		p += size + listpackBacklen(size)
+	}
+}
+
+// listpackBacklen returns how many bytes encode the length of an entry
+// of size bytes after it
+func listpackBacklen(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// intsetEntries returns the integers of an intset in decimal form
+func intsetEntries(is []byte) (items [][]byte, err error) {
+	if len(is) < 8 {
+		return nil, invalidRDB
+	}
+	enc := int(binary.LittleEndian.Uint32(is))
+	n := int(binary.LittleEndian.Uint32(is[4:]))
+	if (enc != 2 && enc != 4 && enc != 8) || n < 0 || 8+n*enc != len(is) {
+		return nil, invalidRDB
+	}
+	for i := 0; i < n; i++ {
+		b := is[8+i*enc:]
+		var v int64
+		switch enc {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(b)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(b)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(b))
+		}
+		items = append(items, []byte(strconv.FormatInt(v, 10)))
+	}
+	return
+}
+
+// zipmapEntries returns the alternating fields and values of a zipmap,
+// the hash encoding of redis before 2.6
+func zipmapEntries(zm []byte) (items [][]byte, err error) {
+	p := 1 // number of entries, not reliable
+	readLen := func() (int, bool) {
+		if p >= len(zm) || zm[p] == 0xff {
+			return 0, false
+		}
+		if zm[p] < 254 {
+			p++
+			return int(zm[p-1]), true
+		}
+		if p+5 > len(zm) {
+			return 0, false
+		}
+		p += 5
+		return int(binary.LittleEndian.Uint32(zm[p-4:])), true
+	}
+	for {
+		if p >= len(zm) {
+			return nil, invalidRDB
+		}
+		if zm[p] == 0xff {
+			return
+		}
+		kl, ok := readLen()
+		if !ok || kl < 0 || p+kl > len(zm) {
+			return nil, invalidRDB
+		}
+		items = append(items, zm[p:p+kl])
+		p += kl
+		vl, ok := readLen()
+		// one byte of free space follows the length
+		if !ok || vl < 0 || p+1+vl > len(zm) {
+			return nil, invalidRDB
+		}
+		free := int(zm[p])
+		p++
+		items = append(items, zm[p:p+vl])
+		p += vl + free
+	}
+}
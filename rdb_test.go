@@ -0,0 +1,290 @@
+package toyredis
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRDB(t *testing.T) {
+	src := []*Cache{NewCache(MB), NewCache(MB)}
+	src[0].Set("str", []byte("foo"))
+	src[0].Expire("str", 10000)
+	src[0].Set("gone", []byte("bar"))
+	src[0].Expire("gone", 10)
+	src[0].Set("int", []byte("-12345"))
+	src[0].Set("long", []byte(strings.Repeat("abc", 100)))
+	src[0].HSet("hash", "k", []byte("v"))
+	src[1].RPush("list", [][]byte{[]byte("a"), []byte("b")})
+	src[1].SAdd("set", []string{"a", "b"})
+	src[1].ZAdd("zset", ZAddOptions{}, []ZMember{{"a", 1.5}, {"b", -2}})
+
+	buf := new(bytes.Buffer)
+	if err := WriteRDB(buf, src); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if bytes.Contains(data, []byte("abcabcabc")) {
+		t.Fatal("long strings should be compressed.")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	dst := []*Cache{NewCache(MB), NewCache(MB)}
+	if err := ReadRDB(bytes.NewReader(data), dst); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := dst[0].Get("str"); string(v) != "foo" {
+		t.Fatalf("expected foo, got %s", v)
+	}
+	if at, _ := dst[0].ExpireTime("str"); at == nilTime {
+		t.Fatal("expire should be kept.")
+	}
+	if dst[0].Exists("gone") != 0 {
+		t.Fatal("expired keys should not be loaded.")
+	}
+	if v, _ := dst[0].Get("int"); string(v) != "-12345" {
+		t.Fatalf("expected -12345, got %s", v)
+	}
+	if v, _ := dst[0].Get("long"); string(v) != strings.Repeat("abc", 100) {
+		t.Fatalf("bad long string %s", v)
+	}
+	if v, _ := dst[0].HGet("hash", "k"); string(v) != "v" {
+		t.Fatalf("expected v, got %s", v)
+	}
+	if v, _ := dst[1].LRange("list", 0, -1); fmt.Sprintf("%s", v) != "[a b]" {
+		t.Fatalf("expected [a b], got %s", v)
+	}
+	if n, _ := dst[1].SCard("set"); n != 2 {
+		t.Fatalf("expected 2 members, got %d", n)
+	}
+	if members, _ := dst[1].ZRange("zset", 0, -1, false); fmt.Sprint(members) != "[{b -2} {a 1.5}]" {
+		t.Fatalf("bad zset %v", members)
+	}
+	if dst[1].GetSize() != src[1].GetSize() {
+		t.Fatalf("expected size %d, got %d", src[1].GetSize(), dst[1].GetSize())
+	}
+
+	for _, i := range []int{3, len(data) / 2, len(data) - 9, len(data) - 1} {
+		corrupted := append([]byte(nil), data...)
+		corrupted[i] ^= 0xff
+		if err := ReadRDB(bytes.NewReader(corrupted), []*Cache{NewCache(MB), NewCache(MB)}); err == nil {
+			t.Fatalf("byte %d was corrupted without an error", i)
+		}
+	}
+	if err := ReadRDB(bytes.NewReader(data[:len(data)-5]), dst); err != invalidRDB {
+		t.Fatalf("expected %v for a truncated file, got %v", invalidRDB, err)
+	}
+
+	for _, c := range append(src, dst...) {
+		c.Stop()
+	}
+}
+
+// the files in testdata were written by redis
+func TestRDBFromRedis(t *testing.T) {
+	load := func(name string) []*Cache {
+		f, err := os.Open("testdata/" + name + ".rdb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		dbs := []*Cache{NewCache(MB), NewCache(MB), NewCache(MB)}
+		if err = ReadRDB(f, dbs); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return dbs
+	}
+	str := func(db *Cache, key string) string {
+		v, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
+	hash := func(db *Cache, key string) map[string]string {
+		v, err := db.HGetAll(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := make(map[string]string)
+		for i := 0; i < len(v); i += 2 {
+			h[string(v[i])] = string(v[i+1])
+		}
+		return h
+	}
+	lrange := func(db *Cache, key string) string {
+		v, err := db.LRange(key, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%s", v)
+	}
+	smembers := func(db *Cache, key string) string {
+		v, err := db.SMembers(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss := make([]string, len(v))
+		for i := range v {
+			ss[i] = string(v[i])
+		}
+		sort.Strings(ss)
+		return fmt.Sprint(ss)
+	}
+
+	dbs := load("multiple_databases")
+	if str(dbs[0], "key_in_zeroth_database") != "zero" || str(dbs[2], "key_in_second_database") != "second" {
+		t.Fatal("multiple_databases failed")
+	}
+	if dbs = load("integer_keys"); str(dbs[0], "-183358245") != "Negative 32 bit integer" || str(dbs[0], "125") != "Positive 8 bit integer" {
+		t.Fatal("integer_keys failed")
+	}
+	if dbs = load("easily_compressible_string_key"); str(dbs[0], strings.Repeat("a", 200)) != "Key that redis should compress easily" {
+		t.Fatal("easily_compressible_string_key failed")
+	}
+	for _, name := range []string{"zipmap_that_compresses_easily", "hash_as_ziplist"} {
+		dbs = load(name)
+		if h := hash(dbs[0], "zipmap_compresses_easily"); h["a"] != "aa" || h["aaaaa"] != "aaaaaaaaaaaaaa" || len(h) != 3 {
+			t.Fatalf("%s failed, got %v", name, h)
+		}
+	}
+	dbs = load("ziplist_with_integers")
+	if l := lrange(dbs[0], "ziplist_with_integers"); l != "[0 1 2 3 4 5 6 7 8 9 10 11 12 -2 13 25 -61 63 16380 -16000 65535 -65523 4194304 9223372036854775807]" {
+		t.Fatalf("ziplist_with_integers failed, got %s", l)
+	}
+	dbs = load("ziplist_that_compresses_easily")
+	if l := lrange(dbs[0], "ziplist_compresses_easily"); !strings.HasPrefix(l, "[aaaaaa aaaaaaaaaaaa ") {
+		t.Fatalf("ziplist_that_compresses_easily failed, got %s", l)
+	}
+	if dbs = load("rdb_v7_list_quicklist"); lrange(dbs[0], "foo") != "[bar baz boo]" {
+		t.Fatal("rdb_v7_list_quicklist failed")
+	}
+	if dbs = load("intset_16"); smembers(dbs[0], "intset_16") != "[32764 32765 32766]" {
+		t.Fatal("intset_16 failed")
+	}
+	if dbs = load("intset_64"); smembers(dbs[0], "intset_64") != "[9223090557583032316 9223090557583032317 9223090557583032318]" {
+		t.Fatal("intset_64 failed")
+	}
+	if dbs = load("regular_set"); smembers(dbs[0], "regular_set") != "[alpha beta delta gamma kappa phi]" {
+		t.Fatal("regular_set failed")
+	}
+	dbs = load("sorted_set_as_ziplist")
+	if score, _, _ := dbs[0].ZScore("sorted_set_as_ziplist", "cb7a24bb7528f934b841b34c3a73e0c7"); score != 2.37 {
+		t.Fatalf("sorted_set_as_ziplist failed, got %v", score)
+	}
+	if dbs = load("regular_sorted_set"); dbs[0].DBSize() != 1 {
+		t.Fatal("regular_sorted_set failed")
+	}
+	if n, _ := dbs[0].ZCard("force_sorted_set"); n <= 128 {
+		t.Fatalf("regular_sorted_set failed, got %d members", n)
+	}
+	if dbs = load("rdb_version_5_with_checksum"); str(dbs[0], "longerstring") != "thisisalongerstring.idontknowwhatitmeans" {
+		t.Fatal("rdb_version_5_with_checksum failed")
+	}
+}
+
+func TestListpack(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	entries := []byte{0x80 | 5, 'f', 'i', 'e', 'l', 'd', 6}
+	entries = append(entries, 12, 1)                  // 7 bit uint
+	entries = append(entries, 0xdf, 0x9c, 2)          // 13 bit int
+	entries = append(entries, 0xf2, 0xa0, 0x86, 1, 4) // 24 bit int
+	entries = append(entries, 0xe0, 100)              // 12 bit string
+	entries = append(entries, long...)
+	entries = append(entries, 102)
+	lp := append([]byte{0, 0, 0, 0, 5, 0}, entries...)
+	lp = append(lp, 0xff)
+
+	items, err := listpackEntries(lp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprintf("%s", items); s != "[field 12 -100 100000 "+long+"]" {
+		t.Fatalf("bad entries %s", s)
+	}
+	if _, err = listpackEntries(lp[:len(lp)-3]); err != invalidRDB {
+		t.Fatalf("expected %v, got %v", invalidRDB, err)
+	}
+}
+
+func TestCRC64(t *testing.T) {
+	var crc crc64Jones
+	crc.Write([]byte("123456789"))
+	if crc.Sum64() != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("bad crc %x", crc.Sum64())
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	lru := NewCache(MB)
+	lru.Set("num", []byte("10"))
+	lru.ZAdd("zset", ZAddOptions{}, []ZMember{{"a", 1}, {"b", 2}})
+
+	// the payload redis 5 to 6 return for the same value
+	if p := lru.Dump("num"); string(p) != "\x00\xc0\n\t\x00\xbem\x06\x89Z(\x00\n" {
+		t.Fatalf("bad payload %q", p)
+	}
+	if p := lru.Dump("none"); p != nil {
+		t.Fatalf("expected nil, got %q", p)
+	}
+
+	p := lru.Dump("zset")
+	if err := lru.Restore("zset", p, RestoreOptions{}); err != busyKey {
+		t.Fatalf("expected %v, got %v", busyKey, err)
+	}
+	expire := time.Now().Add(time.Minute)
+	if err := lru.Restore("zset2", p, RestoreOptions{Expire: expire}); err != nil {
+		t.Fatal(err)
+	}
+	if members, _ := lru.ZRange("zset2", 0, -1, false); fmt.Sprint(members) != "[{a 1} {b 2}]" {
+		t.Fatalf("bad members %v", members)
+	}
+	if at, _ := lru.ExpireTime("zset2"); !at.Equal(expire) {
+		t.Fatalf("expected %v, got %v", expire, at)
+	}
+	if err := lru.Restore("num", p, RestoreOptions{Replace: true, Expire: time.Now().Add(-time.Second)}); err != nil || lru.Exists("num") != 0 {
+		t.Fatal("a past expire should only delete the key.")
+	}
+
+	for _, bad := range [][]byte{p[:len(p)-1], append([]byte{0x7f}, p[1:]...)} {
+		if err := lru.Restore("bad", bad, RestoreOptions{}); err != invalidPayload {
+			t.Fatalf("expected %v, got %v", invalidPayload, err)
+		}
+	}
+	// idle keys are evicted before the ones accessed since
+	lru.Restore("idle", p, RestoreOptions{IdleTime: time.Hour})
+	lru.Restore("idle2", p, RestoreOptions{IdleTime: time.Minute})
+	if lru.ll.Back().Value.(*entry).key != "idle" || lru.ll.Back().Prev().Value.(*entry).key != "idle2" {
+		t.Fatal("restored keys should be ordered by idle time.")
+	}
+	lru.Stop()
+
+	server := NewServerWithConfig(Config{Port: "6795", SizeLimit: MB})
+	defer server.Stop()
+	replies := sendCommands(t, "6795",
+		[]string{"rpush", "list", "a", "b"},
+		[]string{"dump", "list"},
+	)
+	replies = sendCommands(t, "6795",
+		[]string{"restore", "list", "0", replies[1]},
+		[]string{"restore", "list", "0", replies[1], "replace", "idletime", "10", "freq", "1"},
+		[]string{"restore", "list", "-1", replies[1]},
+		[]string{"restore", "list2", "100000", replies[1], "idletime", "10"},
+		[]string{"object", "idletime", "list2"},
+		[]string{"lindex", "list2", "1"},
+		[]string{"pttl", "list2"},
+	)
+	if replies[0] != "-BUSYKEY Target key name already exists." || replies[1] != "-ERR syntax error" ||
+		replies[2] != "-ERR Invalid TTL value, must be >= 0" || replies[3] != "+OK" ||
+		replies[4] != ":10" || replies[5] != "b" {
+		t.Fatalf("unexpected replies %v", replies)
+	}
+	if ttl, _ := strconv.Atoi(replies[6][1:]); ttl <= 0 || ttl > 100000 {
+		t.Fatalf("bad ttl %s", replies[6])
+	}
+}
@@ -0,0 +1,364 @@
+package toyredis
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Replication follows redis: a replica sends PSYNC to its master, which
+// replies with FULLRESYNC, an RDB snapshot of its data set as a bulk
+// string, then every write command it propagates in the request format.
+// Offsets count the bytes of that command stream. The keys the master
+// expires or evicts are propagated as DEL, replicas keep their keys until
+// then and do not enforce their memory limit. Expired keys are hidden from
+// their clients meanwhile, only the stream of the master sees them.
+
+var (
+	readOnlyReplica = errors.New("READONLY You can't write against a read only replica.")
+	masterProtocol  = errors.New("unexpected reply from master")
+)
+
+// a replica that lets more than replicaLimit bytes of the stream pile up
+// is dropped, so that it full syncs once it reconnects
+var replicaLimit = 256 * MB
+
+// replica is a connection of a replica to this server, its outbox holds
+// the stream not sent yet
+type replica struct {
+	*outbox
+	// data set sent by the full sync, nil once sent
+	snapshot [][]*entry
+}
+
+func newReplica(snapshot [][]*entry) *replica {
+	return &replica{outbox: newOutbox(replicaLimit), snapshot: snapshot}
+}
+
+// masterLink is the connection of this server to its master
+type masterLink struct {
+	host, port string
+	done       chan struct{}
+
+	// guarded by the replMu of the server
+	conn   net.Conn
+	up     bool
+	offset int64
+}
+
+func newReplID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalln(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// feedReplicas sends commands that were run against database db to the
+// replicas
+func (s *server) feedReplicas(db int, cmds [][]string) {
+	s.replMu.Lock()
+	defer s.replMu.Unlock()
+
+	if len(s.replicas) == 0 {
+		return
+	}
+	buf := new(bytes.Buffer)
+	wr := NewWriter(buf)
+	if db != s.replDB {
+		wr.Request([]string{"select", strconv.Itoa(db)})
+		s.replDB = db
+	}
+	for _, args := range cmds {
+		wr.Request(args)
+	}
+	s.replOffset += int64(buf.Len())
+	for r := range s.replicas {
+		if _, err := r.Write(buf.Bytes()); err != nil {
+			log.Printf("dropping a replica, more than %d bytes of its stream are pending", replicaLimit)
+			delete(s.replicas, r)
+		}
+	}
+}
+
+// dropReplicas disconnects the replicas, their data set no longer matches
+// this one after a full sync with a new master
+func (s *server) dropReplicas() {
+	s.replMu.Lock()
+	defer s.replMu.Unlock()
+
+	for r := range s.replicas {
+		r.close()
+		delete(s.replicas, r)
+	}
+}
+
+func (s *server) handleReplConf(cn *Conn, ss []string) (err error) {
+	if len(ss)%2 != 0 {
+		err = syntaxError
+	} else {
+		// options such as listening-port are accepted but not used
+		cn.wr.Status("OK")
+	}
+	return
+}
+
+// handleSync starts a full sync for SYNC and PSYNC, partial syncs are not
+// supported. The connection is handed over to serveReplica once the reply
+// is flushed.
+func (s *server) handleSync(cn *Conn, ss []string, psync bool) (err error) {
+	// no write can run while this command holds execMu, so the snapshot
+	// matches the point where the stream starts
+	dbs := s.allDBs()
+	entries := make([][]*entry, len(dbs))
+	for i, db := range dbs {
+		entries[i] = db.entries()
+	}
+	r := newReplica(entries)
+
+	s.replMu.Lock()
+	s.replicas[r] = struct{}{}
+	// the stream of the new replica has to start with a SELECT
+	s.replDB = -1
+	id, offset := s.replID, s.replOffset
+	s.replMu.Unlock()
+
+	if psync {
+		cn.wr.Status(fmt.Sprintf("FULLRESYNC %s %d", id, offset))
+	}
+	cn.takeover = func() { s.serveReplica(cn, r) }
+	return
+}
+
+// serveReplica sends the snapshot and then the command stream to replica
+// r on cn until either side closes
+func (s *server) serveReplica(cn *Conn, r *replica) {
+	defer func() {
+		r.close()
+		s.replMu.Lock()
+		delete(s.replicas, r)
+		s.replMu.Unlock()
+	}()
+	// nothing is expected from the replica but its disconnection
+	go func() {
+		io.Copy(io.Discard, cn.rd.rd)
+		r.close()
+	}()
+
+	buf := new(bytes.Buffer)
+	if err := writeRDB(buf, r.snapshot); err != nil {
+		log.Println(err)
+		return
+	}
+	r.snapshot = nil
+	fmt.Fprintf(cn.bw, "$%d\r\n", buf.Len())
+	if _, err := buf.WriteTo(cn.bw); err != nil {
+		return
+	}
+	for {
+		if err := cn.bw.Flush(); err != nil {
+			return
+		}
+		p, ok := r.next()
+		if !ok {
+			return
+		}
+		cn.bw.Write(p)
+	}
+}
+
+// handleReplicaOf makes this server a replica of host:port, or a master
+// again with NO ONE
+func (s *server) handleReplicaOf(cn *Conn, ss []string) (err error) {
+	if strings.ToLower(ss[0]) == "no" && strings.ToLower(ss[1]) == "one" {
+		s.replMu.Lock()
+		if s.master != nil {
+			s.stopMasterLink()
+			// the history of the stream differs from the old master's
+			s.replID = newReplID()
+			s.db(cn).SetPassive(false)
+		}
+		s.replMu.Unlock()
+		cn.wr.Status("OK")
+		return
+	}
+	if _, err = strconv.ParseUint(ss[1], 10, 16); err != nil {
+		return errors.New("ERR Invalid master port")
+	}
+
+	s.replMu.Lock()
+	defer s.replMu.Unlock()
+	if s.master != nil && s.master.host == ss[0] && s.master.port == ss[1] {
+		cn.wr.Status("OK Already connected to specified master")
+		return
+	}
+	if s.master != nil {
+		s.stopMasterLink()
+	}
+	s.master = &masterLink{host: ss[0], port: ss[1], done: make(chan struct{})}
+	// the databases share the setting
+	s.db(cn).SetPassive(true)
+	go s.replicate(s.master)
+	cn.wr.Status("OK")
+	return
+}
+
+// stopMasterLink must be called with replMu held
+func (s *server) stopMasterLink() {
+	close(s.master.done)
+	if s.master.conn != nil {
+		s.master.conn.Close()
+	}
+	s.master = nil
+}
+
+// isReplica tells whether writes from clients are rejected
+func (s *server) isReplica() bool {
+	s.replMu.Lock()
+	defer s.replMu.Unlock()
+
+	return s.master != nil
+}
+
+// replicate keeps syncing with the master of link, retrying every second,
+// until the link is stopped
+func (s *server) replicate(link *masterLink) {
+	for {
+		err := s.syncWithMaster(link)
+		select {
+		case <-link.done:
+			return
+		default:
+		}
+		log.Printf("replication from %s:%s: %v", link.host, link.port, err)
+		select {
+		case <-link.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// syncWithMaster performs a full sync, then applies the command stream
+// of the master until the connection breaks
+func (s *server) syncWithMaster(link *masterLink) error {
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(link.host, link.port), time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	s.replMu.Lock()
+	select {
+	case <-link.done:
+		s.replMu.Unlock()
+		return nil
+	default:
+		link.conn = c
+	}
+	s.replMu.Unlock()
+	defer func() {
+		s.replMu.Lock()
+		link.conn, link.up = nil, false
+		s.replMu.Unlock()
+	}()
+
+	cr := &countingReader{r: c}
+	rd := NewReader(cr)
+	bw := bufio.NewWriter(c)
+	wr := NewWriter(bw)
+	wr.Request([]string{"replconf", "listening-port", s.port})
+	wr.Request([]string{"psync", "?", "-1"})
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	if line, err := rd.readline(); err != nil {
+		return err
+	} else if line[0] != StatusReply {
+		return fmt.Errorf("%w: %s", masterProtocol, line)
+	}
+
+	// +FULLRESYNC <replid> <offset>
+	line, err := rd.readline()
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		return fmt.Errorf("%w: %s", masterProtocol, line)
+	}
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %s", masterProtocol, line)
+	}
+	if line, err = rd.readline(); err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if line[0] != StringReply || err != nil || n < 0 {
+		return fmt.Errorf("%w: %s", masterProtocol, line)
+	}
+	payload := make([]byte, n)
+	if _, err = io.ReadFull(rd.rd, payload); err != nil {
+		return err
+	}
+	if err = s.loadFromMaster(payload); err != nil {
+		return err
+	}
+
+	s.replMu.Lock()
+	link.up, link.offset = true, offset
+	s.replMu.Unlock()
+	// replies are discarded
+	discard := bufio.NewWriter(io.Discard)
+	cn := &Conn{bw: discard, wr: NewWriter(discard), master: true}
+	read := cr.n - int64(rd.rd.Buffered())
+	for {
+		ss, err := rd.ReadRequest()
+		if err != nil {
+			return err
+		}
+		if err = s.call(cn, ss); err != nil {
+			log.Printf("replicated command %s failed: %v", ss[0], err)
+		}
+		n := cr.n - int64(rd.rd.Buffered())
+		s.replMu.Lock()
+		link.offset += n - read
+		s.replMu.Unlock()
+		read = n
+	}
+}
+
+// loadFromMaster replaces the data set with the snapshot of a full sync
+func (s *server) loadFromMaster(payload []byte) error {
+	s.execMu.Lock()
+	defer s.execMu.Unlock()
+
+	dbs := s.allDBs()
+	for _, db := range dbs {
+		db.Flush()
+	}
+	if err := ReadRDB(bytes.NewReader(payload), dbs); err != nil {
+		return err
+	}
+	// keys removed before, the master's data set replaces them
+	s.removedMu.Lock()
+	s.removed = nil
+	s.removedMu.Unlock()
+	s.dropReplicas()
+	if s.aof != nil {
+		// the log does not hold the loaded data set
+		if err := s.rewriteAOF(); err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package toyredis
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitReply sends cmd until its reply is want
+func waitReply(t *testing.T, port string, want string, cmd ...string) {
+	for i := 0; ; i++ {
+		reply := sendCommands(t, port, cmd)[0]
+		if reply == want {
+			return
+		}
+		if i == 100 {
+			t.Fatalf("%v: expected %s, got %s", cmd, want, reply)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	master := NewServerWithConfig(Config{Port: "6796", SizeLimit: 20})
+	defer master.Stop()
+	replica := NewServerWithConfig(Config{Port: "6797", SizeLimit: 20})
+	defer replica.Stop()
+
+	sendCommands(t, "6796",
+		[]string{"set", "foo", "bar"},
+		[]string{"select", "2"},
+		[]string{"rpush", "list", "a", "b"},
+	)
+	sendCommands(t, "6797", []string{"set", "stale", "1"})
+	if reply := sendCommands(t, "6797", []string{"replicaof", "localhost", "6796"})[0]; reply != "+OK" {
+		t.Fatalf("unexpected reply %s", reply)
+	}
+	// full sync
+	waitReply(t, "6797", "bar", "get", "foo")
+	replies := sendCommands(t, "6797",
+		[]string{"exists", "stale"},
+		[]string{"select", "2"},
+		[]string{"lindex", "list", "1"},
+		[]string{"set", "foo", "baz"},
+	)
+	if strings.Join(replies, " ") != ":0 +OK b -READONLY You can't write against a read only replica." {
+		t.Fatalf("unexpected replies %v", replies)
+	}
+
+	// command stream
+	sendCommands(t, "6796",
+		[]string{"select", "2"},
+		[]string{"incr", "counter"},
+		[]string{"set", "ttl", "1", "ex", "100"},
+		[]string{"sadd", "set", "a"},
+		[]string{"spop", "set"},
+	)
+	// the stream is applied in order
+	sendCommands(t, "6796", []string{"del", "foo"})
+	waitReply(t, "6797", "$-1", "get", "foo")
+	replies = sendCommands(t, "6797",
+		[]string{"select", "2"},
+		[]string{"get", "counter"},
+		[]string{"ttl", "ttl"},
+		[]string{"exists", "set"},
+	)
+	if replies[1] != "1" || replies[2] == ":-1" || replies[3] != ":0" {
+		t.Fatalf("unexpected replies %v", replies)
+	}
+
+	// replicas leave expiring keys to their master, which sends a DEL,
+	// and hide them meanwhile
+	sendCommands(t, "6796", []string{"set", "short", "1", "px", "50"})
+	waitReply(t, "6797", "1", "get", "short")
+	master.execMu.Lock()
+	time.Sleep(100 * time.Millisecond)
+	replies = sendCommands(t, "6797", []string{"get", "short"}, []string{"pttl", "short"})
+	kept := replica.allDBs()[0].has("short")
+	master.execMu.Unlock()
+	if strings.Join(replies, " ") != "$-1 :-2" || !kept {
+		t.Fatalf("short should be kept and hidden, got %v, %v", replies, kept)
+	}
+	for i := 0; replica.allDBs()[0].has("short"); i++ {
+		if i == 100 {
+			t.Fatal("short should have been deleted by the master.")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if reply := sendCommands(t, "6797", []string{"replicaof", "no", "one"})[0]; reply != "+OK" {
+		t.Fatalf("unexpected reply %s", reply)
+	}
+	if reply := sendCommands(t, "6797", []string{"set", "foo", "baz"})[0]; reply != "+OK" {
+		t.Fatalf("a former replica should accept writes, got %s", reply)
+	}
+}
+
+func TestSlowReplica(t *testing.T) {
+	defer func(limit int) { replicaLimit = limit }(replicaLimit)
+	replicaLimit = MB
+	server := NewServerWithConfig(Config{Port: "6810", SizeLimit: 100})
+	defer server.Stop()
+
+	// a replica that never reads the stream
+	cn, err := net.Dial("tcp", "localhost:6810")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cn.Close()
+	cn.Write([]byte("*1\r\n$4\r\nsync\r\n"))
+	countReplicas := func() int {
+		server.replMu.Lock()
+		defer server.replMu.Unlock()
+		return len(server.replicas)
+	}
+	for countReplicas() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// its stream piles up until it is dropped
+	value := strings.Repeat("x", MB/2)
+	for i := 0; countReplicas() > 0; i++ {
+		if i == 100 {
+			t.Fatal("the replica should have been dropped.")
+		}
+		sendCommands(t, "6810", []string{"set", "foo", value})
+	}
+}
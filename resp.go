@@ -155,8 +155,14 @@ func (w *Writer) nullString() error {
 	return w.simple(StringReply, []byte{'-', '1'})
 }
 
+// Array writes the header of an array, the caller writes n elements
+// following it.
+func (w *Writer) Array(n int) error {
+	return w.simple(ArrayReply, []byte(strconv.Itoa(n)))
+}
+
 func (w *Writer) StringArray(bs [][]byte) error {
-	if err := w.simple(ArrayReply, []byte(strconv.Itoa(len(bs)))); err != nil {
+	if err := w.Array(len(bs)); err != nil {
 		return err
 	}
 	for _, b := range bs {
@@ -168,6 +174,20 @@ func (w *Writer) StringArray(bs [][]byte) error {
 	return nil
 }
 
+// Request writes a command the way clients send it, as an array of bulk
+// strings.
+func (w *Writer) Request(ss []string) error {
+	if err := w.Array(len(ss)); err != nil {
+		return err
+	}
+	for _, s := range ss {
+		if err := w.String([]byte(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (w *Writer) NullStringArray() error {
 	return w.simple(ArrayReply, []byte{'-', '1'})
 }
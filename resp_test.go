@@ -51,6 +51,26 @@ func TestWriter(t *testing.T) {
 	if string(buf.Bytes()) != expected {
 		t.Fatalf("want %q, got %q", buf.Bytes(), expected)
 	}
+
+	io.ReadAll(buf)
+	wr.Array(2)
+	wr.Int(1)
+	wr.String(nil)
+	expected = "*2\r\n" +
+		":1\r\n" +
+		"$-1\r\n"
+	if string(buf.Bytes()) != expected {
+		t.Fatalf("want %q, got %q", buf.Bytes(), expected)
+	}
+
+	io.ReadAll(buf)
+	wr.Request([]string{"get", "foo"})
+	expected = "*2\r\n" +
+		"$3\r\nget\r\n" +
+		"$3\r\nfoo\r\n"
+	if string(buf.Bytes()) != expected {
+		t.Fatalf("want %q, got %q", buf.Bytes(), expected)
+	}
 }
 
 func TestReader(t *testing.T) {
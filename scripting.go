@@ -0,0 +1,415 @@
+package toyredis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Scripts run in a Lua interpreter with execMu held exclusively, so that no
+// other command runs in between. redis.call and redis.pcall run commands
+// through the same handlers as clients do, and the writes are propagated
+// between a MULTI and an EXEC the way a transaction is, those of the
+// transaction the script runs in if any. Once a script has run for longer
+// than the time limit, other clients are replied BUSY until it returns or
+// SCRIPT KILL stops it, which is only allowed before it writes.
+
+const defaultScriptTimeLimit = 5 * time.Second
+
+var (
+	noScript       = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+	busyScript     = errors.New("BUSY Redis is busy running a script. You can only call SCRIPT KILL.")
+	notBusy        = errors.New("NOTBUSY No scripts in execution right now.")
+	unkillable     = errors.New("UNKILLABLE Sorry the script already executed write commands against the dataset.")
+	scriptKilled   = errors.New("ERR Script killed by user with SCRIPT KILL...")
+	negativeKeys   = errors.New("ERR Number of keys can't be negative")
+	tooManyKeys    = errors.New("ERR Number of keys can't be greater than number of args")
+	notFromScript  = errors.New("ERR This Redis command is not allowed from script")
+	noCallArgument = errors.New("ERR Please specify at least one argument for this redis lib call")
+	badCallArgs    = errors.New("ERR Lua redis lib command arguments must be strings or integers")
+)
+
+// runningScript is the script being run, guarded by scriptMu
+type runningScript struct {
+	// the connection that runs the script
+	caller  *Conn
+	started time.Time
+	cancel  context.CancelFunc
+	wrote   bool
+	killed  bool
+}
+
+// compileScript returns the SHA1 of script and its compiled form
+func compileScript(script string) (string, *lua.FunctionProto, error) {
+	sum := sha1.Sum([]byte(script))
+	chunk, err := parse.Parse(strings.NewReader(script), "user_script")
+	if err != nil {
+		return "", nil, errors.New("ERR Error compiling script: " + oneLine(err.Error()))
+	}
+	proto, err := lua.Compile(chunk, "user_script")
+	if err != nil {
+		return "", nil, errors.New("ERR Error compiling script: " + oneLine(err.Error()))
+	}
+	return hex.EncodeToString(sum[:]), proto, nil
+}
+
+// loadScript compiles script and caches it by its SHA1
+func (s *server) loadScript(script string) (string, *lua.FunctionProto, error) {
+	sha, proto, err := compileScript(script)
+	if err != nil {
+		return "", nil, err
+	}
+	s.scriptMu.Lock()
+	s.scripts[sha] = proto
+	s.scriptMu.Unlock()
+	return sha, proto, nil
+}
+
+// scriptBusy tells whether a script has run past the time limit
+func (s *server) scriptBusy() bool {
+	s.scriptMu.Lock()
+	defer s.scriptMu.Unlock()
+
+	return s.script != nil && time.Since(s.script.started) > s.scriptTimeLimit
+}
+
+// handleEval parses EVAL script numkeys [key ...] [arg ...] and EVALSHA
+// sha1 numkeys [key ...] [arg ...], execMu must be held exclusively
+func (s *server) handleEval(cn *Conn, ss []string, sha bool) (err error) {
+	numKeys, err := strconv.Atoi(ss[1])
+	switch {
+	case err != nil:
+		return notIntError
+	case numKeys < 0:
+		return negativeKeys
+	case numKeys > len(ss)-2:
+		return tooManyKeys
+	}
+
+	var proto *lua.FunctionProto
+	if sha {
+		s.scriptMu.Lock()
+		proto = s.scripts[strings.ToLower(ss[0])]
+		s.scriptMu.Unlock()
+		if proto == nil {
+			return noScript
+		}
+	} else if _, proto, err = s.loadScript(ss[0]); err != nil {
+		return
+	}
+	return s.runScript(cn, proto, ss[2:2+numKeys], ss[2+numKeys:])
+}
+
+func (s *server) runScript(cn *Conn, proto *lua.FunctionProto, keys, args []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rs := &runningScript{caller: cn, started: time.Now(), cancel: cancel}
+	s.scriptMu.Lock()
+	s.script = rs
+	s.scriptMu.Unlock()
+	defer func() {
+		s.scriptMu.Lock()
+		s.script = nil
+		s.scriptMu.Unlock()
+	}()
+
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// no access to the file system
+	L.SetGlobal("dofile", lua.LNil)
+	L.SetGlobal("loadfile", lua.LNil)
+	L.SetGlobal("KEYS", stringTable(L, keys))
+	L.SetGlobal("ARGV", stringTable(L, args))
+
+	// the commands of the script have a connection of their own, so that
+	// SELECT does not change the database of the caller
+	buf := new(bytes.Buffer)
+	bw := bufio.NewWriter(buf)
+	sc := &Conn{bw: bw, wr: NewWriter(bw), db: cn.db}
+	call := func(L *lua.LState, protected bool) int {
+		reply, err := s.scriptCall(L, sc, buf, rs)
+		if err != nil && !protected {
+			L.Error(errorTable(L, err.Error()), 1)
+		}
+		if err != nil {
+			reply = errorTable(L, err.Error())
+		}
+		L.Push(reply)
+		return 1
+	}
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":  func(L *lua.LState) int { return call(L, false) },
+		"pcall": func(L *lua.LState) int { return call(L, true) },
+		"error_reply": func(L *lua.LState) int {
+			L.Push(errorTable(L, L.CheckString(1)))
+			return 1
+		},
+		"status_reply": func(L *lua.LState) int {
+			t := L.NewTable()
+			t.RawSetString("ok", lua.LString(L.CheckString(1)))
+			L.Push(t)
+			return 1
+		},
+	})
+	L.SetGlobal("redis", redis)
+	L.SetContext(ctx)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	err := L.PCall(0, 1, nil)
+
+	s.scriptMu.Lock()
+	killed := rs.killed
+	s.scriptMu.Unlock()
+	if !cn.multi {
+		// otherwise EXEC ends the transaction
+		s.propagateExec(cn)
+	}
+	switch {
+	case killed:
+		return scriptKilled
+	case err != nil:
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			if t, ok := apiErr.Object.(*lua.LTable); ok {
+				if msg, ok := t.RawGetString("err").(lua.LString); ok {
+					return errors.New(oneLine(string(msg)))
+				}
+			}
+			return errors.New("ERR Error running script: " + oneLine(apiErr.Object.String()))
+		}
+		return errors.New("ERR Error running script: " + oneLine(err.Error()))
+	}
+	writeLuaValue(cn.wr, L.Get(-1))
+	return nil
+}
+
+// scriptCall runs the command passed to redis.call or redis.pcall on sc
+// and returns its reply
+func (s *server) scriptCall(L *lua.LState, sc *Conn, buf *bytes.Buffer, rs *runningScript) (lua.LValue, error) {
+	n := L.GetTop()
+	if n == 0 {
+		return nil, noCallArgument
+	}
+	args := make([]string, n)
+	for i := 1; i <= n; i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			args[i-1] = string(v)
+		case lua.LNumber:
+			args[i-1] = v.String()
+		default:
+			return nil, badCallArgs
+		}
+	}
+	cmd := s.lookupCommand(strings.ToLower(args[0]))
+	switch {
+	case cmd == nil:
+		return nil, unsupportedRequest
+	case cmd.flags&FlagNoScript != 0:
+		return nil, notFromScript
+	case !cmd.checkArity(len(args)):
+		return nil, arityError
+	}
+	write := cmd.flags&FlagWrite != 0
+	if write && s.isReplica() {
+		return nil, readOnlyReplica
+	}
+	if write {
+		s.scriptMu.Lock()
+		rs.wrote = true
+		s.scriptMu.Unlock()
+		s.propagateMulti(rs.caller)
+	}
+
+	buf.Reset()
+	if err := s.run(sc, cmd, args); err != nil {
+		return nil, err
+	}
+	sc.bw.Flush()
+	return readLuaValue(L, NewReader(buf))
+}
+
+// readLuaValue converts a reply to a Lua value the way redis does: nil to
+// false, status and error replies to tables with an ok or err field
+func readLuaValue(L *lua.LState, rd *Reader) (lua.LValue, error) {
+	line, err := rd.readline()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case StatusReply:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(line[1:]))
+		return t, nil
+	case ErrorReply:
+		return errorTable(L, string(line[1:])), nil
+	case IntReply:
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		return lua.LNumber(n), err
+	case StringReply:
+		if string(line) == "$-1" {
+			return lua.LFalse, nil
+		}
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(rd.rd, b); err != nil {
+			return nil, err
+		}
+		return lua.LString(b[:n]), nil
+	case ArrayReply:
+		if string(line) == "*-1" {
+			return lua.LFalse, nil
+		}
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		t := L.CreateTable(n, 0)
+		for i := 0; i < n; i++ {
+			v, err := readLuaValue(L, rd)
+			if err != nil {
+				return nil, err
+			}
+			t.Append(v)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// writeLuaValue converts the value a script returns to a reply the way
+// redis does: numbers are truncated to integers, false to nil and arrays
+// stop at their first nil
+func writeLuaValue(wr *Writer, v lua.LValue) {
+	switch v := v.(type) {
+	case lua.LString:
+		wr.String([]byte(v))
+	case lua.LNumber:
+		wr.Int(int(v))
+	case lua.LBool:
+		if v {
+			wr.Int(1)
+		} else {
+			wr.String(nil)
+		}
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			wr.Error(oneLine(string(msg)))
+			return
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			wr.Status(oneLine(string(msg)))
+			return
+		}
+		n := 0
+		for v.RawGetInt(n+1) != lua.LNil {
+			n++
+		}
+		wr.Array(n)
+		for i := 1; i <= n; i++ {
+			writeLuaValue(wr, v.RawGetInt(i))
+		}
+	default:
+		wr.String(nil)
+	}
+}
+
+// oneLine makes msg fit in a status or error reply
+func oneLine(msg string) string {
+	return strings.TrimSpace(strings.NewReplacer("\r", " ", "\n", " ").Replace(msg))
+}
+
+func stringTable(L *lua.LState, ss []string) *lua.LTable {
+	t := L.CreateTable(len(ss), 0)
+	for _, s := range ss {
+		t.Append(lua.LString(s))
+	}
+	return t
+}
+
+func errorTable(L *lua.LState, msg string) *lua.LTable {
+	t := L.NewTable()
+	t.RawSetString("err", lua.LString(msg))
+	return t
+}
+
+// handleScript parses SCRIPT LOAD script, SCRIPT EXISTS sha1 [sha1 ...]
+// and SCRIPT FLUSH [ASYNC|SYNC]. SCRIPT KILL is run by killScript.
+func (s *server) handleScript(cn *Conn, ss []string) (err error) {
+	switch sub := strings.ToLower(ss[0]); {
+	case sub == "load" && len(ss) == 2:
+		var sha string
+		if sha, _, err = s.loadScript(ss[1]); err == nil {
+			cn.wr.String([]byte(sha))
+		}
+	case sub == "exists" && len(ss) >= 2:
+		s.scriptMu.Lock()
+		cn.wr.Array(len(ss) - 1)
+		for _, sha := range ss[1:] {
+			if s.scripts[strings.ToLower(sha)] != nil {
+				cn.wr.Int(1)
+			} else {
+				cn.wr.Int(0)
+			}
+		}
+		s.scriptMu.Unlock()
+	case sub == "flush" && len(ss) <= 2:
+		if len(ss) == 2 && strings.ToLower(ss[1]) != "async" && strings.ToLower(ss[1]) != "sync" {
+			return syntaxError
+		}
+		s.scriptMu.Lock()
+		s.scripts = make(map[string]*lua.FunctionProto)
+		s.scriptMu.Unlock()
+		cn.wr.Status("OK")
+	case sub == "kill" && len(ss) == 1:
+		err = s.killScript(cn)
+	default:
+		err = fmt.Errorf("ERR Unknown SCRIPT subcommand or wrong number of arguments for '%s'", ss[0])
+	}
+	return
+}
+
+// killScript stops the running script unless it wrote. It is called
+// without execMu, which the script holds.
+func (s *server) killScript(cn *Conn) error {
+	s.scriptMu.Lock()
+	defer s.scriptMu.Unlock()
+
+	switch {
+	case s.script == nil:
+		return notBusy
+	case s.script.wrote:
+		return unkillable
+	}
+	s.script.killed = true
+	s.script.cancel()
+	cn.wr.Status("OK")
+	return nil
+}
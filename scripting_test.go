@@ -0,0 +1,99 @@
+package toyredis
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScripting(t *testing.T) {
+	server := NewServerWithConfig(Config{Port: "6804", SizeLimit: 20, ScriptTimeLimit: 50 * time.Millisecond})
+	defer server.Stop()
+
+	cdc, rd := openCDC(t, "6804")
+	defer cdc.Close()
+
+	c := dial(t, "6804")
+	defer c.Close()
+	c.send("eval", "return redis.call('set', KEYS[1], ARGV[1])", "1", "foo", "bar")
+	c.send("eval", "return redis.call('incrby', KEYS[1], 5)", "1", "n")
+	c.send("eval", "return {1, 'a', false, {2}, nil, 3}", "0")
+	c.send("eval", "redis.call('select', 1) return redis.call('get', KEYS[1])", "1", "foo")
+	c.send("get", "foo")
+	c.expect(t, "+OK", ":5", ":1 a (nil) :2", "(nil)", "bar")
+
+	// errors
+	c.send("eval", "return redis.call('incr', KEYS[1])", "1", "foo")
+	c.send("eval", "return redis.pcall('incr', KEYS[1]).err", "1", "foo")
+	c.send("eval", "return redis.call('multi')", "0")
+	c.send("eval", "return redis.error_reply('MY error')", "0")
+	c.send("eval", "return 1", "2", "a")
+	c.expect(t,
+		"-ERR value is not an integer or out of range",
+		"ERR value is not an integer or out of range",
+		"-ERR This Redis command is not allowed from script",
+		"-MY error",
+		"-ERR Number of keys can't be greater than number of args")
+	c.send("eval", "return (", "0")
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if reply, _ := readReply(c.rd); !strings.HasPrefix(reply, "-ERR Error compiling script") {
+		t.Fatalf("unexpected reply %s", reply)
+	}
+
+	// cache
+	c.send("script", "load", "return ARGV[1]")
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	sha, _ := readReply(c.rd)
+	if len(sha) != 40 {
+		t.Fatalf("unexpected reply %s", sha)
+	}
+	c.send("evalsha", sha, "0", "hi")
+	c.send("script", "exists", sha, "ffff")
+	c.send("script", "flush")
+	c.send("evalsha", sha, "0", "hi")
+	c.expect(t, "hi", ":1 :0", "+OK", "-NOSCRIPT No matching script. Please use EVAL.")
+
+	// in a transaction
+	c.send("multi")
+	c.send("set", "a", "1")
+	c.send("eval", "return redis.call('incr', KEYS[1])", "1", "a")
+	c.send("exec")
+	c.expect(t, "+OK", "+QUEUED", "+QUEUED", "+OK :2")
+	c.send("multi")
+	c.send("eval", "return redis.call('incr', KEYS[1])", "1", "a")
+	c.send("exec")
+	c.expect(t, "+OK", "+QUEUED", ":3")
+
+	// the writes are propagated between MULTI and EXEC, once in a
+	// transaction
+	want := []string{
+		"0 0 multi", "1 0 set foo bar", "2 0 exec",
+		"3 0 multi", "4 0 incrby n 5", "5 0 exec",
+		// the failed writes
+		"6 0 multi", "7 0 exec", "8 0 multi", "9 0 exec",
+		"10 0 multi", "11 0 set a 1", "12 0 incr a", "13 0 exec",
+		"14 0 multi", "15 0 incr a", "16 0 exec",
+	}
+	for _, w := range want {
+		ss, err := rd.ReadRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(ss, " "); got != w {
+			t.Fatalf("expected %s, got %s", w, got)
+		}
+	}
+
+	// time limit
+	c.send("eval", "while true do end", "0")
+	time.Sleep(100 * time.Millisecond)
+	other := dial(t, "6804")
+	defer other.Close()
+	other.send("get", "foo")
+	other.send("script", "kill")
+	other.expect(t, "-BUSY Redis is busy running a script. You can only call SCRIPT KILL.", "+OK")
+	c.expect(t, "-ERR Script killed by user with SCRIPT KILL...")
+	other.send("script", "kill")
+	other.send("get", "foo")
+	other.expect(t, "-NOTBUSY No scripts in execution right now.", "bar")
+}
@@ -2,47 +2,321 @@ package toyredis
 
 import (
 	"bufio"
+	"container/list"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
 )
 
 type server struct {
-	port         string
-	listener     net.Listener
-	quit         chan interface{}
-	cache        *Cache
+	port     string
+	listener net.Listener
+	quit     chan interface{}
+	dbs      []*Cache
+	dbsMu    *sync.RWMutex
+	// held exclusively by write commands and shared by the others
+	execMu       *sync.RWMutex
+	aof          *aof
 	clientsCount int
 	mu           *sync.Mutex
+
+	// snapshot settings and state, guarded by mu
+	dir        string
+	dbFilename string
+	saveRules  []SaveRule
+	dirty      int // writes since the last successful save
+	lastSave   time.Time
+	saving     bool
+
+	// replication state, guarded by replMu
+	replMu     *sync.Mutex
+	replID     string
+	replOffset int64
+	replDB     int // database selected in the stream, -1 if none
+	replicas   map[*replica]struct{}
+	master     *masterLink // nil unless this server is a replica
+
+	cdc *cdc
+
+	// connections blocked on each key, guarded by blockMu
+	blockMu *sync.Mutex
+	blocked map[blockKey]*list.List
+	// keys written since the blocked connections were served, guarded by
+	// readyMu
+	readyMu *sync.Mutex
+	ready   map[blockKey]bool
+
+	pubsub *pubsub
+	// classes of keyspace notifications sent, accessed atomically
+	notifyFlags int32
+
+	// keys the databases removed on their own, not propagated yet, guarded
+	// by removedMu
+	removedMu *sync.Mutex
+	removed   []removedKey
+
+	// scripts cached by SHA1 and the one running, guarded by scriptMu
+	scriptMu        *sync.Mutex
+	scripts         map[string]*lua.FunctionProto
+	script          *runningScript
+	scriptTimeLimit time.Duration
+
+	// the stock commands and the registered ones, guarded by commandsMu
+	commandsMu *sync.RWMutex
+	commands   map[string]*command
+}
+
+// Config holds the settings a server is started with
+type Config struct {
+	Port string
+	// memory limit of all databases together, in MB
+	SizeLimit int
+	// number of databases, 16 if not set
+	Databases int
+	// the RDB snapshot is stored in Dir/DBFilename, by default dump.rdb in
+	// the working directory, and loaded from there on startup
+	Dir        string
+	DBFilename string
+	// automatic background saves, none if empty
+	SaveRules []SaveRule
+	// log write commands to Dir/AppendFilename, appendonly.aof by
+	// default. When enabled it is loaded instead of the snapshot.
+	AppendOnly     bool
+	AppendFilename string
+	AppendFsync    FsyncPolicy
+	// number of records the CDC feed keeps for consumers to resume from,
+	// 10000 by default
+	CDCBacklog int
+	// classes of keyspace notifications sent, in the format of the
+	// notify-keyspace-events setting of redis, none if empty
+	NotifyKeyspaceEvents string
+	// time after which a running script can be stopped with SCRIPT KILL,
+	// 5 seconds by default
+	ScriptTimeLimit time.Duration
+	// commands added to the server before the append only file is loaded,
+	// as RegisterCommand does
+	Commands []Command
+}
+
+// SaveRule triggers a background save once Changes writes have been made
+// and Seconds have passed since the last save.
+type SaveRule struct {
+	Seconds int
+	Changes int
 }
 
+const (
+	defaultDatabases  = 16
+	defaultDBFilename = "dump.rdb"
+	defaultAOFilename = "appendonly.aof"
+)
+
 func NewServer(port string, sizeLimit int) *server {
+	return NewServerWithConfig(Config{Port: port, SizeLimit: sizeLimit})
+}
+
+func NewServerWithConfig(cfg Config) *server {
+	if cfg.Databases <= 0 {
+		cfg.Databases = defaultDatabases
+	}
+	if cfg.DBFilename == "" {
+		cfg.DBFilename = defaultDBFilename
+	}
+	if cfg.AppendFilename == "" {
+		cfg.AppendFilename = defaultAOFilename
+	}
+	if cfg.CDCBacklog <= 0 {
+		cfg.CDCBacklog = defaultCDCBacklog
+	}
+	if cfg.ScriptTimeLimit <= 0 {
+		cfg.ScriptTimeLimit = defaultScriptTimeLimit
+	}
+	flags, err := parseNotifyFlags(cfg.NotifyKeyspaceEvents)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	s := &server{
-		port:  port,
-		quit:  make(chan interface{}),
-		cache: NewCache(MB * sizeLimit),
-		mu:    &sync.Mutex{},
+		port:        cfg.Port,
+		quit:        make(chan interface{}),
+		dbs:         NewCaches(cfg.Databases, MB*cfg.SizeLimit),
+		dbsMu:       &sync.RWMutex{},
+		execMu:      &sync.RWMutex{},
+		mu:          &sync.Mutex{},
+		dir:         cfg.Dir,
+		dbFilename:  cfg.DBFilename,
+		saveRules:   cfg.SaveRules,
+		lastSave:    time.Now(),
+		replMu:      &sync.Mutex{},
+		replID:      newReplID(),
+		replDB:      -1,
+		replicas:    make(map[*replica]struct{}),
+		cdc:         newCDC(cfg.CDCBacklog),
+		blockMu:     &sync.Mutex{},
+		blocked:     make(map[blockKey]*list.List),
+		readyMu:     &sync.Mutex{},
+		ready:       make(map[blockKey]bool),
+		pubsub:      newPubSub(),
+		notifyFlags: flags,
+		removedMu:   &sync.Mutex{},
+
+		scriptMu:        &sync.Mutex{},
+		scripts:         make(map[string]*lua.FunctionProto),
+		scriptTimeLimit: cfg.ScriptTimeLimit,
+
+		commandsMu: &sync.RWMutex{},
+		commands:   make(map[string]*command, len(commandTable)),
+	}
+	for name, c := range commandTable {
+		s.commands[name] = c
+	}
+	for _, c := range cfg.Commands {
+		if err := s.addCommand(c); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	for i, db := range s.dbs {
+		db.OnEvent(s.cacheEvents(i))
+	}
+	if cfg.AppendOnly {
+		path := filepath.Join(s.dir, cfg.AppendFilename)
+		if err := s.loadAOF(path); err != nil {
+			log.Fatalln(err)
+		}
+		a, err := openAOF(path, cfg.AppendFsync)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		s.aof = a
+	} else if err := readRDBFile(filepath.Join(s.dir, s.dbFilename), s.dbs); err != nil {
+		log.Fatalln(err)
 	}
-	l, err := net.Listen("tcp", ":"+port)
+	l, err := net.Listen("tcp", ":"+cfg.Port)
 	if err != nil {
 		log.Fatalln(err)
 	}
 	s.listener = l
+	// keys evicted while loading
+	s.propagateRemoved()
 	go s.serve()
+	go s.cron()
+	go s.expireKeys()
 	return s
 }
 
 func (s *server) Stop() {
 	close(s.quit)
 	s.listener.Close()
-	s.cache.Stop()
+	s.replMu.Lock()
+	if s.master != nil {
+		s.stopMasterLink()
+	}
+	s.replMu.Unlock()
+	s.dropReplicas()
+	s.cdc.close()
+	for _, db := range s.dbs {
+		db.Stop()
+	}
+	if s.aof != nil {
+		if err := s.aof.close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// db returns the database selected by the connection
+func (s *server) db(cn *Conn) *Cache {
+	s.dbsMu.RLock()
+	defer s.dbsMu.RUnlock()
+	return s.dbs[cn.db]
+}
+
+// allDBs returns a copy of the databases in index order
+func (s *server) allDBs() []*Cache {
+	s.dbsMu.RLock()
+	defer s.dbsMu.RUnlock()
+	return append([]*Cache(nil), s.dbs...)
+}
+
+// cron runs the periodic tasks of the server
+func (s *server) cron() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	for {
+		select {
+		case <-s.quit:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			s.checkSaveRules()
+			if s.aof != nil {
+				s.aof.syncIfDue()
+			}
+		}
+	}
+}
+
+func (s *server) checkSaveRules() {
+	s.mu.Lock()
+	due := false
+	for _, r := range s.saveRules {
+		if s.dirty >= r.Changes && time.Since(s.lastSave) >= time.Duration(r.Seconds)*time.Second {
+			due = true
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if due {
+		if finish, err := s.startSave(); err == nil {
+			if err = finish(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// startSave takes a point-in-time copy of all databases and returns the
+// function that writes it to the snapshot file. Only one save can be in
+// progress at a time.
+func (s *server) startSave() (finish func() error, err error) {
+	s.mu.Lock()
+	if s.saving {
+		s.mu.Unlock()
+		return nil, saveInProgress
+	}
+	s.saving = true
+	path, dirty := filepath.Join(s.dir, s.dbFilename), s.dirty
+	s.mu.Unlock()
+
+	dbs := s.allDBs()
+	entries := make([][]*entry, len(dbs))
+	for i, db := range dbs {
+		entries[i] = db.entries()
+	}
+
+	return func() error {
+		err := writeRDBFile(path, entries)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.saving = false
+		if err == nil {
+			s.dirty -= dirty
+			s.lastSave = time.Now()
+		}
+		return err
+	}, nil
 }
 
 func (s *server) serve() {
@@ -62,12 +336,100 @@ func (s *server) serve() {
 
 //------------------------------------------------------------------------------
 
+// outbox queues what is sent to a connection by a goroutine of its own, so
+// that the writers never wait for a slow reader
+type outbox struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	closed  bool
+	// once more than limit bytes are pending, the outbox is closed and
+	// its content dropped, 0 for no limit
+	limit int
+}
+
+var outboxClosed = errors.New("outbox closed")
+
+func newOutbox(limit int) *outbox {
+	o := &outbox{limit: limit}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+func (o *outbox) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return 0, outboxClosed
+	}
+	o.pending = append(o.pending, p...)
+	o.cond.Signal()
+	if o.limit > 0 && len(o.pending) > o.limit {
+		o.pending, o.closed = nil, true
+		return 0, outboxClosed
+	}
+	return len(p), nil
+}
+
+// next waits for what is pending, ok is false once the outbox is closed
+// and drained
+func (o *outbox) next() (p []byte, ok bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for len(o.pending) == 0 && !o.closed {
+		o.cond.Wait()
+	}
+	p, o.pending = o.pending, nil
+	return p, len(p) > 0 || !o.closed
+}
+
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+	o.cond.Signal()
+}
+
+//------------------------------------------------------------------------------
+
 type Conn struct {
 	netConn net.Conn
 
 	rd *Reader
 	bw *bufio.Writer
 	wr *Writer
+
+	db int // index of the selected database
+
+	// set by handlers of non-deterministic commands to the commands that
+	// are propagated instead of the request
+	propagated [][]string
+
+	// set by handlers that turn the connection into a stream, such as the
+	// one of a replica, run once the reply is flushed
+	takeover func()
+	// set by blocking commands that found no data, the connection waits
+	// once the command returns
+	waiter *waiter
+	// set on the first subscription, the writes to the connection go
+	// through it from then on
+	sub *subscriber
+	// the link to the master of this server, exempt from READONLY
+	master bool
+
+	// set by MULTI, the commands are queued until EXEC or DISCARD
+	multi  bool
+	queued [][]string
+	// set when a command could not be queued, EXEC fails
+	aborted bool
+	// set by WATCH until EXEC, DISCARD or UNWATCH
+	watched []watchedKey
+	// set once the transaction or script run writes, a MULTI was
+	// propagated and the EXEC is due
+	inMulti bool
 }
 
 func NewConn(c net.Conn) *Conn {
@@ -85,8 +447,37 @@ var (
 	unsupportedRequest = errors.New("ERR unsupported command")
 	arityError         = errors.New("ERR wrong number of arguments")
 	notIntError        = errors.New("ERR value is not an integer or out of range")
+	notPositiveError   = errors.New("ERR value is out of range, must be positive")
+	syntaxError        = errors.New("ERR syntax error")
+	notFloatError      = errors.New("ERR value is not a valid float")
+	invalidCursor      = errors.New("ERR invalid cursor")
+	invalidDBIndex     = errors.New("ERR DB index is out of range")
+	saveInProgress     = errors.New("ERR Background save already in progress")
+	aofDisabled        = errors.New("ERR Append only file is not enabled")
+	invalidTTL         = errors.New("ERR Invalid TTL value, must be >= 0")
+	invalidIdleTime    = errors.New("ERR Invalid IDLETIME value, must be >= 0")
+	invalidFreq        = errors.New("ERR Invalid FREQ value, must be >= 0 and <= 255")
 )
 
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, notFloatError
+	}
+	return f, nil
+}
+
+// formatFloat formats f the way redis replies with scores
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
 func (s *server) handleConnection(c net.Conn) {
 	s.mu.Lock()
 	s.clientsCount++
@@ -99,7 +490,14 @@ func (s *server) handleConnection(c net.Conn) {
 			cn.wr.Error(err.Error())
 			cn.bw.Flush()
 		}
-		c.Close()
+		if cn.sub != nil {
+			s.pubsub.unsubscribe(cn.sub, nil, nil, false)
+			s.pubsub.unsubscribe(cn.sub, nil, nil, true)
+			// the connection is closed once the outbox is drained
+			cn.sub.close()
+		} else {
+			c.Close()
+		}
 		s.mu.Lock()
 		s.clientsCount--
 		s.mu.Unlock()
@@ -114,299 +512,1812 @@ func (s *server) handleConnection(c net.Conn) {
 			break
 		}
 
-		switch strings.ToLower(ss[0]) {
-		case "flushdb":
-			err = s.handleFlush(cn, ss[1:])
-		case "expire": // seconds
-			err = s.handleExpire(cn, ss[1:], 1000)
-		case "pexpire": // milliseconds
-			err = s.handleExpire(cn, ss[1:], 1)
-		case "set":
-			err = s.handleSet(cn, ss[1:])
-		case "mset":
-			err = s.handleMSet(cn, ss[1:])
-		case "get":
-			err = s.handleGet(cn, ss[1:])
-		case "mget":
-			err = s.handleMGet(cn, ss[1:])
-		case "exists":
-			err = s.handleExists(cn, ss[1:])
-		case "hset":
-			err = s.handleHSet(cn, ss[1:])
-		case "hmset":
-			err = s.handleHMSet(cn, ss[1:])
-		case "hget":
-			err = s.handleHGet(cn, ss[1:])
-		case "hmget":
-			err = s.handleHMGet(cn, ss[1:])
-		case "hgetall":
-			err = s.handleHGetAll(cn, ss[1:])
-		case "hexists":
-			err = s.handleHExists(cn, ss[1:])
-		case "del":
-			err = s.handleDel(cn, ss[1:])
-		case "hdel":
-			err = s.handleHDel(cn, ss[1:])
-		case "info":
-			err = s.handleInfo(cn, ss[1:])
-		case "config":
-			err = s.handleConfigSet(cn, ss[1:])
-		default:
-			err = unsupportedRequest
+		err = s.call(cn, ss)
+		if cn.waiter != nil {
+			s.wait(cn)
 		}
 		if err != nil {
 			cn.wr.Error(err.Error())
 		}
 		cn.bw.Flush()
+		if cn.takeover != nil {
+			cn.takeover()
+			err = io.EOF
+			break
+		}
 	}
 }
 
-func (s *server) handleFlush(cn *Conn, ss []string) (err error) {
-	if len(ss) != 0 {
-		err = arityError
+// call runs a command and propagates it if it changed the data set.
+// Writes are run one at a time so that they are logged in the order they
+// were applied.
+func (s *server) call(cn *Conn, ss []string) (err error) {
+	if len(ss) == 0 {
+		return invalidRequest
+	}
+	name := strings.ToLower(ss[0])
+	if cn.sub != nil && !subscribedCommands[name] && s.pubsub.subscribed(cn.sub) {
+		return fmt.Errorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context", name)
+	}
+	if name == "script" && len(ss) == 2 && strings.ToLower(ss[1]) == "kill" {
+		// the script holds execMu
+		return s.killScript(cn)
+	}
+	if !cn.master && s.scriptBusy() {
+		return busyScript
+	}
+	cmd := s.lookupCommand(name)
+	if cn.multi && !transactionCommands[name] {
+		return s.queue(cn, cmd, ss)
+	}
+	if cmd == nil {
+		return unsupportedRequest
+	}
+	write := cmd.flags&FlagWrite != 0
+	if write && !cn.master && s.isReplica() {
+		return readOnlyReplica
+	}
+	// EXEC and scripts run writes as well
+	exclusive := write || name == "exec" || name == "eval" || name == "evalsha"
+	if exclusive {
+		s.execMu.Lock()
+		defer s.execMu.Unlock()
+		if cn.master {
+			// the keys expired here exist until the master deletes them
+			s.db(cn).ShowExpired(true)
+			defer s.db(cn).ShowExpired(false)
+		}
 	} else {
-		s.cache.Flush()
-		cn.wr.Status("OK")
+		s.execMu.RLock()
+		defer s.execMu.RUnlock()
 	}
-	return
-}
 
-func (s *server) handleExpire(cn *Conn, ss []string, unit int) (err error) {
-	if len(ss) != 2 {
-		err = arityError
+	if err = s.run(cn, cmd, ss); err != nil || !exclusive {
+		return
+	}
+	if !cn.master {
+		s.serveBlocked()
 	} else {
-		i, e := strconv.Atoi(ss[1])
-		if e != nil {
-			err = notIntError
-		} else {
-			num := s.cache.Expire(ss[0], i*unit)
-			cn.wr.Int(num)
-		}
+		s.takeReady()
 	}
 	return
 }
 
-func (s *server) handleSet(cn *Conn, ss []string) (err error) {
-	if len(ss) != 2 {
-		err = arityError
-	} else {
-		s.cache.Set(ss[0], []byte(ss[1]))
-		cn.wr.Status("OK")
+// run dispatches a command and propagates it if it wrote, execMu must be
+// held
+func (s *server) run(cn *Conn, cmd *command, ss []string) (err error) {
+	cn.propagated = nil
+	if err = s.checkMemory(cn, cmd); err == nil {
+		err = s.dispatch(cn, cmd, ss)
 	}
+	if err == nil && cmd.flags&FlagWrite != 0 {
+		s.wrote(cn, cmd.name, ss)
+	}
+	// reads expire keys too
+	s.propagateRemoved()
 	return
 }
 
-func (s *server) handleMSet(cn *Conn, ss []string) (err error) {
-	if len(ss) < 2 || len(ss)%2 != 0 {
-		err = arityError
-	} else {
-		for i := 0; i < len(ss); i += 2 {
-			s.cache.Set(ss[i], []byte(ss[i+1]))
+// checkMemory frees memory before a command that may use more, and refuses
+// the command if it cannot, as with noeviction. The stream of the master
+// is applied whatever the memory used.
+func (s *server) checkMemory(cn *Conn, cmd *command) error {
+	if cmd.flags&FlagDenyOOM == 0 || cn.master {
+		return nil
+	}
+	return s.db(cn).FreeMemory()
+}
+
+// wrote counts a write command that succeeded and propagates it
+func (s *server) wrote(cn *Conn, cmd string, ss []string) {
+	s.mu.Lock()
+	s.dirty++
+	s.mu.Unlock()
+	s.propagate(cn, cmd, ss)
+}
+
+// commands with a relative expire, their absolute expire is logged after
+// them so that replaying does not extend the ttl
+var relativeExpireCommands = map[string]bool{
+	"expire": true, "pexpire": true, "set": true, "setex": true, "psetex": true, "getex": true, "restore": true,
+}
+
+// propagate logs a write command that succeeded and sends it to the
+// replicas
+func (s *server) propagate(cn *Conn, cmd string, ss []string) {
+	cmds := cn.propagated
+	if cmds == nil {
+		cmds = [][]string{ss}
+		if relativeExpireCommands[cmd] {
+			if at, ok := s.db(cn).ExpireTime(ss[1]); ok && at != nilTime {
+				ms := strconv.FormatInt(fromTime(at, time.Millisecond), 10)
+				cmds = append(cmds, []string{"pexpireat", ss[1], ms})
+			}
 		}
-		cn.wr.Status("OK")
 	}
-	return
+	// the keys removed while the command ran that it wrote again were
+	// removed before it took effect, the others after
+	var after []removedKey
+	for _, r := range s.takeRemoved() {
+		if s.allDBs()[r.db].has(r.key) {
+			s.feed(r.db, [][]string{{"del", r.key}})
+		} else {
+			after = append(after, r)
+		}
+	}
+	if len(cmds) != 0 {
+		s.feed(cn.db, cmds)
+	}
+	for _, r := range after {
+		s.feed(r.db, [][]string{{"del", r.key}})
+	}
 }
 
-func (s *server) handleGet(cn *Conn, ss []string) (err error) {
-	if len(ss) != 1 {
-		err = arityError
-	} else {
-		d, err := s.cache.Get(ss[0])
-		if err != nil {
-			return err
+// feed logs commands run against database db, and sends them to the
+// replicas and the CDC feed
+func (s *server) feed(db int, cmds [][]string) {
+	if s.aof != nil {
+		if err := s.aof.append(db, cmds); err != nil {
+			log.Println(err)
 		}
-		cn.wr.String((d))
 	}
-	return
+	s.feedReplicas(db, cmds)
+	s.cdc.append(db, cmds)
 }
 
-func (s *server) handleMGet(cn *Conn, ss []string) (err error) {
-	if len(ss) < 1 {
-		err = arityError
-	} else {
-		buf := make([][]byte, len(ss))
-		for i, k := range ss {
-			d, err := s.cache.Get(k)
-			if err != nil {
-				return err
+// removedKey is a key a database expired or evicted on its own
+type removedKey struct {
+	db  int
+	key string
+}
+
+// propagateRemoved propagates the keys the databases removed on their own
+// as DEL, execMu must be held
+func (s *server) propagateRemoved() {
+	for _, r := range s.takeRemoved() {
+		s.feed(r.db, [][]string{{"del", r.key}})
+	}
+}
+
+// takeRemoved returns the keys the databases removed on their own since
+// the last call
+func (s *server) takeRemoved() []removedKey {
+	s.removedMu.Lock()
+	defer s.removedMu.Unlock()
+	removed := s.removed
+	s.removed = nil
+	return removed
+}
+
+// expireKeys removes the keys that expired without being accessed, as the
+// databases leave it to the server to propagate it
+func (s *server) expireKeys() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	for {
+		select {
+		case <-s.quit:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+			s.execMu.Lock()
+			for _, db := range s.allDBs() {
+				db.ActiveExpire()
 			}
-			buf[i] = d
+			s.propagateRemoved()
+			s.execMu.Unlock()
 		}
-		cn.wr.StringArray(buf)
 	}
-	return
 }
 
-func (s *server) handleExists(cn *Conn, ss []string) (err error) {
-	if len(ss) != 1 {
-		err = arityError
-	} else {
-		num := s.cache.Exists(ss[0])
-		cn.wr.Int(num)
+// dispatch checks the arity of a command and runs its handler
+func (s *server) dispatch(cn *Conn, cmd *command, ss []string) error {
+	if !cmd.checkArity(len(ss)) {
+		return arityError
 	}
-	return
+	return cmd.handler(s, cn, ss[1:])
 }
 
-func (s *server) handleHSet(cn *Conn, ss []string) (err error) {
-	if len(ss) != 3 {
-		err = arityError
-	} else {
-		s.cache.HSet(ss[0], ss[1], []byte(ss[2]))
-		cn.wr.Status("OK")
+func (s *server) handleSave(cn *Conn, ss []string) (err error) {
+	finish, err := s.startSave()
+	if err != nil {
+		return
 	}
+	if err = finish(); err != nil {
+		return
+	}
+	cn.wr.Status("OK")
 	return
 }
 
-func (s *server) handleHMSet(cn *Conn, ss []string) (err error) {
-	if len(ss) < 3 || len(ss)%2 != 1 {
-		err = arityError
-	} else {
-		for i := 1; i < len(ss); i += 2 {
-			s.cache.HSet(ss[0], ss[i], []byte(ss[i+1]))
-		}
-		cn.wr.Status("OK")
+func (s *server) handleBgSave(cn *Conn, ss []string) (err error) {
+	finish, err := s.startSave()
+	if err != nil {
+		return
 	}
+	go func() {
+		if err := finish(); err != nil {
+			log.Println(err)
+		}
+	}()
+	cn.wr.Status("Background saving started")
 	return
 }
 
-func (s *server) handleHGet(cn *Conn, ss []string) (err error) {
-	if len(ss) != 2 {
-		err = arityError
-	} else {
-		d, err := s.cache.HGet(ss[0], ss[1])
-		if err != nil {
-			return err
-		}
-		cn.wr.String((d))
+func (s *server) handleBgRewriteAOF(cn *Conn, ss []string) (err error) {
+	if s.aof == nil {
+		return aofDisabled
 	}
+	// no write can run while this command holds execMu
+	if err = s.rewriteAOF(); err != nil {
+		return
+	}
+	cn.wr.Status("Background append only file rewriting started")
 	return
 }
 
-func (s *server) handleHGetAll(cn *Conn, ss []string) (err error) {
-	if len(ss) != 1 {
-		err = arityError
-	} else {
-		d, err := s.cache.HGetAll(ss[0])
-		if err != nil {
-			return err
-		}
-		cn.wr.StringArray(d)
+// rewriteAOF starts rewriting the append only file in the background. The
+// caller keeps writes out, so that the copy of the data set matches the
+// point where buffering starts.
+func (s *server) rewriteAOF() error {
+	if err := s.aof.startRewrite(); err != nil {
+		return err
 	}
+	dbs := s.allDBs()
+	entries := make([][]*entry, len(dbs))
+	for i, db := range dbs {
+		entries[i] = db.entries()
+	}
+	go func() {
+		f, err := writeRewrite(s.aof.path, entries)
+		if err = s.aof.finishRewrite(f, err); err != nil {
+			log.Println(err)
+		}
+	}()
+	return nil
+}
+
+func (s *server) handleLastSave(cn *Conn, ss []string) (err error) {
+	s.mu.Lock()
+	cn.wr.Int(int(s.lastSave.Unix()))
+	s.mu.Unlock()
 	return
 }
 
-func (s *server) handleHMGet(cn *Conn, ss []string) (err error) {
-	if len(ss) < 2 {
-		err = arityError
-	} else {
-		buf := make([][]byte, len(ss)-1)
-		for i, k := range ss[1:] {
-			d, err := s.cache.HGet(ss[0], k)
-			if err != nil {
-				return err
-			}
-			buf[i] = d
-		}
-		cn.wr.StringArray(buf)
-	}
+func (s *server) handleFlush(cn *Conn, ss []string) (err error) {
+	s.db(cn).Flush()
+	cn.wr.Status("OK")
 	return
 }
 
-func (s *server) handleDel(cn *Conn, ss []string) (err error) {
-	if len(ss) < 1 {
-		err = arityError
-	} else {
-		num := s.cache.Remove(ss)
-		cn.wr.Int(num)
+func (s *server) handleFlushAll(cn *Conn, ss []string) (err error) {
+	for _, db := range s.allDBs() {
+		db.Flush()
 	}
+	cn.wr.Status("OK")
 	return
 }
 
-func (s *server) handleHDel(cn *Conn, ss []string) (err error) {
-	if len(ss) < 2 {
-		err = arityError
-	} else {
-		num, err := s.cache.HDel(ss[0], ss[1:])
-		if err != nil {
-			return err
-		}
-		cn.wr.Int(num)
+// parseDBIndex parses a database index and checks that it is in range
+func (s *server) parseDBIndex(arg string) (int, error) {
+	i, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, notIntError
 	}
-	return
+	if i < 0 || i >= len(s.dbs) {
+		return 0, invalidDBIndex
+	}
+	return i, nil
 }
 
-func (s *server) handleHExists(cn *Conn, ss []string) (err error) {
-	if len(ss) != 2 {
-		err = arityError
-	} else {
-		num, err := s.cache.HExists(ss[0], ss[1])
-		if err != nil {
-			return err
-		}
-		cn.wr.Int(num)
+func (s *server) handleSelect(cn *Conn, ss []string) (err error) {
+	i, err := s.parseDBIndex(ss[0])
+	if err != nil {
+		return
 	}
+	cn.db = i
+	cn.wr.Status("OK")
 	return
 }
 
-func (s *server) handleInfo(cn *Conn, ss []string) (err error) {
-	if len(ss) != 0 {
-		err = arityError
-	} else {
-		pid := os.Getpid()
-
-		info := []struct {
-			groupName string
-			kv        map[string]string
-		}{
-			{"Server", make(map[string]string)},
-			{"Clients", make(map[string]string)},
-			{"Memory", make(map[string]string)},
-		}
-		info[0].kv["process_id"] = strconv.Itoa(pid)
-		info[0].kv["tcp_port"] = s.port
-		info[1].kv["connected_clients"] = strconv.Itoa(s.clientsCount)
-		info[2].kv["used_memory"] = strconv.Itoa(s.cache.GetSize())
-		info[2].kv["maxmemory"] = strconv.Itoa(s.cache.GetSizeLimit())
-
-		sb := new(strings.Builder)
-		clrf := "\r\n"
-		for idx, i := range info {
-			sb.WriteString("# ")
-			sb.WriteString(i.groupName)
-			sb.WriteString(clrf)
-			for k, v := range i.kv {
-				sb.WriteString(k)
-				sb.WriteString(":")
-				sb.WriteString(v)
-				sb.WriteString(clrf)
-			}
-			if idx != len(info)-1 {
-				sb.WriteString(clrf)
-			}
+func (s *server) handleSwapDB(cn *Conn, ss []string) (err error) {
+	i, err := s.parseDBIndex(ss[0])
+	if err != nil {
+		return
+	}
+	j, err := s.parseDBIndex(ss[1])
+	if err != nil {
+		return
+	}
+	s.dbsMu.Lock()
+	s.dbs[i], s.dbs[j] = s.dbs[j], s.dbs[i]
+	s.dbs[i].OnEvent(s.cacheEvents(i))
+	s.dbs[j].OnEvent(s.cacheEvents(j))
+	s.dbsMu.Unlock()
+	// the keys waited for in either database may hold data now
+	s.blockMu.Lock()
+	for k := range s.blocked {
+		if k.db == i || k.db == j {
+			s.markReady(k)
 		}
-		cn.wr.String([]byte(sb.String()))
 	}
+	s.blockMu.Unlock()
+	cn.wr.Status("OK")
 	return
 }
 
-func (s *server) handleConfigSet(cn *Conn, ss []string) (err error) {
-	if len(ss) == 3 && ss[0] == "set" {
-		if ss[1] == "maxmemory" {
+func (s *server) handleMove(cn *Conn, ss []string) (err error) {
+	i, err := s.parseDBIndex(ss[1])
+	if err != nil {
+		return
+	}
+	s.dbsMu.RLock()
+	src, dst := s.dbs[cn.db], s.dbs[i]
+	s.dbsMu.RUnlock()
+	ok, err := src.Move(ss[0], dst)
+	if err != nil {
+		return
+	}
+	if ok {
+		cn.wr.Int(1)
+	} else {
+		cn.wr.Int(0)
+	}
+	return
+}
+
+func (s *server) handleExpire(cn *Conn, ss []string, cmd string, unit time.Duration, absolute bool) (err error) {
+	n, err := strconv.ParseInt(ss[1], 10, 64)
+	if err != nil {
+		return notIntError
+	}
+	at, ok := toTime(n, unit, absolute)
+	if !ok {
+		return fmt.Errorf("ERR invalid expire time in '%s' command", cmd)
+	}
+
+	var opt ExpireOptions
+	for _, arg := range ss[2:] {
+		switch strings.ToLower(arg) {
+		case "nx":
+			opt.NX = true
+		case "xx":
+			opt.XX = true
+		case "gt":
+			opt.GT = true
+		case "lt":
+			opt.LT = true
+		default:
+			return fmt.Errorf("ERR Unsupported option %s", arg)
+		}
+	}
+	if opt.NX && (opt.XX || opt.GT || opt.LT) {
+		return errors.New("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if opt.GT && opt.LT {
+		return errors.New("ERR GT and LT options at the same time are not compatible")
+	}
+
+	num := s.db(cn).ExpireAt(ss[0], at, opt)
+	cn.wr.Int(num)
+	return
+}
+
+// handleTTL replies with the remaining time to live in unit, -1 if the
+// key has no expire and -2 if it does not exist.
+func (s *server) handleTTL(cn *Conn, ss []string, unit time.Duration) (err error) {
+	expire, exists := s.db(cn).ExpireTime(ss[0])
+	switch {
+	case !exists:
+		cn.wr.Int(-2)
+	case expire == nilTime:
+		cn.wr.Int(-1)
+	default:
+		ttl := time.Until(expire)
+		if ttl < 0 {
+			ttl = 0
+		}
+		cn.wr.Int(int((ttl + unit/2) / unit))
+	}
+	return
+}
+
+// handleExpireTime replies with the absolute unix time of the expire,
+// with the same -1 and -2 replies as TTL.
+func (s *server) handleExpireTime(cn *Conn, ss []string, unit time.Duration) (err error) {
+	expire, exists := s.db(cn).ExpireTime(ss[0])
+	switch {
+	case !exists:
+		cn.wr.Int(-2)
+	case expire == nilTime:
+		cn.wr.Int(-1)
+	default:
+		cn.wr.Int(int(fromTime(expire, unit)))
+	}
+	return
+}
+
+func (s *server) handlePersist(cn *Conn, ss []string) (err error) {
+	num := s.db(cn).Persist(ss[0])
+	cn.wr.Int(num)
+	return
+}
+
+// units of the expire options of SET and GETEX
+var expireOptions = map[string]struct {
+	unit     time.Duration
+	absolute bool
+}{
+	"ex":   {time.Second, false},
+	"px":   {time.Millisecond, false},
+	"exat": {time.Second, true},
+	"pxat": {time.Millisecond, true},
+}
+
+// expireAt converts the argument of an expire option to a deadline, it
+// has to be positive.
+func expireAt(cmd string, arg string, unit time.Duration, absolute bool) (time.Time, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return nilTime, notIntError
+	}
+	at, ok := toTime(n, unit, absolute)
+	if n <= 0 || !ok {
+		return nilTime, fmt.Errorf("ERR invalid expire time in '%s' command", cmd)
+	}
+	return at, nil
+}
+
+// toTime converts a unix time or a ttl given in unit to a point in time,
+// ok is false if it is out of range.
+func toTime(n int64, unit time.Duration, absolute bool) (at time.Time, ok bool) {
+	if absolute {
+		ms := int64(unit / time.Millisecond)
+		if n > math.MaxInt64/ms || n < math.MinInt64/ms {
+			return
+		}
+		perSecond := int64(time.Second / unit)
+		return time.Unix(n/perSecond, n%perSecond*int64(unit)), true
+	}
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return
+	}
+	return time.Now().Add(time.Duration(n) * unit), true
+}
+
+// fromTime converts a point in time to a unix time in unit
+func fromTime(at time.Time, unit time.Duration) int64 {
+	return at.Unix()*int64(time.Second/unit) + int64(at.Nanosecond())/int64(unit)
+}
+
+func (s *server) handleSet(cn *Conn, ss []string) (err error) {
+	var opt SetOptions
+	expires := 0
+	for i := 2; i < len(ss); i++ {
+		switch arg := strings.ToLower(ss[i]); arg {
+		case "nx":
+			opt.NX = true
+		case "xx":
+			opt.XX = true
+		case "get":
+			opt.Get = true
+		case "keepttl":
+			opt.KeepTTL = true
+		case "ex", "px", "exat", "pxat":
+			if i+1 >= len(ss) {
+				return syntaxError
+			}
+			o := expireOptions[arg]
+			if opt.Expire, err = expireAt("set", ss[i+1], o.unit, o.absolute); err != nil {
+				return
+			}
+			expires++
+			i++
+		default:
+			return syntaxError
+		}
+	}
+	if (opt.NX && opt.XX) || expires > 1 || (expires > 0 && opt.KeepTTL) {
+		return syntaxError
+	}
+
+	old, ok, err := s.db(cn).SetWithOptions(ss[0], []byte(ss[1]), opt)
+	if err != nil {
+		return
+	}
+	switch {
+	case opt.Get:
+		cn.wr.String(old)
+	case !ok:
+		cn.wr.String(nil)
+	default:
+		cn.wr.Status("OK")
+	}
+	return
+}
+
+func (s *server) handleSetNX(cn *Conn, ss []string) (err error) {
+	_, ok, err := s.db(cn).SetWithOptions(ss[0], []byte(ss[1]), SetOptions{NX: true})
+	if err != nil {
+		return err
+	}
+	if ok {
+		cn.wr.Int(1)
+	} else {
+		cn.wr.Int(0)
+	}
+	return
+}
+
+func (s *server) handleSetEx(cn *Conn, ss []string, cmd string, unit time.Duration) (err error) {
+	expire, err := expireAt(cmd, ss[1], unit, false)
+	if err != nil {
+		return err
+	}
+	if _, _, err = s.db(cn).SetWithOptions(ss[0], []byte(ss[2]), SetOptions{Expire: expire}); err != nil {
+		return err
+	}
+	cn.wr.Status("OK")
+	return
+}
+
+func (s *server) handleGetSet(cn *Conn, ss []string) (err error) {
+	old, _, err := s.db(cn).SetWithOptions(ss[0], []byte(ss[1]), SetOptions{Get: true})
+	if err != nil {
+		return err
+	}
+	cn.wr.String(old)
+	return
+}
+
+func (s *server) handleGetDel(cn *Conn, ss []string) (err error) {
+	d, err := s.db(cn).GetDel(ss[0])
+	if err != nil {
+		return err
+	}
+	cn.wr.String(d)
+	return
+}
+
+func (s *server) handleGetEx(cn *Conn, ss []string) (err error) {
+	expire := nilTime
+	var persist bool
+	if len(ss) > 1 {
+		arg := strings.ToLower(ss[1])
+		o, isExpire := expireOptions[arg]
+		switch {
+		case len(ss) == 2 && arg == "persist":
+			persist = true
+		case len(ss) == 3 && isExpire:
+			if expire, err = expireAt("getex", ss[2], o.unit, o.absolute); err != nil {
+				return
+			}
+		default:
+			return syntaxError
+		}
+	}
+	d, err := s.db(cn).GetEx(ss[0], expire, persist)
+	if err != nil {
+		return
+	}
+	cn.wr.String(d)
+	return
+}
+
+func (s *server) handleMSet(cn *Conn, ss []string) (err error) {
+	if len(ss)%2 != 0 {
+		err = arityError
+	} else {
+		for i := 0; i < len(ss); i += 2 {
+			if err = s.db(cn).Set(ss[i], []byte(ss[i+1])); err != nil {
+				return
+			}
+		}
+		cn.wr.Status("OK")
+	}
+	return
+}
+
+func (s *server) handleGet(cn *Conn, ss []string) (err error) {
+	d, err := s.db(cn).Get(ss[0])
+	if err != nil {
+		return err
+	}
+	cn.wr.String((d))
+	return
+}
+
+func (s *server) handleMGet(cn *Conn, ss []string) (err error) {
+	buf := make([][]byte, len(ss))
+	for i, k := range ss {
+		d, err := s.db(cn).Get(k)
+		if err != nil {
+			return err
+		}
+		buf[i] = d
+	}
+	cn.wr.StringArray(buf)
+	return
+}
+
+func (s *server) handleIncr(cn *Conn, ss []string, incr int64) (err error) {
+	n, err := s.db(cn).IncrBy(ss[0], incr)
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(int(n))
+	return
+}
+
+// sign is -1 for DECRBY
+func (s *server) handleIncrBy(cn *Conn, ss []string, sign int64) (err error) {
+	incr, e := strconv.ParseInt(ss[1], 10, 64)
+	if e != nil {
+		return notIntError
+	}
+	if sign < 0 && incr == math.MinInt64 {
+		return overflowError
+	}
+	n, err := s.db(cn).IncrBy(ss[0], sign*incr)
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(int(n))
+	return
+}
+
+func (s *server) handleIncrByFloat(cn *Conn, ss []string) (err error) {
+	incr, err := parseFloat(ss[1])
+	if err != nil {
+		return err
+	}
+	f, err := s.db(cn).IncrByFloat(ss[0], incr)
+	if err != nil {
+		return err
+	}
+	cn.wr.String([]byte(strconv.FormatFloat(f, 'f', -1, 64)))
+	return
+}
+
+func (s *server) handleExists(cn *Conn, ss []string) (err error) {
+	num := s.db(cn).Exists(ss[0])
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleHSet(cn *Conn, ss []string) (err error) {
+	if err = s.db(cn).HSet(ss[0], ss[1], []byte(ss[2])); err != nil {
+		return
+	}
+	cn.wr.Status("OK")
+	return
+}
+
+func (s *server) handleHMSet(cn *Conn, ss []string) (err error) {
+	if len(ss)%2 != 1 {
+		err = arityError
+	} else {
+		for i := 1; i < len(ss); i += 2 {
+			if err = s.db(cn).HSet(ss[0], ss[i], []byte(ss[i+1])); err != nil {
+				return
+			}
+		}
+		cn.wr.Status("OK")
+	}
+	return
+}
+
+func (s *server) handleHGet(cn *Conn, ss []string) (err error) {
+	d, err := s.db(cn).HGet(ss[0], ss[1])
+	if err != nil {
+		return err
+	}
+	cn.wr.String((d))
+	return
+}
+
+func (s *server) handleHGetAll(cn *Conn, ss []string) (err error) {
+	d, err := s.db(cn).HGetAll(ss[0])
+	if err != nil {
+		return err
+	}
+	cn.wr.StringArray(d)
+	return
+}
+
+func (s *server) handleHMGet(cn *Conn, ss []string) (err error) {
+	buf := make([][]byte, len(ss)-1)
+	for i, k := range ss[1:] {
+		d, err := s.db(cn).HGet(ss[0], k)
+		if err != nil {
+			return err
+		}
+		buf[i] = d
+	}
+	cn.wr.StringArray(buf)
+	return
+}
+
+func (s *server) handleHIncrBy(cn *Conn, ss []string) (err error) {
+	incr, e := strconv.ParseInt(ss[2], 10, 64)
+	if e != nil {
+		return notIntError
+	}
+	n, err := s.db(cn).HIncrBy(ss[0], ss[1], incr)
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(int(n))
+	return
+}
+
+func (s *server) handleHIncrByFloat(cn *Conn, ss []string) (err error) {
+	incr, err := parseFloat(ss[2])
+	if err != nil {
+		return err
+	}
+	f, err := s.db(cn).HIncrByFloat(ss[0], ss[1], incr)
+	if err != nil {
+		return err
+	}
+	cn.wr.String([]byte(strconv.FormatFloat(f, 'f', -1, 64)))
+	return
+}
+
+func (s *server) handleDel(cn *Conn, ss []string) (err error) {
+	num := s.db(cn).Remove(ss)
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleHDel(cn *Conn, ss []string) (err error) {
+	num, err := s.db(cn).HDel(ss[0], ss[1:])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleHExists(cn *Conn, ss []string) (err error) {
+	num, err := s.db(cn).HExists(ss[0], ss[1])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handlePush(cn *Conn, ss []string, left bool) (err error) {
+	values := make([][]byte, len(ss)-1)
+	for i, v := range ss[1:] {
+		values[i] = []byte(v)
+	}
+	var num int
+	if left {
+		num, err = s.db(cn).LPush(ss[0], values)
+	} else {
+		num, err = s.db(cn).RPush(ss[0], values)
+	}
+	if err != nil {
+		return
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handlePop(cn *Conn, ss []string, left bool) (err error) {
+	if len(ss) != 1 && len(ss) != 2 {
+		return arityError
+	}
+	count := 1
+	if len(ss) == 2 {
+		if count, err = strconv.Atoi(ss[1]); err != nil {
+			return notIntError
+		}
+		if count < 0 {
+			return notPositiveError
+		}
+	}
+	var values [][]byte
+	if left {
+		values, err = s.db(cn).LPop(ss[0], count)
+	} else {
+		values, err = s.db(cn).RPop(ss[0], count)
+	}
+	if err != nil {
+		return
+	}
+	switch {
+	case len(ss) == 2 && values == nil:
+		cn.wr.NullStringArray()
+	case len(ss) == 2:
+		cn.wr.StringArray(values)
+	case len(values) == 0:
+		cn.wr.String(nil)
+	default:
+		cn.wr.String(values[0])
+	}
+	return
+}
+
+func (s *server) handleLLen(cn *Conn, ss []string) (err error) {
+	num, err := s.db(cn).LLen(ss[0])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleLRange(cn *Conn, ss []string) (err error) {
+	start, e1 := strconv.Atoi(ss[1])
+	stop, e2 := strconv.Atoi(ss[2])
+	if e1 != nil || e2 != nil {
+		return notIntError
+	}
+	d, err := s.db(cn).LRange(ss[0], start, stop)
+	if err != nil {
+		return err
+	}
+	cn.wr.StringArray(d)
+	return
+}
+
+func (s *server) handleLIndex(cn *Conn, ss []string) (err error) {
+	i, e := strconv.Atoi(ss[1])
+	if e != nil {
+		return notIntError
+	}
+	d, err := s.db(cn).LIndex(ss[0], i)
+	if err != nil {
+		return err
+	}
+	cn.wr.String(d)
+	return
+}
+
+func (s *server) handleLSet(cn *Conn, ss []string) (err error) {
+	i, e := strconv.Atoi(ss[1])
+	if e != nil {
+		return notIntError
+	}
+	if err = s.db(cn).LSet(ss[0], i, []byte(ss[2])); err != nil {
+		return
+	}
+	cn.wr.Status("OK")
+	return
+}
+
+func (s *server) handleLRem(cn *Conn, ss []string) (err error) {
+	count, e := strconv.Atoi(ss[1])
+	if e != nil {
+		return notIntError
+	}
+	num, err := s.db(cn).LRem(ss[0], count, []byte(ss[2]))
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleLTrim(cn *Conn, ss []string) (err error) {
+	start, e1 := strconv.Atoi(ss[1])
+	stop, e2 := strconv.Atoi(ss[2])
+	if e1 != nil || e2 != nil {
+		return notIntError
+	}
+	if err = s.db(cn).LTrim(ss[0], start, stop); err != nil {
+		return
+	}
+	cn.wr.Status("OK")
+	return
+}
+
+func (s *server) handleLInsert(cn *Conn, ss []string) (err error) {
+	var before bool
+	switch strings.ToLower(ss[1]) {
+	case "before":
+		before = true
+	case "after":
+	default:
+		return syntaxError
+	}
+	num, err := s.db(cn).LInsert(ss[0], before, []byte(ss[2]), []byte(ss[3]))
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleSAdd(cn *Conn, ss []string) (err error) {
+	num, err := s.db(cn).SAdd(ss[0], ss[1:])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleSRem(cn *Conn, ss []string) (err error) {
+	num, err := s.db(cn).SRem(ss[0], ss[1:])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleSMembers(cn *Conn, ss []string) (err error) {
+	d, err := s.db(cn).SMembers(ss[0])
+	if err != nil {
+		return err
+	}
+	cn.wr.StringArray(d)
+	return
+}
+
+func (s *server) handleSIsMember(cn *Conn, ss []string) (err error) {
+	num, err := s.db(cn).SIsMember(ss[0], ss[1])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleSMIsMember(cn *Conn, ss []string) (err error) {
+	nums, err := s.db(cn).SMIsMember(ss[0], ss[1:])
+	if err != nil {
+		return err
+	}
+	cn.wr.Array(len(nums))
+	for _, num := range nums {
+		cn.wr.Int(num)
+	}
+	return
+}
+
+func (s *server) handleSCard(cn *Conn, ss []string) (err error) {
+	num, err := s.db(cn).SCard(ss[0])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleSPop(cn *Conn, ss []string) (err error) {
+	if len(ss) != 1 && len(ss) != 2 {
+		return arityError
+	}
+	count := 1
+	if len(ss) == 2 {
+		if count, err = strconv.Atoi(ss[1]); err != nil {
+			return notIntError
+		}
+		if count < 0 {
+			return notPositiveError
+		}
+	}
+	d, err := s.db(cn).SPop(ss[0], count)
+	if err != nil {
+		return
+	}
+	// the popped members are random, replicate their removal instead
+	cn.propagated = [][]string{}
+	if len(d) > 0 {
+		srem := []string{"srem", ss[0]}
+		for _, m := range d {
+			srem = append(srem, string(m))
+		}
+		cn.propagated = append(cn.propagated, srem)
+	}
+	switch {
+	case len(ss) == 2 && d == nil:
+		cn.wr.StringArray([][]byte{})
+	case len(ss) == 2:
+		cn.wr.StringArray(d)
+	case len(d) == 0:
+		cn.wr.String(nil)
+	default:
+		cn.wr.String(d[0])
+	}
+	return
+}
+
+func (s *server) handleSRandMember(cn *Conn, ss []string) (err error) {
+	if len(ss) != 1 && len(ss) != 2 {
+		return arityError
+	}
+	count := 1
+	if len(ss) == 2 {
+		if count, err = strconv.Atoi(ss[1]); err != nil {
+			return notIntError
+		}
+	}
+	d, err := s.db(cn).SRandMember(ss[0], count)
+	if err != nil {
+		return
+	}
+	switch {
+	case len(ss) == 2 && d == nil:
+		cn.wr.StringArray([][]byte{})
+	case len(ss) == 2:
+		cn.wr.StringArray(d)
+	case len(d) == 0:
+		cn.wr.String(nil)
+	default:
+		cn.wr.String(d[0])
+	}
+	return
+}
+
+func (s *server) handleSMove(cn *Conn, ss []string) (err error) {
+	num, err := s.db(cn).SMove(ss[0], ss[1], ss[2])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleSetOperation(cn *Conn, ss []string, op func([]string) ([][]byte, error)) (err error) {
+	d, err := op(ss)
+	if err != nil {
+		return err
+	}
+	cn.wr.StringArray(d)
+	return
+}
+
+func (s *server) handleSetOperationStore(cn *Conn, ss []string, op func(string, []string) (int, error)) (err error) {
+	num, err := op(ss[0], ss[1:])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleZAdd(cn *Conn, ss []string) (err error) {
+	var opt ZAddOptions
+	var incr bool
+	i := 1
+flags:
+	for ; i < len(ss); i++ {
+		switch strings.ToLower(ss[i]) {
+		case "nx":
+			opt.NX = true
+		case "xx":
+			opt.XX = true
+		case "gt":
+			opt.GT = true
+		case "lt":
+			opt.LT = true
+		case "ch":
+			opt.CH = true
+		case "incr":
+			incr = true
+		default:
+			break flags
+		}
+	}
+	pairs := ss[i:]
+	switch {
+	case len(pairs) == 0 || len(pairs)%2 != 0:
+		return syntaxError
+	case opt.NX && opt.XX:
+		return errors.New("ERR XX and NX options at the same time are not compatible")
+	case (opt.GT && opt.NX) || (opt.LT && opt.NX) || (opt.GT && opt.LT):
+		return errors.New("ERR GT, LT, and/or NX options at the same time are not compatible")
+	case incr && len(pairs) != 2:
+		return errors.New("ERR INCR option supports a single increment-element pair")
+	}
+
+	members := make([]ZMember, len(pairs)/2)
+	for i := range members {
+		score, err := parseFloat(pairs[i*2])
+		if err != nil {
+			return err
+		}
+		members[i] = ZMember{pairs[i*2+1], score}
+	}
+	if incr {
+		score, ok, err := s.db(cn).ZIncrBy(ss[0], opt, members[0].Score, members[0].Member)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			cn.wr.String(nil)
+		} else {
+			cn.wr.String([]byte(formatFloat(score)))
+		}
+		return nil
+	}
+	num, err := s.db(cn).ZAdd(ss[0], opt, members)
+	if err != nil {
+		return
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleZIncrBy(cn *Conn, ss []string) (err error) {
+	incr, err := parseFloat(ss[1])
+	if err != nil {
+		return err
+	}
+	score, _, err := s.db(cn).ZIncrBy(ss[0], ZAddOptions{}, incr, ss[2])
+	if err != nil {
+		return err
+	}
+	cn.wr.String([]byte(formatFloat(score)))
+	return
+}
+
+func (s *server) handleZRem(cn *Conn, ss []string) (err error) {
+	num, err := s.db(cn).ZRem(ss[0], ss[1:])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleZScore(cn *Conn, ss []string) (err error) {
+	score, ok, err := s.db(cn).ZScore(ss[0], ss[1])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		cn.wr.String(nil)
+	} else {
+		cn.wr.String([]byte(formatFloat(score)))
+	}
+	return
+}
+
+func (s *server) handleZCard(cn *Conn, ss []string) (err error) {
+	num, err := s.db(cn).ZCard(ss[0])
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleZRank(cn *Conn, ss []string, rev bool) (err error) {
+	rank, ok, err := s.db(cn).ZRank(ss[0], ss[1], rev)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		cn.wr.String(nil)
+	} else {
+		cn.wr.Int(rank)
+	}
+	return
+}
+
+func (s *server) handleZCount(cn *Conn, ss []string) (err error) {
+	r, err := ParseScoreRange(ss[1], ss[2])
+	if err != nil {
+		return err
+	}
+	num, err := s.db(cn).ZCount(ss[0], r)
+	if err != nil {
+		return err
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleZRange(cn *Conn, ss []string) (err error) {
+	var by string
+	var rev, withScores, limit bool
+	offset, count := 0, -1
+	for i := 3; i < len(ss); i++ {
+		switch arg := strings.ToLower(ss[i]); arg {
+		case "byscore", "bylex":
+			by = arg
+		case "rev":
+			rev = true
+		case "withscores":
+			withScores = true
+		case "limit":
+			if i+2 >= len(ss) {
+				return syntaxError
+			}
+			o, e1 := strconv.Atoi(ss[i+1])
+			c, e2 := strconv.Atoi(ss[i+2])
+			if e1 != nil || e2 != nil {
+				return notIntError
+			}
+			offset, count, limit = o, c, true
+			i += 2
+		default:
+			return syntaxError
+		}
+	}
+	if limit && by == "" {
+		return errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if withScores && by == "bylex" {
+		return errors.New("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	// with REV, the range is given from max to min
+	min, max := ss[1], ss[2]
+	if rev {
+		min, max = max, min
+	}
+	var members []ZMember
+	switch by {
+	case "byscore":
+		r, e := ParseScoreRange(min, max)
+		if e != nil {
+			return e
+		}
+		members, err = s.db(cn).ZRangeByScore(ss[0], r, rev, offset, count)
+	case "bylex":
+		r, e := ParseLexRange(min, max)
+		if e != nil {
+			return e
+		}
+		members, err = s.db(cn).ZRangeByLex(ss[0], r, rev, offset, count)
+	default:
+		start, e1 := strconv.Atoi(ss[1])
+		stop, e2 := strconv.Atoi(ss[2])
+		if e1 != nil || e2 != nil {
+			return notIntError
+		}
+		members, err = s.db(cn).ZRange(ss[0], start, stop, rev)
+	}
+	if err != nil {
+		return
+	}
+	writeZMembers(cn.wr, members, withScores)
+	return
+}
+
+func (s *server) handleZPop(cn *Conn, ss []string, pop func(string, int) ([]ZMember, error)) (err error) {
+	if len(ss) != 1 && len(ss) != 2 {
+		return arityError
+	}
+	count := 1
+	if len(ss) == 2 {
+		if count, err = strconv.Atoi(ss[1]); err != nil {
+			return notIntError
+		}
+		if count < 0 {
+			return notPositiveError
+		}
+	}
+	members, err := pop(ss[0], count)
+	if err != nil {
+		return
+	}
+	writeZMembers(cn.wr, members, true)
+	return
+}
+
+func (s *server) handleZSetOperationStore(cn *Conn, ss []string, op func(string, []string, []float64, int) (int, error)) (err error) {
+	numKeys, err := strconv.Atoi(ss[1])
+	if err != nil {
+		return notIntError
+	}
+	if numKeys < 1 {
+		return errors.New("ERR at least 1 input key is needed")
+	}
+	if numKeys > len(ss)-2 {
+		return syntaxError
+	}
+	keys := ss[2 : 2+numKeys]
+	var weights []float64
+	aggregate := AggregateSum
+	for i := 2 + numKeys; i < len(ss); i++ {
+		switch strings.ToLower(ss[i]) {
+		case "weights":
+			if i+numKeys >= len(ss) {
+				return syntaxError
+			}
+			weights = make([]float64, numKeys)
+			for j := range weights {
+				if weights[j], err = parseFloat(ss[i+1+j]); err != nil {
+					return errors.New("ERR weight value is not a float")
+				}
+			}
+			i += numKeys
+		case "aggregate":
+			if i+1 >= len(ss) {
+				return syntaxError
+			}
+			switch strings.ToLower(ss[i+1]) {
+			case "sum":
+				aggregate = AggregateSum
+			case "min":
+				aggregate = AggregateMin
+			case "max":
+				aggregate = AggregateMax
+			default:
+				return syntaxError
+			}
+			i++
+		default:
+			return syntaxError
+		}
+	}
+	num, err := op(ss[0], keys, weights, aggregate)
+	if err != nil {
+		return
+	}
+	cn.wr.Int(num)
+	return
+}
+
+// writeZMembers replies with a flat array of members, each followed by
+// its score if withScores is set.
+func writeZMembers(wr *Writer, members []ZMember, withScores bool) {
+	if withScores {
+		wr.Array(len(members) * 2)
+	} else {
+		wr.Array(len(members))
+	}
+	for _, m := range members {
+		wr.String([]byte(m.Member))
+		if withScores {
+			wr.String([]byte(formatFloat(m.Score)))
+		}
+	}
+}
+
+func (s *server) handleKeys(cn *Conn, ss []string) (err error) {
+	keys := s.db(cn).Keys(ss[0])
+	buf := make([][]byte, len(keys))
+	for i, k := range keys {
+		buf[i] = []byte(k)
+	}
+	cn.wr.StringArray(buf)
+	return
+}
+
+// parseScanOptions parses the MATCH, COUNT and, if allowed, TYPE options
+// of the SCAN family.
+func parseScanOptions(ss []string, allowType bool) (pattern string, count int, typ string, err error) {
+	count = 10
+	for i := 0; i < len(ss); i += 2 {
+		if i+1 >= len(ss) {
+			return "", 0, "", syntaxError
+		}
+		switch strings.ToLower(ss[i]) {
+		case "match":
+			pattern = ss[i+1]
+			if pattern == "*" {
+				pattern = ""
+			}
+		case "count":
+			if count, err = strconv.Atoi(ss[i+1]); err != nil {
+				return "", 0, "", notIntError
+			}
+			if count < 1 {
+				return "", 0, "", syntaxError
+			}
+		case "type":
+			if !allowType {
+				return "", 0, "", syntaxError
+			}
+			typ = strings.ToLower(ss[i+1])
+		default:
+			return "", 0, "", syntaxError
+		}
+	}
+	return
+}
+
+func (s *server) handleScan(cn *Conn, ss []string) (err error) {
+	cursor, err := strconv.ParseUint(ss[0], 10, 63)
+	if err != nil {
+		return invalidCursor
+	}
+	pattern, count, typ, err := parseScanOptions(ss[1:], true)
+	if err != nil {
+		return
+	}
+	next, keys := s.db(cn).Scan(int(cursor), count, pattern, typ)
+	buf := make([][]byte, len(keys))
+	for i, k := range keys {
+		buf[i] = []byte(k)
+	}
+	cn.wr.Array(2)
+	cn.wr.String([]byte(strconv.Itoa(next)))
+	cn.wr.StringArray(buf)
+	return
+}
+
+// handleCollectionScan serves HSCAN, SSCAN and ZSCAN, which always
+// complete in a single call.
+func (s *server) handleCollectionScan(cn *Conn, ss []string, cmd string) (err error) {
+	if _, err = strconv.ParseUint(ss[1], 10, 63); err != nil {
+		return invalidCursor
+	}
+	pattern, _, _, err := parseScanOptions(ss[2:], false)
+	if err != nil {
+		return
+	}
+	var buf [][]byte
+	switch cmd {
+	case "hscan":
+		buf, err = s.db(cn).HScan(ss[0], pattern)
+	case "sscan":
+		buf, err = s.db(cn).SScan(ss[0], pattern)
+	case "zscan":
+		var members []ZMember
+		members, err = s.db(cn).ZScan(ss[0], pattern)
+		for _, m := range members {
+			buf = append(buf, []byte(m.Member), []byte(formatFloat(m.Score)))
+		}
+	}
+	if err != nil {
+		return
+	}
+	cn.wr.Array(2)
+	cn.wr.String([]byte("0"))
+	cn.wr.StringArray(buf)
+	return
+}
+
+func (s *server) handleType(cn *Conn, ss []string) (err error) {
+	cn.wr.Status(s.db(cn).Type(ss[0]))
+	return
+}
+
+func (s *server) handleRename(cn *Conn, ss []string, nx bool) (err error) {
+	ok, err := s.db(cn).Rename(ss[0], ss[1], nx)
+	if err != nil {
+		return
+	}
+	switch {
+	case !nx:
+		cn.wr.Status("OK")
+	case ok:
+		cn.wr.Int(1)
+	default:
+		cn.wr.Int(0)
+	}
+	return
+}
+
+func (s *server) handleCopy(cn *Conn, ss []string) (err error) {
+	var replace bool
+	for _, arg := range ss[2:] {
+		if strings.ToLower(arg) != "replace" {
+			return syntaxError
+		}
+		replace = true
+	}
+	num, err := s.db(cn).Copy(ss[0], ss[1], replace)
+	if err != nil {
+		return
+	}
+	cn.wr.Int(num)
+	return
+}
+
+func (s *server) handleRandomKey(cn *Conn, ss []string) (err error) {
+	if key, ok := s.db(cn).RandomKey(); ok {
+		cn.wr.String([]byte(key))
+	} else {
+		cn.wr.String(nil)
+	}
+	return
+}
+
+func (s *server) handleDBSize(cn *Conn, ss []string) (err error) {
+	cn.wr.Int(s.db(cn).DBSize())
+	return
+}
+
+func (s *server) handleTouch(cn *Conn, ss []string) (err error) {
+	cn.wr.Int(s.db(cn).Touch(ss))
+	return
+}
+
+func (s *server) handleUnlink(cn *Conn, ss []string) (err error) {
+	cn.wr.Int(s.db(cn).Unlink(ss))
+	return
+}
+
+func (s *server) handleDump(cn *Conn, ss []string) (err error) {
+	cn.wr.String(s.db(cn).Dump(ss[0]))
+	return
+}
+
+// handleRestore parses RESTORE key ttl payload [REPLACE] [ABSTTL]
+// [IDLETIME seconds] [FREQ frequency], a ttl of 0 means no expire.
+func (s *server) handleRestore(cn *Conn, ss []string) (err error) {
+	ttl, err := strconv.ParseInt(ss[1], 10, 64)
+	if err != nil {
+		return notIntError
+	}
+	if ttl < 0 {
+		return invalidTTL
+	}
+
+	var opt RestoreOptions
+	var absolute bool
+	for i := 3; i < len(ss); i++ {
+		switch arg := strings.ToLower(ss[i]); {
+		case arg == "replace":
+			opt.Replace = true
+		case arg == "absttl":
+			absolute = true
+		case arg == "idletime" && i+1 < len(ss) && !opt.SetFreq:
+			i++
+			n, err := strconv.ParseInt(ss[i], 10, 64)
+			if err != nil {
+				return notIntError
+			}
+			if n < 0 || n > math.MaxInt64/int64(time.Second) {
+				return invalidIdleTime
+			}
+			opt.IdleTime = time.Duration(n) * time.Second
+		case arg == "freq" && i+1 < len(ss) && opt.IdleTime == 0:
+			i++
+			n, err := strconv.ParseInt(ss[i], 10, 64)
+			if err != nil {
+				return notIntError
+			}
+			if n < 0 || n > 255 {
+				return invalidFreq
+			}
+			opt.Freq, opt.SetFreq = uint8(n), true
+		default:
+			return syntaxError
+		}
+	}
+	if ttl > 0 {
+		at, ok := toTime(ttl, time.Millisecond, absolute)
+		if !ok {
+			return invalidTTL
+		}
+		opt.Expire = at
+	}
+
+	if err = s.db(cn).Restore(ss[0], []byte(ss[2]), opt); err != nil {
+		return
+	}
+	cn.wr.Status("OK")
+	return
+}
+
+func (s *server) handleInfo(cn *Conn, ss []string) (err error) {
+	pid := os.Getpid()
+
+	info := []struct {
+		groupName string
+		kv        map[string]string
+	}{
+		{"Server", make(map[string]string)},
+		{"Clients", make(map[string]string)},
+		{"Memory", make(map[string]string)},
+		{"Persistence", make(map[string]string)},
+		{"Replication", make(map[string]string)},
+		{"Keyspace", make(map[string]string)},
+	}
+	info[0].kv["process_id"] = strconv.Itoa(pid)
+	info[0].kv["tcp_port"] = s.port
+	info[1].kv["connected_clients"] = strconv.Itoa(s.clientsCount)
+	dbs := s.allDBs()
+	for i, db := range dbs {
+		if keys := db.DBSize(); keys > 0 {
+			info[5].kv["db"+strconv.Itoa(i)] = fmt.Sprintf("keys=%d,expires=%d", keys, db.ExpiresCount())
+		}
+	}
+	info[2].kv["used_memory"] = strconv.Itoa(dbs[0].UsedMemory())
+	info[2].kv["maxmemory"] = strconv.Itoa(dbs[0].GetSizeLimit())
+	info[2].kv["maxmemory_policy"] = dbs[0].GetPolicy().String()
+	s.mu.Lock()
+	info[3].kv["rdb_changes_since_last_save"] = strconv.Itoa(s.dirty)
+	info[3].kv["rdb_bgsave_in_progress"] = boolInfo(s.saving)
+	info[3].kv["rdb_last_save_time"] = strconv.FormatInt(s.lastSave.Unix(), 10)
+	s.mu.Unlock()
+	info[3].kv["aof_enabled"] = boolInfo(s.aof != nil)
+	info[3].kv["aof_rewrite_in_progress"] = boolInfo(s.aof != nil && s.aof.rewriting())
+	s.replMu.Lock()
+	if s.master != nil {
+		info[4].kv["role"] = "slave"
+		info[4].kv["master_host"] = s.master.host
+		info[4].kv["master_port"] = s.master.port
+		status := "down"
+		if s.master.up {
+			status = "up"
+		}
+		info[4].kv["master_link_status"] = status
+		info[4].kv["slave_repl_offset"] = strconv.FormatInt(s.master.offset, 10)
+	} else {
+		info[4].kv["role"] = "master"
+	}
+	info[4].kv["connected_slaves"] = strconv.Itoa(len(s.replicas))
+	info[4].kv["master_replid"] = s.replID
+	info[4].kv["master_repl_offset"] = strconv.FormatInt(s.replOffset, 10)
+	s.replMu.Unlock()
+
+	sb := new(strings.Builder)
+	clrf := "\r\n"
+	for idx, i := range info {
+		sb.WriteString("# ")
+		sb.WriteString(i.groupName)
+		sb.WriteString(clrf)
+		for k, v := range i.kv {
+			sb.WriteString(k)
+			sb.WriteString(":")
+			sb.WriteString(v)
+			sb.WriteString(clrf)
+		}
+		if idx != len(info)-1 {
+			sb.WriteString(clrf)
+		}
+	}
+	cn.wr.String([]byte(sb.String()))
+	return
+}
+
+func boolInfo(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func (s *server) handleConfigSet(cn *Conn, ss []string) (err error) {
+	if len(ss) == 3 && ss[0] == "set" {
+		if ss[1] == "maxmemory" {
 			r := regexp.MustCompile(`^(\d+)mb$`)
 			match := r.FindStringSubmatch(ss[2])
 			if len(match) != 2 {
 				return fmt.Errorf("invalid maxmemory: %s", ss[2])
 			}
 			sizeLimit, _ := strconv.Atoi(match[1])
-			s.cache.SetSizeLimit(sizeLimit * 1024)
+			// the databases share the limit
+			s.db(cn).SetSizeLimit(sizeLimit * 1024)
 			cn.wr.Status("OK")
 			return
 		}
 		if ss[1] == "maxmemory-policy" {
+			policy, e := ParseEvictionPolicy(ss[2])
+			if e != nil {
+				return e
+			}
+			for _, db := range s.allDBs() {
+				db.SetPolicy(policy)
+			}
+			cn.wr.Status("OK")
+			return
+		}
+		if ss[1] == "dir" {
+			if fi, e := os.Stat(ss[2]); e != nil || !fi.IsDir() {
+				return fmt.Errorf("invalid dir: %s", ss[2])
+			}
+			s.mu.Lock()
+			s.dir = ss[2]
+			s.mu.Unlock()
+			cn.wr.Status("OK")
+			return
+		}
+		if ss[1] == "dbfilename" {
+			if ss[2] == "" || filepath.Base(ss[2]) != ss[2] {
+				return fmt.Errorf("invalid dbfilename: %s", ss[2])
+			}
+			s.mu.Lock()
+			s.dbFilename = ss[2]
+			s.mu.Unlock()
+			cn.wr.Status("OK")
+			return
+		}
+		if ss[1] == "save" {
+			rules, e := parseSaveRules(ss[2])
+			if e != nil {
+				return e
+			}
+			s.mu.Lock()
+			s.saveRules = rules
+			s.mu.Unlock()
+			cn.wr.Status("OK")
+			return
+		}
+		if ss[1] == "appendfsync" {
+			fsync, e := ParseFsyncPolicy(ss[2])
+			if e != nil {
+				return e
+			}
+			if s.aof != nil {
+				s.aof.setFsync(fsync)
+			}
+			cn.wr.Status("OK")
+			return
+		}
+		if ss[1] == "notify-keyspace-events" {
+			flags, e := parseNotifyFlags(ss[2])
+			if e != nil {
+				return e
+			}
+			atomic.StoreInt32(&s.notifyFlags, flags)
+			cn.wr.Status("OK")
+			return
+		}
+		if ss[1] == "lua-time-limit" || ss[1] == "busy-reply-threshold" {
+			ms, e := strconv.Atoi(ss[2])
+			if e != nil || ms <= 0 {
+				return fmt.Errorf("invalid %s: %s", ss[1], ss[2])
+			}
+			s.scriptMu.Lock()
+			s.scriptTimeLimit = time.Duration(ms) * time.Millisecond
+			s.scriptMu.Unlock()
+			cn.wr.Status("OK")
+			return
+		}
+		if ss[1] == "lfu-log-factor" || ss[1] == "lfu-decay-time" {
+			i, e := strconv.Atoi(ss[2])
+			if e != nil || i < 0 {
+				return fmt.Errorf("invalid %s: %s", ss[1], ss[2])
+			}
+			if ss[1] == "lfu-log-factor" {
+				for _, db := range s.allDBs() {
+					db.SetLFULogFactor(i)
+				}
+			} else {
+				for _, db := range s.allDBs() {
+					db.SetLFUDecayTime(i)
+				}
+			}
 			cn.wr.Status("OK")
 			return
 		}
 	}
 	return unsupportedRequest
 }
+
+// parseSaveRules parses the "<seconds> <changes> ..." format of the save
+// config, an empty string disables automatic saves.
+func parseSaveRules(arg string) ([]SaveRule, error) {
+	fields := strings.Fields(arg)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save: %s", arg)
+	}
+	rules := make([]SaveRule, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, e1 := strconv.Atoi(fields[i])
+		changes, e2 := strconv.Atoi(fields[i+1])
+		if e1 != nil || e2 != nil || seconds < 0 || changes < 0 {
+			return nil, fmt.Errorf("invalid save: %s", arg)
+		}
+		rules = append(rules, SaveRule{seconds, changes})
+	}
+	return rules, nil
+}
+
+func (s *server) handleObject(cn *Conn, ss []string) (err error) {
+	if strings.ToLower(ss[0]) == "freq" {
+		freq, exists, err := s.db(cn).Freq(ss[1])
+		if err != nil {
+			return err
+		}
+		if !exists {
+			cn.wr.String(nil)
+		} else {
+			cn.wr.Int(freq)
+		}
+	} else if strings.ToLower(ss[0]) == "idletime" {
+		idle, exists := s.db(cn).IdleTime(ss[1])
+		if !exists {
+			cn.wr.String(nil)
+		} else {
+			cn.wr.Int(int(idle / time.Second))
+		}
+	} else {
+		err = unsupportedRequest
+	}
+	return
+}
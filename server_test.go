@@ -3,7 +3,9 @@ package toyredis
 import (
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -152,4 +154,278 @@ func TestWithRedisCli(t *testing.T) {
 	time.Sleep(time.Millisecond * 60)
 	hasInteger("exists foo", 0)
 	hasInteger("hexists bar k1", 0)
+
+	// test lists
+	runCli("flushdb")
+	hasInteger("rpush foo b c d", 3)
+	hasInteger("lpush foo a", 4)
+	hasError("lpush foo", "(error) ERR wrong number of arguments")
+	hasStringArray("lrange foo 0 -1", []string{"a", "b", "c", "d"})
+	hasInteger("llen foo", 4)
+	hasString("lindex foo -1", "d")
+	isNil("lindex foo 10")
+	hasStatus("lset foo 1 B", "OK")
+	hasError("lset foo 10 x", "(error) ERR index out of range")
+	hasError("lset bar 0 x", "(error) ERR no such key")
+	hasInteger("linsert foo before c B", 5)
+	hasInteger("linsert foo after none x", -1)
+	hasInteger("lrem foo 0 B", 2)
+	hasStatus("ltrim foo 0 1", "OK")
+	hasStringArray("lrange foo 0 -1", []string{"a", "c"})
+	hasString("lpop foo", "a")
+	hasStringArray("rpop foo 2", []string{"c"})
+	isNil("lpop foo")
+	hasInteger("exists foo", 0)
+	hasStatus("set bar barValue", "OK")
+	hasError("lpush bar a", "(error) WRONGTYPE")
+
+	// test sets
+	runCli("flushdb")
+	hasInteger("sadd foo a b c", 3)
+	hasInteger("sadd foo c d", 1)
+	hasError("sadd foo", "(error) ERR wrong number of arguments")
+	hasInteger("scard foo", 4)
+	hasInteger("sismember foo a", 1)
+	hasInteger("srem foo a b none", 2)
+	hasStatus("smismember foo c none", "1) (integer) 1\n2) (integer) 0")
+	hasInteger("sadd bar d e", 2)
+	hasStringArray("sinter foo bar", []string{"d"})
+	hasStringArray("sdiff bar foo", []string{"e"})
+	hasInteger("sunionstore baz foo bar", 3)
+	hasInteger("smove baz foo e", 1)
+	hasInteger("scard foo", 3)
+	hasInteger("sinterstore baz foo none", 0)
+	hasInteger("exists baz", 0)
+	hasInteger("srem bar d", 1)
+	hasStringArray("smembers bar", []string{"e"})
+	hasString("spop bar", "e")
+	isNil("spop bar")
+	hasStatus("set str strValue", "OK")
+	hasError("sadd str a", "(error) WRONGTYPE")
+
+	// test sorted sets
+	runCli("flushdb")
+	hasInteger("zadd foo 1 a 2 b 3 c", 3)
+	hasInteger("zadd foo nx 10 a 4 d", 1)
+	hasInteger("zadd foo xx ch 1.5 a 5 e", 1)
+	hasError("zadd foo nx xx 1 a", "(error) ERR XX and NX options at the same time are not compatible")
+	hasError("zadd foo nx 1", "(error) ERR syntax error")
+	hasError("zadd foo x a", "(error) ERR value is not a valid float")
+	hasString("zadd foo incr 2 a", "3.5")
+	isNil("zadd foo gt incr -1 a")
+	hasString("zscore foo a", "3.5")
+	hasString("zincrby foo -0.5 a", "3")
+	hasInteger("zcard foo", 4)
+	hasStringArray("zrange foo 0 -1", []string{"b", "a", "c", "d"})
+	hasStringArray("zrange foo 0 1 withscores", []string{"b", "2", "a", "3"})
+	hasStringArray("zrange foo +inf (3 byscore rev", []string{"d"})
+	hasStringArray("zrange foo -inf +inf byscore limit 1 2", []string{"a", "c"})
+	hasError("zrange foo 0 1 limit 0 1", "(error) ERR syntax error")
+	hasInteger("zrank foo c", 2)
+	hasInteger("zrevrank foo c", 1)
+	isNil("zrank foo none")
+	hasInteger("zcount foo (2 3", 2)
+	hasInteger("zrem foo a none", 1)
+	hasStringArray("zpopmin foo", []string{"b", "2"})
+	hasStringArray("zpopmax foo 2", []string{"d", "4", "c", "3"})
+	hasInteger("exists foo", 0)
+	hasInteger("zadd bar 0 a 0 b 0 c", 3)
+	hasStringArray("zrange bar [b + bylex", []string{"b", "c"})
+	hasInteger("zadd baz 1 b 2 c", 2)
+	hasInteger("zinterstore out 2 bar baz weights 1 3", 2)
+	hasStringArray("zrange out 0 -1 withscores", []string{"b", "3", "c", "6"})
+	hasInteger("zunionstore out 2 bar baz aggregate max", 3)
+	hasString("zscore out c", "2")
+
+	// test set options
+	runCli("flushdb")
+	hasStatus("set foo v1 nx px 100", "OK")
+	isNil("set foo v2 nx")
+	hasString("set foo v3 xx get keepttl", "v1")
+	isNil("set bar v1 xx")
+	hasError("set foo v1 nx xx", "(error) ERR syntax error")
+	hasError("set foo v1 ex 10 px 100", "(error) ERR syntax error")
+	hasError("set foo v1 ex 0", "(error) ERR invalid expire time in 'set' command")
+	hasInteger("setnx bar v1", 1)
+	hasInteger("setnx bar v2", 0)
+	hasString("getset bar v3", "v1")
+	hasStatus("psetex baz 100 v1", "OK")
+	hasString("getex bar px 100", "v3")
+	time.Sleep(time.Millisecond * 110)
+	isNil("get foo")
+	isNil("get bar")
+	isNil("get baz")
+	hasStatus("setex foo 100 v1", "OK")
+	hasString("getex foo persist", "v1")
+	hasString("getdel foo", "v1")
+	isNil("getdel foo")
+	hasInteger("sadd set a", 1)
+	hasStatus("set set v1", "OK")
+	hasString("get set", "v1")
+
+	// test counters
+	runCli("flushdb")
+	hasInteger("incr foo", 1)
+	hasInteger("incrby foo 10", 11)
+	hasInteger("decr foo", 10)
+	hasInteger("decrby foo -5", 15)
+	hasError("incrby foo x", "(error) ERR value is not an integer or out of range")
+	hasString("incrbyfloat foo 0.5", "15.5")
+	hasError("incr foo", "(error) ERR value is not an integer or out of range")
+	hasString("incrbyfloat foo 5.0e3", "5015.5")
+	hasStatus("set bar 9223372036854775807", "OK")
+	hasError("incr bar", "(error) ERR increment or decrement would overflow")
+	hasInteger("hincrby baz f 3", 3)
+	hasString("hincrbyfloat baz f 1.25", "4.25")
+	hasError("hincrby baz f 1", "(error) ERR hash value is not an integer")
+	hasInteger("sadd set a", 1)
+	hasError("incr set", "(error) WRONGTYPE")
+
+	// test maxmemory-policy
+	runCli("flushdb")
+	hasError("config set maxmemory-policy foo", "(error) invalid maxmemory-policy: foo")
+	hasStatus("config set maxmemory-policy noeviction", "OK")
+	hasStatus("config set maxmemory 1mb", "OK")
+	hasStatus("set foo "+strings.Repeat("x", 2000), "OK")
+	hasError("set bar barValue", "(error) OOM command not allowed")
+	hasError("hset bar k1 v1", "(error) OOM command not allowed")
+	// denied even if it would not add anything
+	hasError("setnx foo x", "(error) OOM command not allowed")
+	hasInteger("exists foo", 1)
+	hasInteger("del foo", 1)
+	hasStatus("set bar barValue", "OK")
+	hasStatus("config set maxmemory-policy allkeys-lru", "OK")
+	hasStatus("config set maxmemory 20480mb", "OK")
+
+	// test object freq
+	runCli("flushdb")
+	hasStatus("set foo fooValue", "OK")
+	hasError("object freq foo", "(error) ERR An LFU maxmemory policy is not selected")
+	hasStatus("config set maxmemory-policy allkeys-lfu", "OK")
+	hasStatus("config set lfu-log-factor 0", "OK")
+	hasInteger("object freq foo", 5)
+	hasString("get foo", "fooValue")
+	hasInteger("object freq foo", 6)
+	isNil("object freq bar")
+	hasStatus("config set lfu-log-factor 10", "OK")
+	hasStatus("config set maxmemory-policy allkeys-lru", "OK")
+
+	// test ttl
+	runCli("flushdb")
+	hasStatus("set foo fooValue", "OK")
+	hasInteger("ttl foo", -1)
+	hasInteger("ttl bar", -2)
+	hasInteger("pexpiretime foo", -1)
+	hasInteger("expire foo 100 xx", 0)
+	hasInteger("expire foo 100 nx", 1)
+	hasInteger("ttl foo", 100)
+	hasInteger("expire foo 50 gt", 0)
+	hasInteger("expire foo 50 lt", 1)
+	hasError("expire foo 50 nx gt", "(error) ERR NX and XX, GT or LT options at the same time are not compatible")
+	hasInteger("expireat foo 33177117420", 1)
+	hasInteger("expiretime foo", 33177117420)
+	hasInteger("pexpiretime foo", 33177117420000)
+	hasInteger("persist foo", 1)
+	hasInteger("persist foo", 0)
+	hasInteger("pttl foo", -1)
+	hasInteger("pexpireat foo 1000", 1)
+	hasInteger("exists foo", 0)
+	hasStatus("set foo fooValue", "OK")
+	hasInteger("expire foo -1", 1)
+	hasInteger("exists foo", 0)
+
+	// test keys and scan
+	runCli("flushdb")
+	hasStatus("mset foo 1 bar 2", "OK")
+	hasInteger("sadd baz a b", 2)
+	hasStatus("hset hash k1 v1", "OK")
+	hasStringArray("keys f*", []string{"foo"})
+	hasStringArray("keys ba[r]", []string{"bar"})
+	hasStatus("scan 0 match b* type set", "1) \"0\"\n2) 1) \"baz\"")
+	hasStatus("sscan baz 0 match a", "1) \"0\"\n2) 1) \"a\"")
+	hasStatus("hscan hash 0", "1) \"0\"\n2) 1) \"k1\"\n   2) \"v1\"")
+	hasError("scan x", "(error) ERR invalid cursor")
+	hasError("scan 0 count", "(error) ERR syntax error")
+
+	// test key commands
+	runCli("flushdb")
+	hasStatus("set foo bar", "OK")
+	hasInteger("sadd set a", 1)
+	hasStatus("type set", "set")
+	hasStatus("type none", "none")
+	hasStatus("rename foo baz", "OK")
+	hasError("rename foo baz", "(error) ERR no such key")
+	hasInteger("renamenx baz set", 0)
+	hasInteger("copy baz foo", 1)
+	hasInteger("copy set foo", 0)
+	hasInteger("copy set foo replace", 1)
+	hasError("copy foo foo", "(error) ERR source and destination objects are the same")
+	hasStatus("type foo", "set")
+	hasInteger("dbsize", 3)
+	hasInteger("touch foo none", 1)
+	hasInteger("unlink foo baz none", 2)
+	hasString("randomkey", "set")
+
+	// test databases
+	runCli("flushall")
+	hasStatus("set foo bar", "OK")
+	hasStatus("-n 1 set foo baz", "OK")
+	hasString("-n 1 get foo", "baz")
+	hasError("-n 16 get foo", "(error) ERR DB index is out of range")
+	hasInteger("-n 1 move foo 2", 1)
+	hasInteger("move foo 2", 0)
+	hasString("-n 2 get foo", "baz")
+	hasStatus("swapdb 0 2", "OK")
+	hasString("get foo", "baz")
+	hasString("-n 2 get foo", "bar")
+	hasError("move foo 0", "(error) ERR source and destination objects are the same")
+	if info := runCli("info"); !strings.Contains(info, "db2:keys=1,expires=0") {
+		t.Errorf("keyspace info missing, got %s", info)
+	}
+	hasStatus("flushall", "OK")
+	isNil("-n 2 get foo")
+
+	// test snapshot
+	dir := t.TempDir()
+	hasStatus("config set dir "+dir, "OK")
+	hasError("config set dir "+dir+"/none", "(error) invalid dir: "+dir+"/none")
+	hasStatus("set foo bar", "OK")
+	hasStatus("save", "OK")
+	if _, err := os.Stat(filepath.Join(dir, "dump.rdb")); err != nil {
+		t.Error(err)
+	}
+	if lastSave, _ := strconv.Atoi(strings.TrimPrefix(runCli("lastsave"), "(integer) ")); time.Now().Unix()-int64(lastSave) > 1 {
+		t.Errorf("bad lastsave %d", lastSave)
+	}
+	hasStatus("bgsave", "Background saving started")
+	// wait for the background save before the directory is removed
+	for i := 0; runCli("save") != "OK"; i++ {
+		if i == 100 {
+			t.Fatal("background save did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSnapshotOnStartup(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		Port:      "6790",
+		SizeLimit: 20,
+		Dir:       dir,
+		SaveRules: []SaveRule{{Seconds: 0, Changes: 1}},
+	}
+	server := NewServerWithConfig(cfg)
+	sendCommands(t, cfg.Port, []string{"select", "3"}, []string{"set", "foo", "bar"})
+
+	// the save rule saves on the next tick
+	time.Sleep(300 * time.Millisecond)
+	server.Stop()
+
+	cfg.Port = "6791"
+	server = NewServerWithConfig(cfg)
+	defer server.Stop()
+	if v, _ := server.dbs[3].Get("foo"); string(v) != "bar" {
+		t.Fatalf("expected bar, got %s", v)
+	}
 }
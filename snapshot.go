@@ -0,0 +1,209 @@
+package toyredis
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// Snapshots were written in this format before they were written as RDB
+// files, and are still loaded on startup. A snapshot starts with
+// snapshotMagic and a version byte. Then every database that has keys is
+// written as opSelectDB and its index followed by its entries, and the
+// file ends with opEOF and the CRC-32 of all the bytes before it.
+//
+// An entry is its value type, its expire in unix milliseconds (0 if it
+// has none), the key and the value. Lengths and counts are uvarints,
+// strings are length prefixed and scores are the bits of a float64.
+
+const (
+	snapshotMagic   = "TOYREDIS"
+	snapshotVersion = 1
+
+	opSelectDB = 0xfe
+	opEOF      = 0xff
+)
+
+const (
+	typeString byte = iota
+	typeHash
+	typeList
+	typeSet
+	typeZSet
+)
+
+var corruptSnapshot = errors.New("corrupt snapshot")
+
+type snapshotReader struct {
+	br  *bufio.Reader
+	crc hash.Hash32
+}
+
+func (r *snapshotReader) ReadByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	r.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (r *snapshotReader) read(n uint64) ([]byte, error) {
+	// do not trust n for the allocation
+	p := make([]byte, 0, minUint64(n, 4096))
+	for uint64(len(p)) < n {
+		chunk := make([]byte, minUint64(n-uint64(len(p)), 4096))
+		if _, err := io.ReadFull(r.br, chunk); err != nil {
+			return nil, err
+		}
+		p = append(p, chunk...)
+	}
+	r.crc.Write(p)
+	return p, nil
+}
+
+func (r *snapshotReader) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(r)
+}
+
+func (r *snapshotReader) readString() ([]byte, error) {
+	n, err := r.readUvarint()
+	if err != nil {
+		return nil, err
+	}
+	return r.read(n)
+}
+
+func (r *snapshotReader) readValue(typ byte) (value interface{}, err error) {
+	if typ == typeString {
+		return r.readString()
+	}
+
+	n, err := r.readUvarint()
+	if err != nil {
+		return
+	}
+	switch typ {
+	case typeHash:
+		h := make(map[string][]byte)
+		for i := uint64(0); i < n; i++ {
+			vk, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			if h[string(vk)], err = r.readString(); err != nil {
+				return nil, err
+			}
+		}
+		return h, nil
+	case typeList:
+		l := list.New()
+		for i := uint64(0); i < n; i++ {
+			v, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			l.PushBack(v)
+		}
+		return l, nil
+	case typeSet:
+		set := make(map[string]struct{})
+		for i := uint64(0); i < n; i++ {
+			m, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			set[string(m)] = struct{}{}
+		}
+		return set, nil
+	case typeZSet:
+		zs := newZset()
+		for i := uint64(0); i < n; i++ {
+			m, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			b, err := r.read(8)
+			if err != nil {
+				return nil, err
+			}
+			score := math.Float64frombits(binary.LittleEndian.Uint64(b))
+			if _, ok := zs.dict[string(m)]; ok || math.IsNaN(score) {
+				return nil, corruptSnapshot
+			}
+			zs.zsl.insert(score, string(m))
+			zs.dict[string(m)] = score
+		}
+		return zs, nil
+	}
+	return nil, corruptSnapshot
+}
+
+// readSnapshot loads a snapshot into dbs. Keys that have expired in the
+// meantime are skipped.
+func readSnapshot(rd io.Reader, dbs []*Cache) error {
+	r := &snapshotReader{
+		br:  bufio.NewReader(rd),
+		crc: crc32.NewIEEE(),
+	}
+	header, err := r.read(uint64(len(snapshotMagic) + 1))
+	if err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return corruptSnapshot
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return errors.New("unsupported snapshot version")
+	}
+
+	var db *Cache
+	now := time.Now()
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return corruptSnapshot
+		}
+		switch {
+		case op == opEOF:
+			sum := r.crc.Sum32()
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(r.br, b); err != nil || binary.LittleEndian.Uint32(b) != sum {
+				return corruptSnapshot
+			}
+			return nil
+		case op == opSelectDB:
+			i, err := r.readUvarint()
+			if err != nil || i >= uint64(len(dbs)) {
+				return corruptSnapshot
+			}
+			db = dbs[i]
+		case op <= typeZSet && db != nil:
+			ms, err := r.readUvarint()
+			if err != nil {
+				return corruptSnapshot
+			}
+			key, err := r.readString()
+			if err != nil {
+				return corruptSnapshot
+			}
+			value, err := r.readValue(op)
+			if err != nil {
+				return corruptSnapshot
+			}
+			expire := nilTime
+			if ms != 0 {
+				expire = time.Unix(0, int64(ms)*int64(time.Millisecond))
+				if expire.Before(now) {
+					continue
+				}
+			}
+			db.load(string(key), value, expire)
+		default:
+			return corruptSnapshot
+		}
+	}
+}
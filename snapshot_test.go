@@ -0,0 +1,55 @@
+package toyredis
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	dst := []*Cache{NewCache(MB), NewCache(MB)}
+	if err := readRDBFile("testdata/toyredis_snapshot.rdb", dst); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := dst[0].Get("str"); string(v) != "foo" {
+		t.Fatalf("expected foo, got %s", v)
+	}
+	if _, exists := dst[0].ExpireTime("str"); !exists {
+		t.Fatal("expire should be kept.")
+	}
+	if dst[0].Exists("gone") != 0 {
+		t.Fatal("expired keys should not be loaded.")
+	}
+	if v, _ := dst[0].HGet("hash", "k"); string(v) != "v" {
+		t.Fatalf("expected v, got %s", v)
+	}
+	if v, _ := dst[1].LRange("list", 0, -1); fmt.Sprintf("%s", v) != "[a b]" {
+		t.Fatalf("expected [a b], got %s", v)
+	}
+	if n, _ := dst[1].SCard("set"); n != 2 {
+		t.Fatalf("expected 2 members, got %d", n)
+	}
+	if members, _ := dst[1].ZRange("zset", 0, -1, false); fmt.Sprint(members) != "[{b -2} {a 1.5}]" {
+		t.Fatalf("bad zset %v", members)
+	}
+
+	data, err := os.ReadFile("testdata/toyredis_snapshot.rdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{3, len(data) / 2, len(data) - 1} {
+		corrupted := append([]byte(nil), data...)
+		corrupted[i] ^= 0xff
+		if err := readSnapshot(bytes.NewReader(corrupted), []*Cache{NewCache(MB), NewCache(MB)}); err != corruptSnapshot {
+			t.Fatalf("expected %v for byte %d, got %v", corruptSnapshot, i, err)
+		}
+	}
+	if err := readSnapshot(bytes.NewReader(data[:len(data)-5]), dst); err != corruptSnapshot {
+		t.Fatalf("expected %v for a truncated snapshot, got %v", corruptSnapshot, err)
+	}
+
+	for _, c := range dst {
+		c.Stop()
+	}
+}